@@ -29,14 +29,14 @@ main() {
   echo
   info "specious"
 
-  local benchmarks="fillseq,readseq,init,fillrandom,readrandom,\
+  local benchmarks="fillseq,readseq,init,fillbatch,init,fillrandom,readrandom,\
 fs-write,fs-read"
   "$BENCH_BIN" -db specious -final-compact -delete-db \
                -benchmarks="$benchmarks" "$@"
 
   echo
   info "leveldb"
-  local benchmarks="fillseq,readseq,init,fillrandom,readrandom"
+  local benchmarks="fillseq,readseq,init,fillbatch,init,fillrandom,readrandom"
   "$BENCH_BIN" -db leveldb -final-compact -delete-db \
                -benchmarks="$benchmarks" "$@"
 }
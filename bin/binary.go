@@ -3,30 +3,68 @@ package bin
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
 // Simple binary parsing/serialization library.
+//
+// Errors are sticky: once decoding runs out of data (or encoding fails to
+// write), all further operations do nothing, and the error is reported by Err.
+// This allows decoding a whole structure and checking for errors once at the
+// end.
+
+// ErrCorrupt is the error reported when there is not enough data to decode a
+// value, which indicates the data is corrupt.
+var ErrCorrupt = errors.New("corrupt data")
 
 // Decoder streams binary data from a byte buffer.
 type Decoder struct {
 	buf []byte
+	err error
 }
 
 // NewDecoder creates a decoder that parses data from buffer b.
 //
 // Retains b, which the caller should not use afterward.
 func NewDecoder(b []byte) *Decoder {
-	return &Decoder{b}
+	return &Decoder{buf: b}
 }
 
 // RemainingBytes gives the number of bytes remaining in the buffer.
+//
+// After an error, there are no remaining bytes.
 func (r Decoder) RemainingBytes() int {
 	return len(r.buf)
 }
 
+// Err returns the first error encountered while decoding, if any.
+func (r Decoder) Err() error {
+	return r.err
+}
+
+// Fail records an error, stopping further decoding.
+//
+// This allows callers to report their own decoding errors (for example, an
+// invalid tag) through the decoder.
+func (r *Decoder) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.buf = nil
+}
+
 // Bytes is a primitive decoder that reads a fixed number of bytes.
+//
+// If there are fewer than n bytes remaining, returns nil and fails with
+// ErrCorrupt.
 func (r *Decoder) Bytes(n int) []byte {
+	if n < 0 || n > len(r.buf) {
+		r.Fail(fmt.Errorf("%w: need %d bytes but only %d remain",
+			ErrCorrupt, n, len(r.buf)))
+		return nil
+	}
 	d := r.buf[:n]
 	r.buf = r.buf[n:]
 	return d
@@ -37,6 +75,7 @@ type Encoder struct {
 	w io.Writer
 	// total bytes written since initialization
 	bytesWritten int
+	err          error
 }
 
 // NewEncoder creates an encoder that writes data to w.
@@ -50,14 +89,20 @@ func (w Encoder) BytesWritten() int {
 	return w.bytesWritten
 }
 
+// Err returns the first error encountered while encoding, if any.
+func (w Encoder) Err() error {
+	return w.err
+}
+
 // Bytes is a primitive encoder that copies bytes.
 func (w *Encoder) Bytes(b []byte) {
-	for {
+	for w.err == nil {
 		n, err := w.w.Write(b)
+		w.bytesWritten += n
 		if err != nil {
-			panic(err)
+			w.err = err
+			return
 		}
-		w.bytesWritten += n
 		if n == len(b) {
 			return
 		}
@@ -67,24 +112,38 @@ func (w *Encoder) Bytes(b []byte) {
 
 // Uint64 decodes a uint64 (in little endian format).
 func (r *Decoder) Uint64() uint64 {
-	return binary.LittleEndian.Uint64(r.Bytes(8))
+	b := r.Bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
 }
 
 // Uint32 decodes a uint32 (in little endian format).
 func (r *Decoder) Uint32() uint32 {
-	return binary.LittleEndian.Uint32(r.Bytes(4))
+	b := r.Bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
 }
 
 // Uint16 decodes a uint16 (in little endian format).
 func (r *Decoder) Uint16() uint16 {
-	return binary.LittleEndian.Uint16(r.Bytes(2))
+	b := r.Bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
 }
 
 // Uint8 decodes a uint8
 func (r *Decoder) Uint8() uint8 {
-	b := r.buf[0]
-	r.buf = r.buf[1:]
-	return b
+	b := r.Bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
 }
 
 // Array16 decodes an array prefixed with a 16-byte length.
@@ -117,10 +176,7 @@ func (w *Encoder) Uint16(v uint16) {
 
 // Uint8 encodes a uint8
 func (w *Encoder) Uint8(b uint8) {
-	_, err := w.w.Write([]byte{b})
-	if err != nil {
-		panic(err)
-	}
+	w.Bytes([]byte{b})
 }
 
 // Array16 encodes an array prefixed with a 16-byte length.
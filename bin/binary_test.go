@@ -2,7 +2,9 @@ package bin
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -137,3 +139,42 @@ func TestVarInt(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeShort(t *testing.T) {
+	assert := assert.New(t)
+	r := NewDecoder([]byte{1, 2, 3})
+	assert.Equal(uint16(0x0201), r.Uint16())
+	assert.NoError(r.Err())
+	assert.Equal(uint32(0), r.Uint32(), "short read should produce zero")
+	assert.True(errors.Is(r.Err(), ErrCorrupt), "short read should be corruption")
+	assert.Equal(0, r.RemainingBytes(), "decoder should stop after an error")
+	assert.Equal(uint8(0), r.Uint8())
+	assert.Nil(r.Array())
+	assert.True(errors.Is(r.Err(), ErrCorrupt), "error should be sticky")
+}
+
+type failingWriter struct {
+	remaining int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.remaining {
+		n := w.remaining
+		w.remaining = 0
+		return n, io.ErrShortWrite
+	}
+	w.remaining -= len(p)
+	return len(p), nil
+}
+
+func TestEncodeError(t *testing.T) {
+	assert := assert.New(t)
+	e := NewEncoder(&failingWriter{remaining: 6})
+	e.Uint32(1)
+	assert.NoError(e.Err())
+	e.Uint32(2)
+	assert.Equal(io.ErrShortWrite, e.Err())
+	assert.Equal(6, e.BytesWritten())
+	e.Uint8(3)
+	assert.Equal(6, e.BytesWritten(), "encoder should stop after an error")
+}
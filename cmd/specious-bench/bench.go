@@ -3,9 +3,12 @@ package main
 import (
 	"fmt"
 	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/tchajed/specious-db/db"
+	"github.com/tchajed/specious-db/fs"
 )
 
 type generator struct {
@@ -25,25 +28,40 @@ func (g generator) ReSeed(i int64) {
 func (g *generator) NextKey() db.Key {
 	k := g.key
 	g.key++
-	return db.Key(k)
+	return db.Uint64Key(k)
 }
 
 func (g generator) RandomKey(max int) db.Key {
 	n := g.Rand.Int63n(int64(max))
-	return db.Key(uint64(n))
+	return db.Uint64Key(uint64(n))
 }
 
+// Value generates a value that compresses to about *compressionRatio of its
+// size, by repeating a random fragment (as LevelDB's benchmarks do).
 func (g generator) Value() []byte {
-	b := make([]byte, 100)
-	g.Read(b)
+	b := make([]byte, *valueSize)
+	n := int(float64(len(b)) * *compressionRatio)
+	if n < 1 {
+		n = 1
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	g.Read(b[:n])
+	for i := n; i < len(b); i += n {
+		copy(b[i:], b[:n])
+	}
 	return b
 }
 
 type stats struct {
 	Ops   int
 	Bytes int
-	Start time.Time
-	End   *time.Time
+	// DiskBytes is the number of bytes the benchmark transferred to or from
+	// the filesystem, which reflects compression (0 if unknown)
+	DiskBytes int
+	Start     time.Time
+	End       *time.Time
 }
 
 func newStats() *stats {
@@ -81,6 +99,11 @@ func (s stats) MegabytesPerSec() float64 {
 	return mb / s.seconds()
 }
 
+func (s stats) DiskMegabytesPerSec() float64 {
+	mb := float64(s.DiskBytes) / (1024 * 1024)
+	return mb / s.seconds()
+}
+
 func (s stats) formatStats() string {
 	if s.Bytes == 0 {
 		if s.Ops == 1 {
@@ -88,9 +111,15 @@ func (s stats) formatStats() string {
 		}
 		return fmt.Sprintf("%7.3f micros/op", s.MicrosPerOp())
 	}
-	return fmt.Sprintf("%7.3f micros/op; %6.1f MB/s",
+	if s.DiskBytes == 0 {
+		return fmt.Sprintf("%7.3f micros/op; %6.1f MB/s",
+			s.MicrosPerOp(),
+			s.MegabytesPerSec())
+	}
+	return fmt.Sprintf("%7.3f micros/op; %6.1f MB/s; %6.1f MB/s on disk",
 		s.MicrosPerOp(),
-		s.MegabytesPerSec())
+		s.MegabytesPerSec(),
+		s.DiskMegabytesPerSec())
 }
 
 // BenchState tracks information for a single benchmark.
@@ -98,15 +127,55 @@ type BenchState struct {
 	name string
 	*generator
 	*stats
+	fs fs.Filesys
+	// fsStart is the filesystem's stats at the start of the benchmark
+	fsStart fs.Stats
+}
+
+// NewBench initializes a BenchState for a benchmark using filesys.
+func NewBench(name string, filesys fs.Filesys) BenchState {
+	return BenchState{name, newGenerator(), newStats(), filesys, filesys.GetStats()}
 }
 
-// NewBench initializes a BenchState.
-func NewBench(name string) BenchState {
-	return BenchState{name, newGenerator(), newStats()}
+// parallelFill runs a fill benchmark with *numWriters goroutines, which split
+// the entries evenly.
+//
+// Each goroutine calls fill for its entries [start, end) with its own generator
+// (positioned at start for sequential keys) and stats, which are then added to
+// the benchmark's stats.
+func (s BenchState) parallelFill(fill func(g *generator, start, end int, s *stats)) {
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	for w := 0; w < *numWriters; w++ {
+		start := *numEntries * w / *numWriters
+		end := *numEntries * (w + 1) / *numWriters
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			g := newGenerator()
+			g.ReSeed(int64(w))
+			g.key = uint64(start)
+			var local stats
+			fill(g, start, end, &local)
+			m.Lock()
+			s.Ops += local.Ops
+			s.Bytes += local.Bytes
+			m.Unlock()
+		}(w, start, end)
+	}
+	wg.Wait()
 }
 
 // Report finishes the benchmark and prints final statistics.
 func (s BenchState) Report() {
 	s.stats.done()
+	fsEnd := s.fs.GetStats()
+	// read benchmarks are measured by what they read from disk, and write
+	// benchmarks by what they write (including compactions)
+	if strings.Contains(s.name, "read") {
+		s.DiskBytes = fsEnd.ReadBytes - s.fsStart.ReadBytes
+	} else {
+		s.DiskBytes = fsEnd.WriteBytes - s.fsStart.WriteBytes
+	}
 	fmt.Printf("%-20s : %s\n", s.name, s.stats.formatStats())
 }
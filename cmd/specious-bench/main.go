@@ -21,14 +21,22 @@ const dbPath = "benchmark.db"
 
 type database interface {
 	db.Store
-	Compact()
+	Compact() error
+}
+
+// check aborts the benchmark on an error
+func check(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func initFs() fs.Filesys {
 	switch *fsType {
 	case "dir":
-		filesys := fs.DirFs(dbPath)
-		fs.DeleteAll(filesys)
+		filesys, err := fs.DirFs(dbPath)
+		check(err)
+		check(fs.DeleteAll(filesys))
 		return filesys
 	case "mem":
 		return fs.MemFs()
@@ -36,22 +44,50 @@ func initFs() fs.Filesys {
 	return nil
 }
 
+// speciousOptions configures specious-db from the command-line flags
+func speciousOptions() *db.Options {
+	opts := db.DefaultOptions()
+	if *syncInterval > 0 {
+		opts.Sync = db.SyncPeriodic
+		opts.SyncInterval = *syncInterval
+	}
+	if *syncWrites {
+		opts.Sync = db.SyncAlways
+	}
+	switch *compression {
+	case "none":
+		opts.Compression = db.NoCompression
+	case "flate":
+		opts.Compression = db.FlateCompression
+	default:
+		log.Fatalf("unknown compression %s", *compression)
+	}
+	return &opts
+}
+
 func initDb(filesys fs.Filesys) database {
 	switch *dbType {
-	case "specious":
-		fs.DeleteAll(filesys)
-		return db.Init(filesys)
-	case "specious-mem":
-		return db.Init(filesys)
+	case "specious", "specious-mem":
+		check(db.Destroy(filesys))
+		database, err := db.Init(filesys, speciousOptions())
+		check(err)
+		return database
 	case "leveldb":
 		os.RemoveAll(dbPath)
-		return leveldb.New(dbPath)
+		database, err := leveldb.New(dbPath)
+		check(err)
+		return database
 	case "mem":
 		return memdb.New()
 	}
 	panic(fmt.Errorf("unknown database type %s", *dbType))
 }
 
+// newWriteBatch is db.NewWriteBatch, for use where the db package is shadowed
+func newWriteBatch() *db.WriteBatch {
+	return db.NewWriteBatch()
+}
+
 func showNum(i int) string {
 	if i > 2e6 {
 		if i%1e6 == 0 {
@@ -73,6 +109,13 @@ var dbType = flag.String("db", "specious", "database to use (specious|leveldb|me
 var fsType = flag.String("fs", "dir", "filesystem to use for specious-db (dir|mem)")
 var numEntries = flag.Int("entries", 1000000, "number of entries to put in database")
 var numReads = flag.Int("reads", -1, "number of reads to perform (-1 to copy entries)")
+var valueSize = flag.Int("value-size", 100, "size of each value in bytes")
+var compressionRatio = flag.Float64("compression-ratio", 0.5, "fraction of its size each value compresses to")
+var compression = flag.String("compression", "none", "table compression for specious-db (none|flate)")
+var batchSize = flag.Int("batch-size", 100, "number of entries per write batch for fillbatch")
+var numWriters = flag.Int("writers", 1, "number of goroutines writing concurrently in fill benchmarks")
+var syncWrites = flag.Bool("sync", false, "sync the log after every write (specious-db only)")
+var syncInterval = flag.Duration("sync-interval", 0, "sync the log periodically at this interval (specious-db only)")
 var finalCompact = flag.Bool("final-compact", false, "force a compaction at end of benchmark")
 var deleteDatabase = flag.Bool("delete-db", false, "delete database directory on completion")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
@@ -92,7 +135,8 @@ func writeMemProfile(fname string) {
 }
 
 func writeFile(sz int, data []byte, s *stats, fs fs.Filesys) {
-	f := fs.Create("benchfile")
+	f, err := fs.Create("benchfile")
+	check(err)
 	for sz > 0 {
 		buf := data
 		if sz < len(data) {
@@ -105,15 +149,16 @@ func writeFile(sz int, data []byte, s *stats, fs fs.Filesys) {
 		s.FinishedSingleOp(n)
 		sz -= n
 	}
-	f.Close()
+	check(f.Close())
 }
 
 func readFile(chunkSize int, s *stats, fs fs.Filesys) {
 	buf := make([]byte, chunkSize)
-	f := fs.Open("benchfile")
+	f, err := fs.Open("benchfile")
+	check(err)
 	defer func() {
 		f.Close()
-		fs.Delete("benchfile")
+		check(fs.Delete("benchfile"))
 	}()
 	for {
 		n, err := f.Read(buf)
@@ -144,44 +189,68 @@ func runBenchmarks(fs fs.Filesys, db database) time.Time {
 
 	benchmarkNames := strings.Split(*benchmarks, ",")
 	for _, name := range benchmarkNames {
-		s := NewBench(name)
+		s := NewBench(name, fs)
 		switch name {
 		case "fillseq":
-			for i := 0; i < *numEntries; i++ {
-				k, v := s.NextKey(), s.Value()
-				db.Put(k, v)
-				s.FinishedSingleOp(8 + len(v))
+			s.parallelFill(func(g *generator, start, end int, s *stats) {
+				for i := start; i < end; i++ {
+					k, v := g.NextKey(), g.Value()
+					check(db.Put(k, v))
+					s.FinishedSingleOp(len(k) + len(v))
+				}
+			})
+			if *finalCompact {
+				check(db.Compact())
 			}
+		case "fillbatch":
+			s.parallelFill(func(g *generator, start, end int, s *stats) {
+				b := newWriteBatch()
+				for i := start; i < end; i++ {
+					k, v := g.NextKey(), g.Value()
+					b.Put(k, v)
+					s.FinishedSingleOp(len(k) + len(v))
+					if b.Len() == *batchSize || i == end-1 {
+						check(db.Write(b))
+						b.Clear()
+					}
+				}
+			})
 			if *finalCompact {
-				db.Compact()
+				check(db.Compact())
 			}
 		case "fillrandom":
-			for i := 0; i < *numEntries; i++ {
-				k, v := s.RandomKey(*numEntries), s.Value()
-				db.Put(k, v)
-				s.FinishedSingleOp(8 + len(v))
-			}
+			s.parallelFill(func(g *generator, start, end int, s *stats) {
+				for i := start; i < end; i++ {
+					k, v := g.RandomKey(*numEntries), g.Value()
+					check(db.Put(k, v))
+					s.FinishedSingleOp(len(k) + len(v))
+				}
+			})
 			if *finalCompact {
-				db.Compact()
+				check(db.Compact())
 			}
 		case "readseq":
 			for i := 0; i < *numReads; i++ {
-				v := db.Get(s.NextKey())
+				k := s.NextKey()
+				v, err := db.Get(k)
+				check(err)
 				if v.Present {
-					s.FinishedSingleOp(8 + len(v.Value))
+					s.FinishedSingleOp(len(k) + len(v.Value))
 				}
 			}
 		case "readrandom":
 			// read in a different random order from random writes
 			s.ReSeed(1)
 			for i := 0; i < *numReads; i++ {
-				v := db.Get(s.RandomKey(*numEntries))
+				k := s.RandomKey(*numEntries)
+				v, err := db.Get(k)
+				check(err)
 				if v.Present {
-					s.FinishedSingleOp(8 + len(v.Value))
+					s.FinishedSingleOp(len(k) + len(v.Value))
 				}
 			}
 		case "init":
-			db.Close()
+			check(db.Close())
 			db = initDb(fs)
 			s.FinishedSingleOp(0)
 		case "fs-read":
@@ -199,7 +268,7 @@ func runBenchmarks(fs fs.Filesys, db database) time.Time {
 		s.Report()
 	}
 	end := time.Now()
-	db.Close()
+	check(db.Close())
 	return end
 }
 
@@ -216,7 +285,7 @@ func main() {
 		*numReads = *numEntries
 	}
 
-	totalBytes := float64(*numEntries * (8 + 100))
+	totalBytes := float64(*numEntries * (8 + *valueSize))
 	reportedDatabase := *dbType
 	if *fsType != "dir" {
 		reportedDatabase += fmt.Sprintf(" (%s)", *fsType)
@@ -227,6 +296,10 @@ func main() {
 	}{
 		{"database", reportedDatabase},
 		{"entries", showNum(*numEntries)},
+		{"value size", fmt.Sprintf("%d", *valueSize)},
+		{"compression ratio", fmt.Sprintf("%.2f", *compressionRatio)},
+		{"compression", *compression},
+		{"writers", fmt.Sprintf("%d", *numWriters)},
 		{"final compaction?", fmt.Sprintf("%v", *finalCompact)},
 		{"total data (MB)", fmt.Sprintf("%.1f", totalBytes/(1024*1024))},
 	} {
@@ -241,8 +314,8 @@ func main() {
 
 	if *printStats {
 		fsstats := fs.GetStats()
-		writes := stats{fsstats.WriteOps, fsstats.WriteBytes, start, &end}
-		reads := stats{fsstats.ReadOps, fsstats.ReadBytes, start, &end}
+		writes := stats{Ops: fsstats.WriteOps, Bytes: fsstats.WriteBytes, Start: start, End: &end}
+		reads := stats{Ops: fsstats.ReadOps, Bytes: fsstats.ReadBytes, Start: start, End: &end}
 		fmt.Printf("%-20s : %s [%6d kops]\n", "[meta] fs-writes", writes.formatStats(), writes.Ops/1000)
 		fmt.Printf("%-20s : %s [%6d kops]\n", "[meta] fs-reads", reads.formatStats(), reads.Ops/1000)
 		switch speciousDb := database.(type) {
@@ -252,6 +325,10 @@ func main() {
 			fmt.Printf("%-20s : %0.3f [%0.1f sec]\n", "[meta] compaction",
 				float64(compactionTime)/float64(totalTime),
 				float64(compactionTime)/float64(time.Second))
+			fmt.Printf("%-20s : %d reads\n", "[meta] filter-skips",
+				speciousDb.ReadStats.FilterAvoided())
+			fmt.Printf("%-20s : %d hits, %d misses\n", "[meta] block-cache",
+				speciousDb.ReadStats.CacheHits(), speciousDb.ReadStats.CacheMisses())
 		default:
 		}
 	}
@@ -0,0 +1,65 @@
+package db
+
+// A WriteBatch collects puts and deletes to be applied to a Store atomically.
+//
+// Updates in a batch are applied in order, so a later update to a key in the
+// same batch takes precedence over an earlier one.
+type WriteBatch struct {
+	updates []KeyUpdate
+}
+
+// NewWriteBatch creates an empty batch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds a put of v to k to the batch.
+//
+// The batch keeps copies of k and v, so the caller may reuse them.
+func (b *WriteBatch) Put(k Key, v Value) {
+	b.updates = append(b.updates, newPut(k, v))
+}
+
+// Delete adds a delete of k to the batch.
+//
+// The batch keeps a copy of k, so the caller may reuse it.
+func (b *WriteBatch) Delete(k Key) {
+	b.updates = append(b.updates, newDelete(k))
+}
+
+// newPut creates an update putting v to k that does not share memory with k
+// or v, since the database keeps updates in memory after the write returns.
+func newPut(k Key, v Value) KeyUpdate {
+	return KeyUpdate{Key: copyKey(k), MaybeValue: SomeValue(append(Value(nil), v...))}
+}
+
+// newDelete creates an update deleting k that does not share memory with k.
+func newDelete(k Key) KeyUpdate {
+	return KeyUpdate{Key: copyKey(k), MaybeValue: NoValue}
+}
+
+// copyKey copies a key.
+//
+// The copy is never nil, since a nil key would read back as the unbounded
+// maximum of a table's KeyRange.
+func copyKey(k Key) Key {
+	return append(Key{}, k...)
+}
+
+// Len returns the number of updates in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.updates)
+}
+
+// Updates returns the updates in the batch, in the order they were added.
+//
+// The updates do not have sequence numbers, which are assigned when the batch is
+// written.
+func (b *WriteBatch) Updates() []KeyUpdate {
+	return b.updates
+}
+
+// Clear empties the batch so it can be reused.
+func (b *WriteBatch) Clear() {
+	b.updates = b.updates[:0]
+}
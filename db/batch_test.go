@@ -0,0 +1,94 @@
+package db
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type BatchSuite struct {
+	*DbSuite
+}
+
+func TestBatchSuite(t *testing.T) {
+	suite.Run(t, BatchSuite{new(DbSuite)})
+}
+
+func (suite BatchSuite) writeBatch(updates map[int]string) {
+	b := NewWriteBatch()
+	for k, v := range updates {
+		if v == missing {
+			b.Delete(intKey(k))
+			delete(suite.db.gold, k)
+		} else {
+			b.Put(intKey(k), []byte(v))
+			suite.db.gold[k] = v
+		}
+	}
+	suite.Require().NoError(suite.db.Write(b))
+}
+
+func (suite BatchSuite) TestWriteBatch() {
+	suite.db.Put(1, "val 1")
+	suite.writeBatch(map[int]string{1: missing, 2: "val 2", 3: "val 3"})
+	for k := 1; k <= 3; k++ {
+		suite.check(k)
+	}
+}
+
+func (suite BatchSuite) TestBatchOrder() {
+	b := NewWriteBatch()
+	b.Put(intKey(1), []byte("first"))
+	b.Put(intKey(1), []byte("second"))
+	b.Put(intKey(2), []byte("val 2"))
+	b.Delete(intKey(2))
+	suite.Require().NoError(suite.db.Write(b))
+	suite.Equal("second", suite.db.Get(1))
+	suite.Equal(missing, suite.db.Get(2))
+	suite.crashRestart()
+	suite.Equal("second", suite.db.Get(1), "later put in batch should win after recovery")
+	suite.Equal(missing, suite.db.Get(2), "later delete in batch should win after recovery")
+}
+
+func (suite BatchSuite) TestEmptyBatch() {
+	suite.Require().NoError(suite.db.Write(NewWriteBatch()))
+	suite.crashRestart()
+	suite.check(1)
+}
+
+func (suite BatchSuite) TestBatchRecovery() {
+	suite.db.Put(1, "val 1")
+	suite.writeBatch(map[int]string{1: missing, 2: "val 2", 3: "val 3"})
+	suite.crashRestart()
+	for k := 1; k <= 3; k++ {
+		suite.check(k)
+	}
+}
+
+// a batch that is only partially written to the log should be lost entirely
+func (suite BatchSuite) TestTornBatch() {
+	suite.db.Put(1, "val 1")
+	b := NewWriteBatch()
+	b.Delete(intKey(1))
+	b.Put(intKey(2), []byte("val 2"))
+	suite.Require().NoError(suite.db.Write(b))
+
+	log := logName(suite.db.log.number)
+	f, err := suite.fs.Open(log)
+	suite.Require().NoError(err)
+	data, err := ioutil.ReadAll(f)
+	suite.Require().NoError(err)
+	f.Close()
+	// cut off the end of the batch's record
+	suite.Require().NoError(suite.fs.Delete(log))
+	f2, err := suite.fs.Create(log)
+	suite.Require().NoError(err)
+	_, err = f2.Write(data[:len(data)-2])
+	suite.Require().NoError(err)
+	suite.Require().NoError(f2.Close())
+
+	suite.crashRestart()
+	suite.Equal("val 1", suite.db.Get(1))
+	suite.Equal(missing, suite.db.Get(2))
+}
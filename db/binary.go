@@ -1,6 +1,7 @@
 package db
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/tchajed/specious-db/bin"
@@ -22,53 +23,100 @@ func newEncoder(w io.Writer) Encoder {
 	return Encoder{bin.NewEncoder(w)}
 }
 
+// Key decodes a length-prefixed key, which is never nil (a nil Key is reserved
+// for the unbounded maximum of a KeyRange).
 func (r Decoder) Key() Key {
-	return Key(r.VarInt())
+	k := r.Array()
+	if k == nil {
+		return Key{}
+	}
+	return Key(k)
 }
 
 func (w *Encoder) Key(k Key) {
-	w.VarInt(uint64(k))
+	w.Array(k)
 }
 
+// Each KeyUpdate records whether it is a put or a delete with a tag, which for
+// a put is followed by the value or a pointer to it.
+const (
+	deleteTag uint8 = iota
+	putTag
+	valuePointerTag
+)
+
+// KeyUpdate decodes an update, encoded as:
+//
+//	key Key
+//	seq varint
+//	tag uint8
+//	value [varint length]byte (only for puts)
+//	ptr ValuePointer (only for puts with the value in a value log)
 func (r Decoder) KeyUpdate() KeyUpdate {
 	key := r.Key()
-	length := r.Uint16()
-	if length == 0xffff {
-		return KeyUpdate{key, NoValue}
+	seq := r.VarInt()
+	switch tag := r.Uint8(); tag {
+	case deleteTag:
+		return KeyUpdate{Key: key, Seq: seq, MaybeValue: NoValue}
+	case putTag:
+		value := r.Array()
+		return KeyUpdate{Key: key, Seq: seq, MaybeValue: SomeValue(value)}
+	case valuePointerTag:
+		ptr := r.ValuePointer()
+		return KeyUpdate{Key: key, Seq: seq, MaybeValue: SomeValue(nil), ptr: ptr}
+	default:
+		r.Fail(fmt.Errorf("%w: invalid update tag %d", ErrCorruption, tag))
+		return KeyUpdate{}
 	}
-	value := r.Bytes(int(length))
-	return KeyUpdate{key, SomeValue(value)}
 }
 
 func (w *Encoder) KeyUpdate(e KeyUpdate) {
 	w.Key(e.Key)
-	if e.IsPut() {
-		w.Array16(e.Value)
+	w.VarInt(e.Seq)
+	if e.ptr.IsValid() {
+		w.Uint8(valuePointerTag)
+		w.ValuePointer(e.ptr)
+	} else if e.IsPut() {
+		w.Uint8(putTag)
+		w.Array(e.Value)
 	} else {
-		w.Uint16(0xffff)
+		w.Uint8(deleteTag)
 	}
 }
 
+func (r Decoder) ValuePointer() valuePointer {
+	vlog := r.VarInt()
+	offset := r.VarInt()
+	length := r.VarInt()
+	return valuePointer{uint32(vlog), offset, length}
+}
+
+func (w *Encoder) ValuePointer(p valuePointer) {
+	w.VarInt(uint64(p.vlog))
+	w.VarInt(p.offset)
+	w.VarInt(p.length)
+}
+
 func (r Decoder) Handle() SliceHandle {
 	offset := r.VarInt()
 	length := r.VarInt()
-	return SliceHandle{offset, uint32(length)}
+	return SliceHandle{offset, length}
 }
 
 func (w *Encoder) Handle(h SliceHandle) {
 	w.VarInt(h.Offset)
-	w.VarInt(uint64(h.Length))
+	w.VarInt(h.Length)
 }
 
 func (r Decoder) FixedHandle() SliceHandle {
 	offset := r.Uint64()
-	length := r.Uint32()
+	length := r.Uint64()
 	return SliceHandle{offset, length}
 }
 
 func (w *Encoder) FixedHandle(h SliceHandle) {
 	w.Uint64(h.Offset)
-	w.Uint32(h.Length)
+	w.Uint64(h.Length)
 }
 
 func (r *Decoder) KeyRange() KeyRange {
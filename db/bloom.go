@@ -0,0 +1,95 @@
+package db
+
+// Bloom filters
+//
+// Each table has a Bloom filter over its keys, so that reading a key the table
+// doesn't have can usually skip reading the table. A filter uses bitsPerKey
+// bits for each key and bitsPerKey*ln(2) hash functions, which minimizes the
+// false positive rate (about 1% with 10 bits per key). The hash functions are
+// derived from the two halves of a single 64-bit hash of the key (double
+// hashing).
+//
+// filter format:
+//   bits [n]byte
+//   numHashes uint8
+
+import "hash/fnv"
+
+// maxBloomHashes bounds the number of hash functions; a filter claiming more is
+// treated as matching every key.
+const maxBloomHashes = 30
+
+// A bloomFilter records a set of keys, possibly with false positives. An empty
+// filter matches every key.
+type bloomFilter []byte
+
+func bloomHash(k Key) uint64 {
+	h := fnv.New64a()
+	h.Write(k)
+	// FNV mixes the last bytes of the key poorly, so finish with MurmurHash3's
+	// finalizer to spread similar keys over both halves of the hash
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// newBloomFilter creates a filter over the keys with the given hashes (from
+// bloomHash).
+func newBloomFilter(hashes []uint64, bitsPerKey int) bloomFilter {
+	numHashes := int(float64(bitsPerKey) * 0.69)
+	if numHashes < 1 {
+		numHashes = 1
+	}
+	if numHashes > maxBloomHashes {
+		numHashes = maxBloomHashes
+	}
+	// small filters have a high false positive rate, so use a minimum size
+	bits := len(hashes) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	n := (bits + 7) / 8
+	f := make(bloomFilter, n+1)
+	f[n] = uint8(numHashes)
+	for _, h := range hashes {
+		f.forEachBit(h, func(byteIndex int, mask byte) bool {
+			f[byteIndex] |= mask
+			return true
+		})
+	}
+	return f
+}
+
+// forEachBit calls bit with the position of each of the filter's bits for
+// hash h, stopping early if bit returns false.
+func (f bloomFilter) forEachBit(h uint64, bit func(byteIndex int, mask byte) bool) {
+	numBits := uint32(len(f)-1) * 8
+	numHashes := int(f[len(f)-1])
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := 0; i < numHashes; i++ {
+		pos := (h1 + uint32(i)*h2) % numBits
+		if !bit(int(pos/8), 1<<(pos%8)) {
+			return
+		}
+	}
+}
+
+// MayContain reports whether k might be one of the filter's keys (it is
+// definitely not if this returns false).
+func (f bloomFilter) MayContain(k Key) bool {
+	if len(f) < 2 || f[len(f)-1] > maxBloomHashes {
+		return true
+	}
+	found := true
+	f.forEachBit(bloomHash(k), func(byteIndex int, mask byte) bool {
+		if f[byteIndex]&mask == 0 {
+			found = false
+		}
+		return found
+	})
+	return found
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/specious-db/fs"
+)
+
+func bloomFilterOf(keys []int, bitsPerKey int) bloomFilter {
+	var hashes []uint64
+	for _, k := range keys {
+		hashes = append(hashes, bloomHash(intKey(k)))
+	}
+	return newBloomFilter(hashes, bitsPerKey)
+}
+
+func TestBloomFilter(t *testing.T) {
+	assert := assert.New(t)
+	var keys []int
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, 2*i)
+	}
+	f := bloomFilterOf(keys, 10)
+	for _, k := range keys {
+		if !f.MayContain(intKey(k)) {
+			assert.Fail("filter should contain every key", "key %d", k)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.MayContain(intKey(2*i + 1)) {
+			falsePositives++
+		}
+	}
+	assert.Less(falsePositives, 200, "false positive rate should be about 1%%")
+}
+
+func TestBloomFilterSmall(t *testing.T) {
+	f := bloomFilterOf([]int{1}, 10)
+	assert.True(t, f.MayContain(intKey(1)))
+	falsePositives := 0
+	for i := 2; i < 100; i++ {
+		if f.MayContain(intKey(i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 10)
+}
+
+func TestEmptyBloomFilter(t *testing.T) {
+	var f bloomFilter
+	assert.True(t, f.MayContain(intKey(1)), "no filter should match everything")
+}
+
+func TestFilterAvoidsReads(t *testing.T) {
+	assert := assert.New(t)
+	db := newStringStore(MustInit(fs.MemFs(), nil))
+	for i := 0; i < 100; i++ {
+		db.Put(2*i, "val")
+	}
+	must(db.compactLog())
+	for i := 0; i < 100; i++ {
+		assert.Equal(missing, db.Get(2*i+1))
+	}
+	// the keys between index entries are skipped without the filter, which
+	// catches (almost) all of the other 90
+	assert.Greater(db.ReadStats.FilterAvoided(), uint64(80))
+	// the filter is loaded on recovery
+	must(db.Close())
+	db.Database = MustOpen(db.fs, nil)
+	for i := 0; i < 100; i++ {
+		assert.Equal(db.Expected(2*i), db.Get(2*i))
+	}
+	assert.Equal(uint64(0), db.ReadStats.FilterAvoided())
+	assert.Equal(missing, db.Get(1))
+	assert.Equal(uint64(1), db.ReadStats.FilterAvoided())
+}
+
+func TestFilterDisabled(t *testing.T) {
+	db := newStringStore(MustInit(fs.MemFs(), &Options{BloomBitsPerKey: -1}))
+	for i := 0; i < 100; i++ {
+		db.Put(2*i, "val")
+	}
+	must(db.compactLog())
+	assert.Empty(t, db.mf.tables[0][0].filter)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, missing, db.Get(2*i+1))
+	}
+	assert.Equal(t, uint64(0), db.ReadStats.FilterAvoided())
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A blockCache holds recently read table data (the updates under an index
+// entry), so that reading a hot key does not go to the filesystem. It is
+// shared by all of a database's tables and is safe for concurrent use.
+//
+// The cache is bounded by the total size of the data it holds, and evicts the
+// least recently used data first. A nil *blockCache caches nothing.
+type blockCache struct {
+	m        sync.Mutex
+	capacity int
+	size     int
+	// lru orders the cached data from most to least recently used
+	lru *list.List
+	// the element of lru for each offset in each table
+	tables map[uint32]map[uint64]*list.Element
+}
+
+type cachedBlock struct {
+	ident  uint32
+	offset uint64
+	data   []byte
+}
+
+// newBlockCache creates a cache holding up to capacity bytes, or returns nil
+// if capacity is not positive.
+func newBlockCache(capacity int) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		tables:   make(map[uint32]map[uint64]*list.Element),
+	}
+}
+
+// Get returns the data cached for offset in table ident.
+//
+// The data is shared and should not be modified.
+func (c *blockCache) Get(ident uint32, offset uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.tables[ident][offset]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedBlock).data, true
+}
+
+// Insert caches the data at offset in table ident, which the caller should
+// not modify afterward.
+func (c *blockCache) Insert(ident uint32, offset uint64, data []byte) {
+	if c == nil || len(data) > c.capacity {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	blocks := c.tables[ident]
+	if blocks == nil {
+		blocks = make(map[uint64]*list.Element)
+		c.tables[ident] = blocks
+	}
+	if e, ok := blocks[offset]; ok {
+		// another reader cached the same data first
+		c.lru.MoveToFront(e)
+		return
+	}
+	blocks[offset] = c.lru.PushFront(&cachedBlock{ident, offset, data})
+	c.size += len(data)
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove evicts e.
+//
+// Requires c.m.
+func (c *blockCache) remove(e *list.Element) {
+	b := c.lru.Remove(e).(*cachedBlock)
+	c.size -= len(b.data)
+	blocks := c.tables[b.ident]
+	delete(blocks, b.offset)
+	if len(blocks) == 0 {
+		delete(c.tables, b.ident)
+	}
+}
+
+// EvictTable removes the cached data for table ident (which is being deleted).
+func (c *blockCache) EvictTable(ident uint32) {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, e := range c.tables[ident] {
+		c.remove(e)
+	}
+}
+
+// Size returns the number of bytes of data cached.
+func (c *blockCache) Size() int {
+	if c == nil {
+		return 0
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.size
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tchajed/specious-db/fs"
+)
+
+func TestBlockCacheLRU(t *testing.T) {
+	assert := assert.New(t)
+	c := newBlockCache(30)
+	c.Insert(1, 0, make([]byte, 10))
+	c.Insert(1, 10, make([]byte, 10))
+	c.Insert(2, 0, make([]byte, 10))
+	_, ok := c.Get(1, 0)
+	assert.True(ok)
+	// evicts (1, 10), the least recently used
+	c.Insert(2, 10, make([]byte, 10))
+	assert.Equal(30, c.Size())
+	_, ok = c.Get(1, 10)
+	assert.False(ok, "least recently used data should be evicted")
+	for _, key := range []struct {
+		ident  uint32
+		offset uint64
+	}{{1, 0}, {2, 0}, {2, 10}} {
+		_, ok := c.Get(key.ident, key.offset)
+		assert.True(ok, "%v should be cached", key)
+	}
+
+	c.Insert(3, 0, make([]byte, 100))
+	_, ok = c.Get(3, 0)
+	assert.False(ok, "data larger than the cache should not be cached")
+}
+
+func TestBlockCacheEvictTable(t *testing.T) {
+	assert := assert.New(t)
+	c := newBlockCache(100)
+	c.Insert(1, 0, []byte("table 1"))
+	c.Insert(1, 7, []byte("table 1"))
+	c.Insert(2, 0, []byte("table 2"))
+	c.EvictTable(1)
+	_, ok := c.Get(1, 0)
+	assert.False(ok)
+	data, ok := c.Get(2, 0)
+	assert.True(ok)
+	assert.Equal([]byte("table 2"), data)
+	assert.Equal(len("table 2"), c.Size())
+}
+
+func TestNilBlockCache(t *testing.T) {
+	c := newBlockCache(-1)
+	assert.Nil(t, c)
+	c.Insert(1, 0, []byte("data"))
+	_, ok := c.Get(1, 0)
+	assert.False(t, ok)
+	c.EvictTable(1)
+}
+
+func TestBlockCacheConcurrent(t *testing.T) {
+	c := newBlockCache(1000)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				offset := uint64(j % 50)
+				if data, ok := c.Get(uint32(i%2), offset); ok {
+					assert.Len(t, data, 10)
+				} else {
+					c.Insert(uint32(i%2), offset, make([]byte, 10))
+				}
+				if j%100 == 0 {
+					c.EvictTable(uint32(i % 2))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, c.Size(), 1000)
+}
+
+func TestBlockCacheReads(t *testing.T) {
+	assert := assert.New(t)
+	db := newStringStore(MustInit(fs.MemFs(), nil))
+	for i := 0; i < 100; i++ {
+		db.Put(i, "val")
+	}
+	must(db.compactLog())
+	stats := db.ReadStats
+	assert.Equal("val", db.Get(5))
+	assert.Equal(uint64(1), stats.CacheMisses())
+	for i := 0; i < 10; i++ {
+		assert.Equal("val", db.Get(5))
+	}
+	assert.Equal(uint64(10), stats.CacheHits())
+	assert.Equal(uint64(1), stats.CacheMisses())
+
+	// a value returned from the cache can be modified without affecting later
+	// reads
+	v, err := db.Database.Get(intKey(5))
+	must(err)
+	v.Value[0] = 'x'
+	assert.Equal("val", db.Get(5))
+
+	// compacting deletes the table, which should evict its data
+	old := db.mf.tables[0][0].ident
+	db.Put(5, "new val")
+	must(db.Compact())
+	_, ok := db.mf.cache.tables[old]
+	assert.False(ok, "deleted table's data should be evicted")
+	assert.Equal("new val", db.Get(5))
+}
+
+func TestBlockCacheDisabled(t *testing.T) {
+	db := newStringStore(MustInit(fs.MemFs(), &Options{BlockCacheSize: -1}))
+	for i := 0; i < 100; i++ {
+		db.Put(i, "val")
+	}
+	must(db.compactLog())
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "val", db.Get(5))
+	}
+	assert.Equal(t, uint64(0), db.ReadStats.CacheHits())
+	assert.Equal(t, uint64(0), db.ReadStats.CacheMisses())
+}
@@ -0,0 +1,46 @@
+package db
+
+// Checksums
+//
+// The parts of a table (the block under each index entry, the index, the
+// filter and the footer) are each followed by a CRC32C checksum of their
+// contents, so that corrupt data is reported as an error rather than being
+// decoded:
+//
+// checksummed:
+//   data [n]byte
+//   crc uint32
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumSize is the size of the checksum after checksummed data.
+const checksumSize = 4
+
+// appendChecksum appends the checksum of data to it (possibly reusing its
+// storage).
+func appendChecksum(data []byte) []byte {
+	var crc [checksumSize]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(data, crcTable))
+	return append(data, crc[:]...)
+}
+
+// verifyChecksum checks the checksum at the end of b, returning the data
+// before it.
+func verifyChecksum(b []byte) ([]byte, error) {
+	if len(b) < checksumSize {
+		return nil, fmt.Errorf("%w: missing checksum", ErrCorruption)
+	}
+	data := b[:len(b)-checksumSize]
+	expected := binary.LittleEndian.Uint32(b[len(data):])
+	if actual := crc32.Checksum(data, crcTable); actual != expected {
+		return nil, fmt.Errorf("%w: checksum mismatch (expected %08x, got %08x)",
+			ErrCorruption, expected, actual)
+	}
+	return data, nil
+}
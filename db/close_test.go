@@ -1,9 +1,15 @@
 package db
 
 import (
+	"bytes"
+	"sort"
+	"sync"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/tchajed/specious-db/fs"
 )
 
 type CloseSuite struct {
@@ -18,5 +24,94 @@ func (suite CloseSuite) TestClose() {
 	suite.db.Put(1, "val")
 	suite.Equal("val", suite.db.Get(1))
 	suite.check(1)
-	suite.db.Close()
+	suite.NoError(suite.db.Close())
+}
+
+// openFilesFs tracks which files are open for reading
+type openFilesFs struct {
+	fs.Filesys
+	m    *sync.Mutex
+	open map[string]int
+}
+
+func newOpenFilesFs() openFilesFs {
+	return openFilesFs{fs.MemFs(), new(sync.Mutex), make(map[string]int)}
+}
+
+type openFile struct {
+	fs.ReadFile
+	filesys openFilesFs
+	name    string
+	closed  *bool
+}
+
+func (f openFile) Close() error {
+	f.filesys.m.Lock()
+	defer f.filesys.m.Unlock()
+	if !*f.closed {
+		*f.closed = true
+		f.filesys.open[f.name]--
+	}
+	return f.ReadFile.Close()
+}
+
+func (filesys openFilesFs) Open(fname string) (fs.ReadFile, error) {
+	f, err := filesys.Filesys.Open(fname)
+	if err != nil {
+		return f, err
+	}
+	filesys.m.Lock()
+	defer filesys.m.Unlock()
+	filesys.open[fname]++
+	return openFile{f, filesys, fname, new(bool)}, nil
+}
+
+// OpenFiles returns the names of the files that are open for reading, once
+// for each handle
+func (filesys openFilesFs) OpenFiles() []string {
+	filesys.m.Lock()
+	defer filesys.m.Unlock()
+	var names []string
+	for name, n := range filesys.open {
+		for i := 0; i < n; i++ {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newTablesDb creates a closed database with several tables and a value log
+func newTablesDb(t *testing.T, filesys fs.Filesys) {
+	db := MustInit(filesys, &Options{ValueThreshold: 100})
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.Put(intKey(i), []byte("val")))
+		require.NoError(t, db.Put(intKey(i+10), bytes.Repeat([]byte{1}, 200)))
+		require.NoError(t, db.compactLog())
+	}
+	require.NoError(t, db.Close())
+}
+
+func TestCloseClosesFiles(t *testing.T) {
+	filesys := newOpenFilesFs()
+	newTablesDb(t, filesys)
+	assert.Empty(t, filesys.OpenFiles(), "compaction should close the tables it replaces")
+	db, err := Open(filesys, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	assert.Empty(t, filesys.OpenFiles(), "close should close every file")
+}
+
+func TestCloseReadOnlyClosesFiles(t *testing.T) {
+	filesys := newOpenFilesFs()
+	newTablesDb(t, filesys)
+	for i := 0; i < 3; i++ {
+		db, err := Open(filesys, &Options{ReadOnly: true})
+		require.NoError(t, err)
+		v, err := db.Get(intKey(12))
+		require.NoError(t, err)
+		assert.True(t, v.Present)
+		require.NoError(t, db.Close())
+		assert.Empty(t, filesys.OpenFiles(), "read-only close should close every file")
+	}
 }
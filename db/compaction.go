@@ -0,0 +1,491 @@
+package db
+
+// Background compaction
+//
+// When the log fills up, it is frozen as the immutable memtable (db.imm) and
+// writes continue in a new log. A background goroutine then flushes the
+// immutable memtable to an L0 table and, once there are enough young tables,
+// compacts them into L1. Reads consult both memtables while a flush runs.
+//
+// Levels other than L0 have a target size that grows by LevelSizeMultiplier
+// at each level. Each level gets a score (the number of young tables relative
+// to L0CompactionTrigger for L0, and its size relative to its target for the
+// others), and the level with the highest score of at least 1 is compacted by
+// merging one of its tables into the overlapping tables of the next level.
+//
+// Only one compaction runs at a time (tracked by db.compacting). Compactions
+// hold the lock only to pick their inputs and to install their output, not
+// while reading and writing tables. Writers wait for a flush only if the log
+// fills up again before the immutable memtable is flushed, or if there are
+// too many young tables.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tchajed/specious-db/fs"
+)
+
+// l0StopFactor is how many times L0CompactionTrigger young tables stops
+// writes until a compaction catches up.
+const l0StopFactor = 3
+
+// makeRoomForWrite makes sure the log has room for more updates, freezing a
+// full log as the immutable memtable and starting a new log.
+//
+// Requires the write lock (which is released while waiting for a background
+// flush).
+func (db *Database) makeRoomForWrite() error {
+	for {
+		if db.err != nil {
+			return db.err
+		}
+		if len(db.mf.tables[0]) >= l0StopFactor*db.opts.L0CompactionTrigger {
+			// wait for the young tables to be compacted
+			db.bgCond.Wait()
+			continue
+		}
+		if db.log.SizeEstimate() < db.opts.WriteBufferSize {
+			return nil
+		}
+		if db.imm != nil {
+			// wait for the previous log to be flushed
+			db.bgCond.Wait()
+			continue
+		}
+		if err := db.rotateLog(); err != nil {
+			return err
+		}
+		db.maybeScheduleCompaction()
+	}
+}
+
+// rotateLog freezes the log as the immutable memtable and starts a new log.
+//
+// Requires the write lock, that there is no immutable memtable, and that the
+// group commit leader is not writing to the log (either because the caller is
+// the leader or because logWriting is not set).
+func (db *Database) rotateLog() error {
+	number := db.mf.nextIdent
+	db.mf.nextIdent++
+	log, err := initLog(db.fs, number, db.opts.Sync)
+	if err != nil {
+		return err
+	}
+	if db.opts.Sync != SyncNever {
+		// the frozen log's updates would otherwise only be durable once they
+		// are flushed
+		if err := db.log.Sync(); err != nil {
+			log.Close()
+			db.fs.Delete(logName(number))
+			return err
+		}
+	}
+	db.log.Close()
+	db.imm = db.log
+	db.log = log
+	return nil
+}
+
+// levelScore measures how far over its limit a level is; a level with a score
+// of at least 1 needs to be compacted.
+//
+// Requires a read lock.
+func (db *Database) levelScore(level int) float64 {
+	tables := db.mf.tables[level]
+	if level == 0 {
+		return float64(len(tables)) / float64(db.opts.L0CompactionTrigger)
+	}
+	return float64(levelSize(tables)) / db.opts.maxBytesForLevel(level)
+}
+
+// pickCompactionLevel returns the level with the highest score, if it needs to
+// be compacted.
+//
+// Requires a read lock.
+func (db *Database) pickCompactionLevel() (level int, ok bool) {
+	best := 1.0
+	// the last level has nowhere to compact to
+	for l := 0; l < numLevels-1; l++ {
+		if score := db.levelScore(l); score >= best {
+			level, best, ok = l, score, true
+		}
+	}
+	return
+}
+
+// needsCompaction reports whether there is background work to do.
+//
+// Requires a read lock.
+func (db *Database) needsCompaction() bool {
+	if db.imm != nil {
+		return true
+	}
+	_, ok := db.pickCompactionLevel()
+	return ok
+}
+
+// maybeScheduleCompaction starts a background compaction if one is needed and
+// none is running.
+//
+// Requires the write lock.
+func (db *Database) maybeScheduleCompaction() {
+	if db.compacting || db.closing || db.err != nil || !db.needsCompaction() {
+		return
+	}
+	db.compacting = true
+	go db.backgroundCompaction()
+}
+
+func (db *Database) backgroundCompaction() {
+	db.l.Lock()
+	defer db.l.Unlock()
+	var err error
+	if db.imm != nil {
+		err = db.flushMemtable()
+	} else if level, ok := db.pickCompactionLevel(); ok {
+		err = db.compactLevel(level)
+	}
+	if err != nil && db.err == nil {
+		db.err = fmt.Errorf("database is read-only after background compaction failed: %w", err)
+	}
+	db.compacting = false
+	db.maybeScheduleCompaction()
+	db.bgCond.Broadcast()
+}
+
+// startCompaction waits for any running compaction and then reserves
+// db.compacting for a compaction run by the caller.
+//
+// Requires the write lock.
+func (db *Database) startCompaction() {
+	for db.compacting {
+		db.bgCond.Wait()
+	}
+	db.compacting = true
+}
+
+// finishCompaction ends a compaction started with startCompaction.
+//
+// Requires the write lock.
+func (db *Database) finishCompaction() {
+	db.compacting = false
+	db.maybeScheduleCompaction()
+	db.bgCond.Broadcast()
+}
+
+// flushMemtable writes the immutable memtable to an L0 table.
+//
+// Requires the write lock (which is released while writing the table), and
+// that the caller is the running compaction.
+func (db *Database) flushMemtable() error {
+	start := time.Now()
+	defer db.Stats.AddTimeSince(start)
+	imm := db.imm
+	updates := imm.Updates()
+	lastSeq := db.seq
+	t, err := db.mf.CreateTableSeparating(db.opts.valueThreshold())
+	if err != nil {
+		return err
+	}
+	db.l.Unlock()
+	for _, u := range updates {
+		t.Put(u)
+	}
+	table, err := t.Close()
+	db.l.Lock()
+	if err != nil {
+		return err
+	}
+	// every log before the current one is now in a table
+	err = db.mf.InstallFlushedTable(table, t.ValueLog(), lastSeq, db.log.number)
+	if err != nil {
+		return err
+	}
+	db.imm = nil
+	// failing to delete the log only wastes space, and cleanup() will try
+	// again on recovery
+	db.fs.Delete(logName(imm.number))
+	return nil
+}
+
+// compactLevel compacts part of a level into the next level: all of the
+// young tables for L0, and otherwise one table, picked by cycling through the
+// level's keys.
+//
+// Requires the write lock (which is released while merging), and that the
+// caller is the running compaction.
+func (db *Database) compactLevel(level int) error {
+	if level == 0 {
+		return db.compactYoungTables()
+	}
+	tables := db.mf.tables[level]
+	if len(tables) == 0 {
+		return nil
+	}
+	t := tables[0]
+	if next := db.compactPointers[level]; next != nil {
+		for _, candidate := range tables {
+			if candidate.Keys().Min.Compare(next) > 0 {
+				t = candidate
+				break
+			}
+		}
+	}
+	db.compactPointers[level] = t.Keys().Max
+	return db.compactTables(level, []Table{t})
+}
+
+// compactYoungTables merges the young tables into the L1 tables they overlap.
+//
+// Requires the write lock (which is released while merging), and that the
+// caller is the running compaction.
+func (db *Database) compactYoungTables() error {
+	if len(db.mf.tables[0]) == 0 {
+		return nil
+	}
+	// the young tables can overlap, so they are all compacted together (a
+	// newer young table might otherwise be shadowed by an older one in L1)
+	return db.compactTables(0, db.mf.tables[0])
+}
+
+// compactTables moves inputs (tables at level) to the next level, merging
+// them with the overlapping tables there.
+//
+// Requires the write lock (which is released while merging), and that the
+// caller is the running compaction.
+func (db *Database) compactTables(level int, inputs []Table) error {
+	overlapping := overlappingTables(db.mf.tables[level+1], tablesRange(inputs))
+	if len(inputs) == 1 && len(overlapping) == 0 {
+		// nothing to merge with, so the table can be used as-is
+		return db.mf.MoveTable(inputs[0].ident, level)
+	}
+	return db.mergeTables(level, inputs, overlapping)
+}
+
+// mergeTables merges inputs (tables at level) with overlapping (tables at the
+// next level) into new tables at the next level, starting a new table at the
+// first key after each reaches TargetFileSize. Only the versions that a
+// snapshot might read are kept, and deletes are dropped once there is nothing
+// left for them to shadow.
+//
+// Requires the write lock (which is released while merging), and that the
+// caller is the running compaction.
+func (db *Database) mergeTables(level int, inputs []Table, overlapping []Table) error {
+	start := time.Now()
+	defer db.Stats.AddTimeSince(start)
+	var inputIdents []uint32
+	var overlappingIdents []uint32
+	var updateIterators []UpdateIterator
+	// iterators are ordered from newest to oldest
+	for i := len(inputs) - 1; i >= 0; i-- {
+		inputIdents = append(inputIdents, inputs[i].ident)
+		updateIterators = append(updateIterators, inputs[i].Updates())
+	}
+	for _, t := range overlapping {
+		overlappingIdents = append(overlappingIdents, t.ident)
+		updateIterators = append(updateIterators, t.Updates())
+	}
+	// deletes can be dropped for keys no deeper table holds
+	var deeper []KeyRange
+	for _, tables := range db.mf.tables[level+2:] {
+		for _, t := range tables {
+			deeper = append(deeper, t.Keys())
+		}
+	}
+	isBaseLevel := func(k Key) bool {
+		for _, r := range deeper {
+			if r.Contains(k) {
+				return false
+			}
+		}
+		return true
+	}
+	// later snapshots are taken at db.seq or later, and the updates after
+	// db.seq are not in tables
+	smallestSnapshot := db.snapshots.Oldest(db.seq)
+	// the input tables are immutable and are only deleted by compactions, so
+	// they can be read without the lock
+	db.l.Unlock()
+	it := newCompactionIterator(MergeUpdates(updateIterators), smallestSnapshot, isBaseLevel)
+	tables, err := db.writeMerged(it, level+1)
+	db.l.Lock()
+	if err != nil {
+		return err
+	}
+	err = db.mf.InstallTables(tables, inputIdents, overlappingIdents, level+1, db.seq)
+	if err != nil {
+		discardTables(db.fs, tables)
+		return err
+	}
+	return db.collectValueLogs()
+}
+
+// writeMerged writes the updates from it to new tables at level of about
+// TargetFileSize bytes each. All the versions of a key go in the same table,
+// so that the tables are disjoint.
+//
+// Requires that the caller is the running compaction, and does not hold the
+// lock (which is acquired to create each table).
+func (db *Database) writeMerged(it UpdateIterator, level int) ([]Table, error) {
+	var tables []Table
+	var t *tableCreator
+	var lastKey Key
+	for it.HasNext() {
+		u := it.Next()
+		if t != nil && t.Size() >= uint64(db.opts.TargetFileSize) &&
+			!u.Key.Equal(lastKey) {
+			table, err := t.Close()
+			t = nil
+			if err != nil {
+				discardTables(db.fs, tables)
+				return nil, err
+			}
+			tables = append(tables, table)
+		}
+		if t == nil {
+			var err error
+			db.l.Lock()
+			t, err = db.mf.CreateTable(level)
+			db.l.Unlock()
+			if err != nil {
+				discardTables(db.fs, tables)
+				return nil, err
+			}
+		}
+		t.Put(u)
+		lastKey = u.Key
+	}
+	if err := it.Err(); err != nil {
+		if t != nil {
+			t.Abort()
+		}
+		discardTables(db.fs, tables)
+		return nil, err
+	}
+	if t != nil {
+		table, err := t.Close()
+		if err != nil {
+			discardTables(db.fs, tables)
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// discardTables deletes tables that were created but not installed.
+func discardTables(filesys fs.Filesys, tables []Table) {
+	for _, t := range tables {
+		t.f.Release()
+		// failing to delete a table only wastes space, and cleanup() will try
+		// again on recovery
+		filesys.Delete(identToName(t.ident))
+	}
+}
+
+// compactLog flushes the log to a table, waiting for the flush to finish.
+func (db *Database) compactLog() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	db.l.Lock()
+	defer db.l.Unlock()
+	db.startCompaction()
+	defer db.finishCompaction()
+	// the log can only be rotated once the previous log is flushed and the
+	// group commit leader is not writing to it
+	for db.imm != nil || db.logWriting {
+		if db.imm != nil {
+			if err := db.flushMemtable(); err != nil {
+				return err
+			}
+			continue
+		}
+		db.bgCond.Wait()
+	}
+	if len(db.log.cache.cache) == 0 {
+		return nil
+	}
+	if err := db.rotateLog(); err != nil {
+		return err
+	}
+	return db.flushMemtable()
+}
+
+// compactYoung compacts the young tables into L1, waiting for the compaction
+// to finish.
+func (db *Database) compactYoung() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	db.l.Lock()
+	defer db.l.Unlock()
+	db.startCompaction()
+	defer db.finishCompaction()
+	return db.compactYoungTables()
+}
+
+// DeleteObsoleteFiles deletes files the database doesn't know about.
+//
+// Recovery already does this, to clean up partially constructed tables that
+// weren't successfully added to the database.
+func (db *Database) DeleteObsoleteFiles() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	db.l.Lock()
+	defer db.l.Unlock()
+	// a running compaction's new tables are not yet in the manifest
+	db.startCompaction()
+	defer db.finishCompaction()
+	return db.mf.cleanup()
+}
+
+// compactAllLevels compacts each level other than L0 into the next, moving
+// all of the tables to the deepest level that has any, and waits for the
+// compactions to finish.
+func (db *Database) compactAllLevels() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	db.l.Lock()
+	defer db.l.Unlock()
+	db.startCompaction()
+	defer db.finishCompaction()
+	deepest := 0
+	for level, tables := range db.mf.tables {
+		if len(tables) > 0 {
+			deepest = level
+		}
+	}
+	for level := 1; level < deepest; level++ {
+		if tables := db.mf.tables[level]; len(tables) > 0 {
+			if err := db.compactTables(level, tables); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Compact manually triggers a full compaction of the log and tables.
+func (db *Database) Compact() error {
+	if err := db.compactLog(); err != nil {
+		return err
+	}
+	if err := db.compactYoung(); err != nil {
+		return err
+	}
+	return db.compactAllLevels()
+}
+
+// waitForCompactions waits until there is no background work left.
+func (db *Database) waitForCompactions() error {
+	db.l.Lock()
+	defer db.l.Unlock()
+	for db.err == nil && (db.compacting || db.needsCompaction()) {
+		db.bgCond.Wait()
+	}
+	return db.err
+}
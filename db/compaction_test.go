@@ -0,0 +1,221 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CompactionSuite struct {
+	*DbSuite
+}
+
+func TestCompactionSuite(t *testing.T) {
+	suite.Run(t, CompactionSuite{&DbSuite{opts: &Options{WriteBufferSize: 1024}}})
+}
+
+// pauseCompactions keeps background compactions from running (as if one were
+// in progress) until resume is called.
+func (suite CompactionSuite) pauseCompactions() (resume func()) {
+	db := suite.db.Database
+	db.l.Lock()
+	db.startCompaction()
+	db.l.Unlock()
+	return func() {
+		db.l.Lock()
+		db.finishCompaction()
+		db.l.Unlock()
+	}
+}
+
+// fillLog writes until the log is frozen as the immutable memtable
+func (suite CompactionSuite) fillLog() {
+	for i := 1; suite.db.imm == nil; i++ {
+		suite.Require().Less(i, 1000, "log should fill up")
+		suite.db.Put(i, "val")
+	}
+}
+
+func (suite CompactionSuite) TestBackgroundFlush() {
+	suite.putValues(1, 500)
+	suite.Require().NoError(suite.db.waitForCompactions())
+	suite.Nil(suite.db.imm)
+	suite.NotEmpty(append(suite.db.mf.tables[0], suite.db.mf.tables[1]...),
+		"full logs should be flushed to tables")
+	suite.Less(suite.db.log.SizeEstimate(), 1024)
+	for i := 1; i <= 500; i++ {
+		suite.check(i)
+	}
+}
+
+func (suite CompactionSuite) TestReadImmutableMemtable() {
+	resume := suite.pauseCompactions()
+	suite.db.Put(1, "old")
+	suite.fillLog()
+	suite.db.Put(1, "new")
+	suite.db.Put(2, "val 2")
+	suite.check(1)
+	suite.check(2)
+	// a key only in the immutable memtable
+	suite.check(3)
+	it := suite.db.Scan(KeyRange{Min: intKey(1), Max: intKey(3)})
+	for _, expected := range []string{"new", "val 2", suite.db.Expected(3)} {
+		suite.Require().True(it.HasNext())
+		suite.Equal(Value(expected), it.Next().Value)
+	}
+	suite.False(it.HasNext())
+
+	resume()
+	suite.Require().NoError(suite.db.waitForCompactions())
+	suite.Nil(suite.db.imm, "immutable memtable should be flushed")
+	for i := 1; i <= 3; i++ {
+		suite.check(i)
+	}
+}
+
+func (suite CompactionSuite) TestRecoverImmutableMemtable() {
+	resume := suite.pauseCompactions()
+	suite.fillLog()
+	suite.db.Put(1, "new")
+	logs, err := liveLogs(suite.fs, 0)
+	suite.Require().NoError(err)
+	suite.Len(logs, 2, "both logs should be live")
+	resume()
+	suite.Require().NoError(suite.db.waitForCompactions())
+	suite.crashRestart()
+	for i := range suite.db.gold {
+		suite.check(i)
+	}
+}
+
+func (suite CompactionSuite) TestRecoverUnflushedLogs() {
+	suite.pauseCompactions()
+	suite.fillLog()
+	suite.db.Put(1, "new")
+	// crash with the immutable memtable unflushed
+	suite.crashRestart()
+	for i := range suite.db.gold {
+		suite.check(i)
+	}
+	logs, err := liveLogs(suite.fs, 0)
+	suite.Require().NoError(err)
+	suite.Len(logs, 1, "recovered logs should be deleted")
+}
+
+func (suite CompactionSuite) TestCloseWaitsForCompaction() {
+	suite.putValues(1, 500)
+	suite.Require().NoError(suite.db.Close())
+	suite.db.Database = MustOpen(suite.fs, suite.opts)
+	for i := 1; i <= 500; i++ {
+		suite.check(i)
+	}
+}
+
+// tableUpdates counts the updates stored in tables and their total size
+func (suite CompactionSuite) tableUpdates() (updates int, size uint64) {
+	for _, tables := range suite.db.mf.tables {
+		for _, t := range tables {
+			it := t.Updates()
+			for it.HasNext() {
+				it.Next()
+				updates++
+			}
+			suite.Require().NoError(it.Err())
+			size += t.Size()
+		}
+	}
+	return
+}
+
+func (suite CompactionSuite) TestOverwritesReclaimSpace() {
+	suite.putValues(1, 200)
+	suite.Require().NoError(suite.db.Compact())
+	_, size := suite.tableUpdates()
+	for round := 0; round < 5; round++ {
+		suite.putValues(1, 200)
+		suite.Require().NoError(suite.db.Compact())
+	}
+	updates, newSize := suite.tableUpdates()
+	suite.Equal(200, updates, "only the newest versions should be kept")
+	suite.Less(newSize, size*3/2)
+	for i := 1; i <= 200; i++ {
+		suite.check(i)
+	}
+}
+
+func (suite CompactionSuite) TestDeletesReclaimSpace() {
+	suite.putValues(1, 200)
+	suite.Require().NoError(suite.db.Compact())
+	for i := 1; i <= 200; i++ {
+		suite.db.Put(i, missing)
+	}
+	suite.Require().NoError(suite.db.Compact())
+	updates, size := suite.tableUpdates()
+	suite.Equal(0, updates, "deletes should be dropped at the bottom level")
+	suite.Equal(uint64(0), size)
+	for i := 1; i <= 200; i++ {
+		suite.check(i)
+	}
+	suite.crashRestart()
+	for i := 1; i <= 200; i++ {
+		suite.check(i)
+	}
+}
+
+func (suite CompactionSuite) TestCompactionKeepsSnapshotVersions() {
+	suite.putValues(1, 100)
+	snap := suite.db.Snapshot()
+	defer snap.Release()
+	for i := 1; i <= 100; i++ {
+		if i%2 == 0 {
+			suite.db.Put(i, missing)
+		} else {
+			suite.db.Put(i, "new")
+		}
+	}
+	suite.Require().NoError(suite.db.Compact())
+	updates, _ := suite.tableUpdates()
+	suite.Equal(200, updates, "versions the snapshot reads should be kept")
+	for i := 1; i <= 100; i++ {
+		v, err := snap.Get(intKey(i))
+		suite.Require().NoError(err)
+		suite.Equal(SomeValue(Value(fmt.Sprintf("val %d", i))), v)
+		suite.check(i)
+	}
+}
+
+func TestCompactionIterator(t *testing.T) {
+	put := func(k int, seq uint64) KeyUpdate {
+		return KeyUpdate{Key: intKey(k), Seq: seq, MaybeValue: SomeValue(Value("val"))}
+	}
+	del := func(k int, seq uint64) KeyUpdate {
+		return KeyUpdate{Key: intKey(k), Seq: seq, MaybeValue: NoValue}
+	}
+	newer := sliceUpdateIterator{put(1, 10), del(2, 9), put(3, 4)}
+	older := sliceUpdateIterator{put(1, 5), put(1, 3), put(2, 2), put(3, 4), del(4, 1)}
+	for _, tt := range []struct {
+		name             string
+		smallestSnapshot uint64
+		baseLevel        bool
+		expected         []KeyUpdate
+	}{
+		{"no snapshots", 10, true, []KeyUpdate{put(1, 10), put(3, 4)}},
+		{"not base level", 10, false,
+			[]KeyUpdate{put(1, 10), del(2, 9), put(3, 4), del(4, 1)}},
+		{"snapshot", 5, true,
+			[]KeyUpdate{put(1, 10), put(1, 5), del(2, 9), put(2, 2), put(3, 4)}},
+	} {
+		newer, older := newer, older
+		it := newCompactionIterator(
+			MergeUpdates([]UpdateIterator{&newer, &older}),
+			tt.smallestSnapshot, func(k Key) bool { return tt.baseLevel })
+		var updates []KeyUpdate
+		for it.HasNext() {
+			updates = append(updates, it.Next())
+		}
+		assert.NoError(t, it.Err())
+		assert.Equal(t, tt.expected, updates, tt.name)
+	}
+}
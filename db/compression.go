@@ -0,0 +1,117 @@
+package db
+
+// Block compression
+//
+// The updates under each table index entry are stored as a block, which is
+// compressed as a unit:
+//
+// block:
+//   data [n]byte
+//   type uint8
+//
+// The type byte records how the data is compressed, so tables (and blocks
+// within a table) written with different settings can be read alike. Data that
+// doesn't compress well is stored uncompressed. Flate data starts with the
+// uncompressed length (a uvarint), so it can be decompressed into a buffer of
+// the right size.
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CompressionType selects how tables compress their data.
+type CompressionType uint8
+
+const (
+	// NoCompression stores table data as-is.
+	NoCompression CompressionType = iota
+	// FlateCompression compresses table data with DEFLATE (compress/flate),
+	// favoring speed over compression ratio.
+	FlateCompression
+)
+
+func (c CompressionType) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case FlateCompression:
+		return "flate"
+	}
+	return fmt.Sprintf("CompressionType(%d)", int(c))
+}
+
+func (c CompressionType) isValid() bool {
+	return c == NoCompression || c == FlateCompression
+}
+
+// flateWriters holds idle flate writers, which are expensive to allocate
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// flateReaders holds idle flate readers
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// compressBlock encodes data as a block, compressed with c if that saves at
+// least an eighth of its size.
+func compressBlock(c CompressionType, data []byte) []byte {
+	if c == FlateCompression {
+		var buf bytes.Buffer
+		var lenBuf [binary.MaxVarintLen64]byte
+		buf.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(data)))])
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(&buf)
+		w.Write(data)
+		// writes to a bytes.Buffer cannot fail
+		w.Close()
+		flateWriters.Put(w)
+		if buf.Len() < len(data)-len(data)/8 {
+			buf.WriteByte(uint8(FlateCompression))
+			return buf.Bytes()
+		}
+	}
+	block := make([]byte, len(data)+1)
+	copy(block, data)
+	block[len(data)] = uint8(NoCompression)
+	return block
+}
+
+// decompressBlock decodes a block, returning its data.
+func decompressBlock(block []byte) ([]byte, error) {
+	if len(block) == 0 {
+		return nil, fmt.Errorf("%w: empty block", ErrCorruption)
+	}
+	data := block[:len(block)-1]
+	switch c := CompressionType(block[len(block)-1]); c {
+	case NoCompression:
+		return data, nil
+	case FlateCompression:
+		n, lenSize := binary.Uvarint(data)
+		// flate compresses at most about 1000:1
+		if lenSize <= 0 || n > uint64(len(data))*1100 {
+			return nil, fmt.Errorf("%w: bad block length", ErrCorruption)
+		}
+		r := flateReaders.Get().(io.ReadCloser)
+		defer flateReaders.Put(r)
+		r.(flate.Resetter).Reset(bytes.NewReader(data[lenSize:]), nil)
+		decompressed := make([]byte, n)
+		if _, err := io.ReadFull(r, decompressed); err != nil {
+			return nil, fmt.Errorf("%w: decompressing block: %v", ErrCorruption, err)
+		}
+		return decompressed, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown compression type %d", ErrCorruption, c)
+	}
+}
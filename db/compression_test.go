@@ -0,0 +1,124 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tchajed/specious-db/fs"
+)
+
+func TestCompressBlock(t *testing.T) {
+	assert := assert.New(t)
+	compressible := []byte(strings.Repeat(`{"name": "value"}`, 100))
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(0)).Read(random)
+	for _, tt := range []struct {
+		compression CompressionType
+		data        []byte
+		compressed  bool
+	}{
+		{NoCompression, compressible, false},
+		{FlateCompression, compressible, true},
+		{FlateCompression, random, false},
+		{FlateCompression, nil, false},
+	} {
+		block := compressBlock(tt.compression, tt.data)
+		if tt.compressed {
+			assert.Less(len(block), len(tt.data)/2, "data should be compressed")
+		} else {
+			assert.Equal(len(tt.data)+1, len(block), "data should be stored as-is")
+		}
+		data, err := decompressBlock(block)
+		if assert.NoError(err) {
+			assert.True(bytes.Equal(tt.data, data), "data should round-trip")
+		}
+	}
+}
+
+func TestDecompressCorruptBlock(t *testing.T) {
+	for _, block := range [][]byte{
+		{},
+		{1, 2, 3, 100},
+		{0xff, 0xff, 0xff, uint8(FlateCompression)},
+	} {
+		_, err := decompressBlock(block)
+		assert.True(t, errors.Is(err, ErrCorruption), "block %v (got %v)", block, err)
+	}
+}
+
+func jsonValue(i int) string {
+	return fmt.Sprintf(`{"id": %d, "name": "entry %d", "tags": ["a", "b", "c"], "description": "%s"}`,
+		i, i, strings.Repeat("lorem ipsum ", 10))
+}
+
+// tablesSize is the total size of a database's tables
+func tablesSize(db *Database) (size uint64) {
+	for _, tables := range db.mf.tables {
+		size += levelSize(tables)
+	}
+	return
+}
+
+func TestCompressedTables(t *testing.T) {
+	assert := assert.New(t)
+	var sizes []uint64
+	for _, compression := range []CompressionType{NoCompression, FlateCompression} {
+		db := newStringStore(MustInit(fs.MemFs(), &Options{Compression: compression}))
+		for i := 0; i < 1000; i++ {
+			db.Put(i, jsonValue(i))
+		}
+		must(db.Compact())
+		for i := 0; i < 1000; i += 7 {
+			assert.Equal(db.Expected(i), db.Get(i))
+		}
+		sizes = append(sizes, tablesSize(db.Database))
+	}
+	assert.Less(sizes[1], sizes[0]/3, "compressed tables should be smaller")
+}
+
+func TestCompressionPerLevel(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	opts := &Options{CompressionPerLevel: []CompressionType{NoCompression, FlateCompression}}
+	filesys := fs.MemFs()
+	db := newStringStore(MustInit(filesys, opts))
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 1000; i++ {
+			db.Put(i, jsonValue(i))
+		}
+		must(db.compactLog())
+	}
+	require.Len(db.mf.tables[0], 2)
+	l0Size := db.mf.tables[0][0].Size()
+	// the overlapping young tables are merged (rather than moved) into L1
+	must(db.compactYoung())
+	require.Len(db.mf.tables[1], 1)
+	assert.Less(db.mf.tables[1][0].Size(), l0Size/3,
+		"only L1 should be compressed")
+	assert.Equal(FlateCompression, opts.withDefaults().compressionForLevel(6))
+
+	// tables written without compression can still be read
+	must(db.Close())
+	db.Database = MustOpen(filesys, &Options{Compression: FlateCompression})
+	db.Put(1000, jsonValue(1000))
+	must(db.compactLog())
+	for _, i := range []int{0, 500, 999, 1000} {
+		assert.Equal(db.Expected(i), db.Get(i))
+	}
+}
+
+func TestInvalidCompression(t *testing.T) {
+	for _, opts := range []Options{
+		{Compression: CompressionType(10)},
+		{CompressionPerLevel: []CompressionType{NoCompression, CompressionType(10)}},
+	} {
+		_, err := Init(fs.MemFs(), &opts)
+		assert.True(t, errors.Is(err, ErrInvalidOptions), "options %+v should be invalid", opts)
+	}
+}
@@ -1,7 +1,10 @@
 package db
 
 import (
+	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tchajed/specious-db/fs"
@@ -15,143 +18,432 @@ func (stats *CompactionStats) AddTimeSince(start time.Time) {
 	stats.TotalTime += time.Now().Sub(start)
 }
 
+// RecoveryStats describes what opening the database recovered from its logs.
+type RecoveryStats struct {
+	// LogBytesDiscarded is the number of bytes at the ends of the logs that
+	// were not replayed, because they did not hold complete, valid records
+	// (from a write torn by a crash, or corruption).
+	LogBytesDiscarded int
+}
+
+// ReadStats counts how reads were served. The counters are updated
+// concurrently, so they should be read with its methods.
+type ReadStats struct {
+	filterAvoided uint64
+	cacheHits     uint64
+	cacheMisses   uint64
+}
+
+// FilterAvoided returns the number of table reads skipped because a table's
+// Bloom filter showed it did not have the key.
+func (stats *ReadStats) FilterAvoided() uint64 {
+	return atomic.LoadUint64(&stats.filterAvoided)
+}
+
+func (stats *ReadStats) addFilterAvoided() {
+	if stats != nil {
+		atomic.AddUint64(&stats.filterAvoided, 1)
+	}
+}
+
+// CacheHits returns the number of table reads served from the block cache.
+func (stats *ReadStats) CacheHits() uint64 {
+	return atomic.LoadUint64(&stats.cacheHits)
+}
+
+// CacheMisses returns the number of table reads that missed in the block
+// cache and went to the filesystem.
+func (stats *ReadStats) CacheMisses() uint64 {
+	return atomic.LoadUint64(&stats.cacheMisses)
+}
+
+func (stats *ReadStats) addCacheHit() {
+	if stats != nil {
+		atomic.AddUint64(&stats.cacheHits, 1)
+	}
+}
+
+func (stats *ReadStats) addCacheMiss() {
+	if stats != nil {
+		atomic.AddUint64(&stats.cacheMisses, 1)
+	}
+}
+
 // A Database is a persistent key-value store.
 type Database struct {
-	fs    fs.Filesys
-	log   *dbLog
+	fs  fs.Filesys
+	log *dbLog
+	// imm is the immutable memtable, a full log that is being flushed to a
+	// table in the background (nil if there is none)
+	imm   *dbLog
 	mf    Manifest
 	Stats *CompactionStats
-	l     *sync.RWMutex
+	// ReadStats is shared with the tables
+	ReadStats     *ReadStats
+	RecoveryStats RecoveryStats
+	l             *sync.RWMutex
+	// the sequence number of the most recent update
+	seq       uint64
+	snapshots *snapshotList
+	// err is set once the log can no longer be written (for example, after a
+	// failed write leaves a partial transaction); all further writes fail
+	// with this error (it is ErrReadOnly for a read-only database)
+	err  error
+	opts Options
+	// lock is held while the database is open
+	lock fs.Lock
+	// writes waiting to be logged
+	writers *writeQueue
+	// with SyncPeriodic, closing stopSync stops the background sync, which
+	// closes syncDone when it exits
+	stopSync chan struct{}
+	syncDone chan struct{}
+	// bgCond is signalled (using l) whenever a compaction or a log write
+	// finishes
+	bgCond *sync.Cond
+	// logWriting is set while the group commit leader writes to the log
+	// without the lock
+	logWriting bool
+	// compacting is set while a compaction is running (in the background or
+	// not); only one runs at a time
+	compacting bool
+	// closing is set by Close to stop scheduling background work
+	closing bool
+	// compactPointers records, for each level, the largest key of the last
+	// table compacted out of it, so compactions cycle through the level's
+	// keys
+	compactPointers [numLevels]Key
 }
 
-func (db *Database) Get(k Key) MaybeValue {
+// latestSeq is the sequence number that sees all updates (used by reads that
+// are not from a snapshot).
+const latestSeq = math.MaxUint64
+
+func (db *Database) Get(k Key) (MaybeValue, error) {
 	db.l.RLock()
 	defer db.l.RUnlock()
-	mv := db.log.Get(k)
+	return db.get(k, latestSeq)
+}
+
+// get reads the version of k as of sequence number seq.
+//
+// Requires a read lock.
+func (db *Database) get(k Key, seq uint64) (MaybeValue, error) {
+	mv := db.log.Get(k, seq)
 	if mv.Valid {
-		return mv.MaybeValue
+		return mv.MaybeValue, nil
 	}
-	return db.mf.Get(k)
+	if db.imm != nil {
+		mv := db.imm.Get(k, seq)
+		if mv.Valid {
+			return mv.MaybeValue, nil
+		}
+	}
+	return db.mf.Get(k, seq)
 }
 
-func (db *Database) Put(k Key, v Value) {
-	db.l.Lock()
-	defer db.l.Unlock()
+func (db *Database) Put(k Key, v Value) error {
+	return db.PutWith(k, v, WriteOptions{})
+}
 
-	db.log.Put(k, v)
-	if db.log.SizeEstimate() >= 4*1024*1024 {
-		db.compactLog()
-	}
-	if len(db.mf.tables[0]) >= 4 {
-		db.compactYoung()
-	}
+// PutWith is Put with options for the write.
+func (db *Database) PutWith(k Key, v Value, wo WriteOptions) error {
+	return db.write([]KeyUpdate{newPut(k, v)}, wo)
 }
 
-func (db *Database) Delete(k Key) {
-	db.l.Lock()
-	defer db.l.Unlock()
+// Write atomically applies a batch of updates, which are logged as a single
+// transaction.
+func (db *Database) Write(b *WriteBatch) error {
+	return db.WriteWith(b, WriteOptions{})
+}
+
+// WriteWith is Write with options for the write.
+func (db *Database) WriteWith(b *WriteBatch, wo WriteOptions) error {
+	return db.write(b.Updates(), wo)
+}
 
-	db.log.Delete(k)
+func (db *Database) Delete(k Key) error {
+	return db.DeleteWith(k, WriteOptions{})
+}
+
+// DeleteWith is Delete with options for the write.
+func (db *Database) DeleteWith(k Key, wo WriteOptions) error {
+	return db.write([]KeyUpdate{newDelete(k)}, wo)
+}
+
+// Scan iterates over the entries in the database with keys in r, in key order.
+//
+// The iterator sees the updates in the log at the time of the call, but reads
+// tables lazily as it goes. Tables replaced by compactions since then stay open
+// until the iterator is exhausted.
+func (db *Database) Scan(r KeyRange) Iterator {
+	db.l.RLock()
+	defer db.l.RUnlock()
+	return db.scan(r, latestSeq)
+}
+
+// scan iterates over the entries in r as of sequence number seq.
+//
+// Requires a read lock.
+func (db *Database) scan(r KeyRange, seq uint64) Iterator {
+	// the log holds the newest updates, followed by the immutable memtable and
+	// then the tables from newest to oldest
+	its := []UpdateIterator{db.log.UpdatesIn(r)}
+	if db.imm != nil {
+		its = append(its, db.imm.UpdatesIn(r))
+	}
+	its = append(its, db.mf.UpdatesIn(r)...)
+	it := newDbIterator(MergeUpdates(its), seq, db.mf.vlogs)
+	// the iterator reads the files after the lock is released, so they must
+	// stay open even if compaction replaces them
+	it.release = db.mf.Acquire()
+	return it
 }
 
 var _ Store = &Database{}
 
-// Init creates a new database in a filesystem, replacing anything in the
-// directory.
-func Init(filesys fs.Filesys) *Database {
-	fs.DeleteAll(filesys)
-	mf := initManifest(filesys)
-	log := initLog(filesys)
-	return &Database{filesys, log, mf, new(CompactionStats), new(sync.RWMutex)}
+func newDatabase(fs fs.Filesys, log *dbLog, mf Manifest, seq uint64, opts Options) *Database {
+	l := new(sync.RWMutex)
+	return &Database{
+		fs:        fs,
+		log:       log,
+		mf:        mf,
+		Stats:     new(CompactionStats),
+		ReadStats: mf.stats,
+		l:         l,
+		seq:       seq,
+		snapshots: newSnapshotList(),
+		opts:      opts,
+		writers:   newWriteQueue(),
+		bgCond:    sync.NewCond(l),
+	}
+}
+
+// Init creates a new database in a filesystem.
+//
+// This is Open with CreateIfMissing and ErrorIfExists set, so it fails if
+// there already is a database (use Destroy first to replace it).
+func Init(filesys fs.Filesys, opts *Options) (*Database, error) {
+	o := opts.withDefaults()
+	o.CreateIfMissing = true
+	o.ErrorIfExists = true
+	return Open(filesys, &o)
 }
 
-// Open recovers a Database from an existing on-disk database (of course this
-// also works following a clean shutdown).
-func Open(fs fs.Filesys) *Database {
-	mf := recoverManifest(fs)
-	updates := recoverUpdates(fs)
-	if len(updates) > 0 {
-		// save these to a table; this should be crash-safe because a
-		// partially-written table will be deleted by DeleteObsoleteFiles()
-		t := mf.CreateTable()
-		for _, e := range updates {
-			t.Put(e)
-		}
-		mf.InstallTable(t.Close(), nil, nil, 0)
-		// if we crash here, the log will be converted to a duplicate table
-		fs.Truncate("log")
+// create initializes a new database in a directory with no database.
+func create(filesys fs.Filesys, o Options) (*Database, error) {
+	// clear out the remains of an interrupted creation
+	if err := destroyFiles(filesys); err != nil {
+		return nil, err
 	}
-	log := initLog(fs)
-	return &Database{fs, log, mf, new(CompactionStats), new(sync.RWMutex)}
+	if err := o.save(filesys); err != nil {
+		return nil, err
+	}
+	const firstLog = 1
+	log, err := initLog(filesys, firstLog, o.Sync)
+	if err != nil {
+		return nil, err
+	}
+	// the manifest is created last, which marks the database as complete
+	mf, err := initManifest(filesys, o, firstLog)
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	return newDatabase(filesys, log, mf, 0, o), nil
 }
 
-func (db *Database) compactLog() {
-	// TODO: this could be more fine-grained
-	db.l.Lock()
-	defer db.l.Unlock()
-	start := time.Now()
-	defer db.Stats.AddTimeSince(start)
-	updates := db.log.Updates()
-	if len(updates) == 0 {
-		return
-	}
-	t := db.mf.CreateTable()
+// writeTable writes updates to a new table and installs it in L0, moving large
+// values to a value log, and records that the logs numbered below logNumber
+// (which held the updates) have been flushed.
+func writeTable(mf *Manifest, updates []KeyUpdate, lastSeq uint64, logNumber uint32) error {
+	t, err := mf.CreateTableSeparating(mf.opts.valueThreshold())
+	if err != nil {
+		return err
+	}
 	for _, e := range updates {
 		t.Put(e)
 	}
-	table := t.Close()
-	db.mf.InstallTable(table, nil, nil, 0)
-	db.log.Close()
-	db.fs.Truncate("log")
-	db.log = initLog(db.fs)
+	table, err := t.Close()
+	if err != nil {
+		return err
+	}
+	return mf.InstallFlushedTable(table, t.ValueLog(), lastSeq, logNumber)
 }
 
-func (db *Database) compactYoung() {
-	db.l.RLock()
-	start := time.Now()
-	defer db.Stats.AddTimeSince(start)
-	var youngTables []uint32
-	var level1Tables []uint32
-	var updateIterators []UpdateIterator
-	for _, t := range db.mf.tables[0] {
-		youngTables = append(youngTables, t.ident)
-		updateIterators = append(updateIterators, t.Updates())
-	}
-	// get overlapping tables
-	for _, t := range db.mf.tables[1] {
-		level1Tables = append(level1Tables, t.ident)
-		updateIterators = append(updateIterators, t.Updates())
-	}
-	t := db.mf.CreateTable()
-	it := MergeUpdates(updateIterators)
-	for it.HasNext() {
-		t.Put(it.Next())
-	}
-	table := t.Close()
-	db.l.RUnlock()
-	db.l.Lock()
-	db.mf.InstallTable(table, youngTables, level1Tables, 1)
-	db.l.Unlock()
+// Open opens the database in a filesystem, recovering from a crash if the
+// database was not closed cleanly.
+//
+// opts configures the database (nil uses the defaults); it need not match the
+// options the database was created with. If there is no database, Open
+// creates one if opts.CreateIfMissing is set and otherwise fails with an error
+// satisfying errors.Is(err, fs.ErrNotFound). If the directory has files that
+// are not part of a database, Open fails with ErrNotDatabase rather than
+// touching them.
+//
+// The database is locked until it is closed; opening a database that is
+// already open fails with ErrInUse.
+func Open(filesys fs.Filesys, opts *Options) (*Database, error) {
+	o := opts.withDefaults()
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	if o.ReadOnly {
+		// locking would create the lock file
+		return open(filesys, o)
+	}
+	l, err := lockDatabase(filesys)
+	if err != nil {
+		return nil, err
+	}
+	db, err := open(filesys, o)
+	if err != nil {
+		l.Unlock()
+		return nil, err
+	}
+	db.lock = l
+	if o.Sync == SyncPeriodic {
+		db.stopSync = make(chan struct{})
+		db.syncDone = make(chan struct{})
+		go db.syncPeriodically(o.SyncInterval)
+	}
+	return db, nil
 }
 
-// DeleteObsoleteFiles deletes files the database doesn't know about.
-//
-// This isn't currently correctly called by recovery, but at some point it is
-// required to clean up partially constructed tables that weren't successfully
-// added to the database.
-func (db *Database) DeleteObsoleteFiles() {
-	db.mf.cleanup()
+// open opens or creates the database, with the lock held.
+func open(filesys fs.Filesys, o Options) (*Database, error) {
+	exists, err := checkDatabaseDir(filesys)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if !o.CreateIfMissing {
+			return nil, fmt.Errorf("no database (and CreateIfMissing is not set): %w",
+				fs.ErrNotFound)
+		}
+		return create(filesys, o)
+	}
+	if o.ErrorIfExists {
+		return nil, ErrExists
+	}
+	legacy, err := isLegacyDatabase(filesys)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		if o.ReadOnly {
+			return nil, fmt.Errorf("%w: an integer-key database is upgraded when it is "+
+				"first opened, which cannot be done read-only", ErrReadOnly)
+		}
+		if err := upgradeLegacyDatabase(filesys, o); err != nil {
+			return nil, fmt.Errorf("upgrading integer-key database: %w", err)
+		}
+	}
+	return recoverDatabase(filesys, o)
 }
 
-// Compact manually triggers a full compaction of the log and tables.
-func (db *Database) Compact() {
-	db.compactLog()
-	db.compactYoung()
+// recoverDatabase opens an existing database.
+func recoverDatabase(fs fs.Filesys, o Options) (*Database, error) {
+	mf, err := recoverManifest(fs, o)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := liveLogs(fs, mf.logNumber)
+	if err != nil {
+		return nil, err
+	}
+	updates, logSeq, discarded, err := recoverUpdates(fs, logs)
+	if err != nil {
+		return nil, err
+	}
+	recovery := RecoveryStats{LogBytesDiscarded: discarded}
+	seq := mf.lastSeq
+	if logSeq > seq {
+		seq = logSeq
+	}
+	if o.ReadOnly {
+		db := newDatabase(fs, readOnlyLog(updates), mf, seq, o)
+		db.RecoveryStats = recovery
+		db.err = ErrReadOnly
+		return db, nil
+	}
+	// the new log must be numbered after the recovered logs
+	for _, n := range logs {
+		if n >= mf.nextIdent {
+			mf.nextIdent = n + 1
+		}
+	}
+	logNumber := mf.nextIdent
+	mf.nextIdent++
+	if len(updates) > 0 {
+		// save these to a table; this should be crash-safe because a
+		// partially-written table will be deleted by cleanup() on recovery
+		if err := writeTable(&mf, updates, seq, logNumber); err != nil {
+			return nil, err
+		}
+	}
+	// the recovered logs are now obsolete (if we crash before deleting them,
+	// cleanup() will delete them on recovery)
+	for _, n := range logs {
+		if err := fs.Delete(logName(n)); err != nil {
+			return nil, err
+		}
+	}
+	log, err := initLog(fs, logNumber, o.Sync)
+	if err != nil {
+		return nil, err
+	}
+	db := newDatabase(fs, log, mf, seq, o)
+	db.RecoveryStats = recovery
+	return db, nil
+}
+
+// syncPeriodically syncs the log every interval, until stopSync is closed.
+func (db *Database) syncPeriodically(interval time.Duration) {
+	defer close(db.syncDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stopSync:
+			return
+		case <-ticker.C:
+			// an empty synced write syncs the log in order with other writes,
+			// without holding the lock during the sync (a failure makes the
+			// database read-only, which writes report)
+			db.write(nil, WriteOptions{Sync: true})
+		}
+	}
 }
 
 // Close cleanly shuts down the database, and moreover pushes all data to tables
-// for simple recovery.
-func (db *Database) Close() {
-	db.compactLog()
-	db.log.Close()
+// for simple recovery (except for a read-only database, which is left as is).
+//
+// Waits for a running background compaction to finish.
+func (db *Database) Close() error {
+	if db.opts.ReadOnly {
+		if err := db.log.Close(); err != nil {
+			db.mf.Close()
+			return err
+		}
+		return db.mf.Close()
+	}
+	defer db.lock.Unlock()
+	if db.stopSync != nil {
+		close(db.stopSync)
+		<-db.syncDone
+	}
+	db.l.Lock()
+	db.closing = true
+	db.l.Unlock()
+	if err := db.compactLog(); err != nil {
+		db.log.Close()
+		db.mf.Close()
+		return err
+	}
+	if err := db.log.Close(); err != nil {
+		db.mf.Close()
+		return err
+	}
+	return db.mf.Close()
 }
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 
@@ -11,13 +12,19 @@ import (
 
 const missing = "<missing>"
 
+// intKey converts an integer to a key, so tests can use integer keys
+func intKey(k int) Key {
+	return Uint64Key(uint64(k))
+}
+
 type StringStore struct {
 	*Database
 	gold map[int]string
 }
 
 func (s StringStore) Get(k int) string {
-	v := s.Database.Get(Key(k))
+	v, err := s.Database.Get(intKey(k))
+	must(err)
 	if v.Present {
 		return string(v.Value)
 	}
@@ -34,10 +41,10 @@ func (s StringStore) Expected(k int) string {
 
 func (s StringStore) Put(k int, v string) {
 	if v == missing {
-		s.Database.Delete(Key(k))
+		must(s.Database.Delete(intKey(k)))
 		delete(s.gold, k)
 	} else {
-		s.Database.Put(Key(k), []byte(v))
+		must(s.Database.Put(intKey(k), []byte(v)))
 		s.gold[k] = v
 	}
 }
@@ -49,12 +56,21 @@ func newStringStore(db *Database) StringStore {
 type DbSuite struct {
 	suite.Suite
 	fs fs.Filesys
-	db StringStore
+	// options for the database (nil for the defaults)
+	opts *Options
+	db   StringStore
 }
 
 func (suite *DbSuite) SetupTest() {
 	suite.fs = fs.MemFs()
-	suite.db = newStringStore(Init(suite.fs))
+	suite.db = newStringStore(MustInit(suite.fs, suite.opts))
+}
+
+// crashRestart recovers the database without closing it, as if the process
+// had crashed (which releases the database's lock).
+func (suite *DbSuite) crashRestart() {
+	suite.Require().NoError(suite.db.lock.Unlock())
+	suite.db.Database = MustOpen(suite.fs, suite.opts)
 }
 
 func (suite *DbSuite) putValues(min, max int) {
@@ -70,9 +86,12 @@ func (suite *DbSuite) check(key int, msgAndArgs ...interface{}) {
 func TestDoubleInit(t *testing.T) {
 	assert := assert.New(t)
 	fs := fs.MemFs()
-	db := newStringStore(Init(fs))
+	db := newStringStore(MustInit(fs, nil))
 	db.Put(1, "val 1")
-	db.Close()
-	db = newStringStore(Init(fs))
+	assert.NoError(db.Close())
+	_, err := Init(fs, nil)
+	assert.True(errors.Is(err, ErrExists), "Init should not replace a database")
+	assert.NoError(Destroy(fs))
+	db = newStringStore(MustInit(fs, nil))
 	assert.Equal(missing, db.Get(1))
 }
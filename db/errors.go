@@ -0,0 +1,55 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tchajed/specious-db/bin"
+)
+
+// ErrCorruption is reported (wrapped in a more descriptive error) when the
+// database's on-disk data is corrupt. Check for it with errors.Is.
+//
+// Filesystem errors are reported wrapping fs.ErrNotFound or fs.ErrIO.
+var ErrCorruption = bin.ErrCorrupt
+
+// A CorruptionError reports corrupt data in a table, giving the table's file
+// and the offset of the data that failed its checksum or could not be decoded.
+// CorruptionErrors satisfy errors.Is for ErrCorruption.
+type CorruptionError struct {
+	Table  string
+	Offset uint64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("table %s at offset %d: %v", e.Table, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes CorruptionErrors match ErrCorruption.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+// ErrExists is reported when opening a database that already exists with
+// ErrorIfExists set.
+var ErrExists = errors.New("database already exists")
+
+// ErrInUse is reported when opening a database that is already open.
+var ErrInUse = errors.New("database already in use")
+
+// ErrReadOnly is reported when modifying a database opened with ReadOnly.
+var ErrReadOnly = errors.New("database is read-only")
+
+// ErrNotDatabase is reported when opening a directory that has files other
+// than a database's, which might be some other data; the files are not
+// modified.
+var ErrNotDatabase = errors.New("not a specious database")
+
+// ErrInvalidOptions is reported (wrapped with the invalid setting) when
+// creating or opening a database with invalid Options.
+var ErrInvalidOptions = errors.New("invalid options")
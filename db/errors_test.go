@@ -0,0 +1,213 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tchajed/specious-db/fs"
+)
+
+func overwriteFile(t *testing.T, filesys fs.Filesys, fname string, data []byte) {
+	require.NoError(t, filesys.Delete(fname))
+	f, err := filesys.Create(fname)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+// onlyFile returns the name of the single file of type ty in a database
+func onlyFile(t *testing.T, filesys fs.Filesys, ty fileType) string {
+	files, err := listFiles(filesys)
+	require.NoError(t, err)
+	require.Len(t, files[ty], 1)
+	return files[ty][0]
+}
+
+// currentManifest returns the name of the manifest log that CURRENT points to
+func currentManifest(t *testing.T, filesys fs.Filesys) string {
+	number, err := readCurrent(filesys)
+	require.NoError(t, err)
+	return manifestName(number)
+}
+
+// newClosedDb creates a database with some data in a table
+func newClosedDb(t *testing.T) fs.Filesys {
+	filesys := fs.MemFs()
+	db := MustInit(filesys, nil)
+	require.NoError(t, db.Put(intKey(1), []byte("val 1")))
+	require.NoError(t, db.Close())
+	return filesys
+}
+
+func TestOpenMissingManifest(t *testing.T) {
+	filesys := fs.MemFs()
+	_, err := Open(filesys, nil)
+	assert.True(t, errors.Is(err, fs.ErrNotFound), "error %v should be not found", err)
+}
+
+func TestOpenCorruptManifest(t *testing.T) {
+	filesys := newClosedDb(t)
+	overwriteFile(t, filesys, currentManifest(t, filesys), []byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	_, err := Open(filesys, nil)
+	assert.True(t, errors.Is(err, ErrCorruption), "error %v should be corruption", err)
+}
+
+func TestOpenTruncatedManifest(t *testing.T) {
+	filesys := newClosedDb(t)
+	manifest := currentManifest(t, filesys)
+	f, err := filesys.Open(manifest)
+	require.NoError(t, err)
+	data, err := f.ReadAt(0, 8+8+4)
+	require.NoError(t, err)
+	f.Close()
+	overwriteFile(t, filesys, manifest, data)
+	_, err = Open(filesys, nil)
+	assert.True(t, errors.Is(err, ErrCorruption), "error %v should be corruption", err)
+}
+
+func TestOpenOldFormat(t *testing.T) {
+	filesys := newClosedDb(t)
+	require.NoError(t, filesys.Delete(currentManifest(t, filesys)))
+	require.NoError(t, filesys.Delete(currentFile))
+	// versions 1 to 8 had a single manifest file, starting with a magic
+	// number and the version
+	var manifest bytes.Buffer
+	enc := newEncoder(&manifest)
+	enc.Uint32(manifestMagic)
+	enc.Uint32(8)
+	createFile(t, filesys, legacyManifestName)
+	overwriteFile(t, filesys, legacyManifestName, manifest.Bytes())
+	_, err := Open(filesys, nil)
+	assert.True(t, errors.Is(err, ErrCorruption), "error %v should be corruption", err)
+}
+
+func TestOpenMissingTable(t *testing.T) {
+	filesys := newClosedDb(t)
+	require.NoError(t, filesys.Delete(onlyFile(t, filesys, tableFile)))
+	_, err := Open(filesys, nil)
+	assert.True(t, errors.Is(err, fs.ErrNotFound), "error %v should be not found", err)
+}
+
+func TestOpenCorruptTable(t *testing.T) {
+	filesys := newClosedDb(t)
+	overwriteFile(t, filesys, onlyFile(t, filesys, tableFile), []byte{1, 2, 3})
+	_, err := Open(filesys, nil)
+	assert.True(t, errors.Is(err, ErrCorruption), "error %v should be corruption", err)
+}
+
+func TestOpenCorruptLog(t *testing.T) {
+	filesys := newClosedDb(t)
+	overwriteFile(t, filesys, onlyFile(t, filesys, logFile), []byte{7, 7, 7})
+	db, err := Open(filesys, nil)
+	require.NoError(t, err, "a corrupt log should be discarded")
+	assert.Equal(t, 3, db.RecoveryStats.LogBytesDiscarded)
+	v, err := db.Get(intKey(1))
+	assert.NoError(t, err)
+	assert.Equal(t, SomeValue([]byte("val 1")), v)
+	assert.NoError(t, db.Close())
+}
+
+// readFile reads all of a file's contents
+func readFile(t *testing.T, filesys fs.Filesys, fname string) []byte {
+	f, err := filesys.Open(fname)
+	require.NoError(t, err)
+	defer f.Close()
+	size, err := f.Size()
+	require.NoError(t, err)
+	data, err := f.ReadAt(0, size)
+	require.NoError(t, err)
+	return data
+}
+
+func TestOpenTornLog(t *testing.T) {
+	assert := assert.New(t)
+	filesys := fs.MemFs()
+	db := MustInit(filesys, nil)
+	require.NoError(t, db.Put(intKey(1), []byte("val 1")))
+	require.NoError(t, db.Put(intKey(2), []byte("val 2")))
+	require.NoError(t, db.Put(intKey(3), []byte("val 3")))
+	// crash, with the last write torn and a bit flipped in the second
+	require.NoError(t, db.lock.Unlock())
+	fname := onlyFile(t, filesys, logFile)
+	data := readFile(t, filesys, fname)
+	// the log has an 8-byte header followed by three records of the same size
+	recordSize := (len(data) - 8) / 3
+	data[8+2*recordSize-1] ^= 0x01
+	data = data[:len(data)-2]
+	overwriteFile(t, filesys, fname, data)
+
+	db, err := Open(filesys, nil)
+	require.NoError(t, err)
+	assert.Greater(db.RecoveryStats.LogBytesDiscarded, 0)
+	v, err := db.Get(intKey(1))
+	assert.NoError(err)
+	assert.Equal(SomeValue([]byte("val 1")), v, "writes before the corruption should be recovered")
+	for _, k := range []int{2, 3} {
+		v, err = db.Get(intKey(k))
+		assert.NoError(err)
+		assert.False(v.Present, "key %d should be discarded", k)
+	}
+	assert.NoError(db.Close())
+}
+
+var errInjected = errors.New("injected write failure")
+
+// failingFs is a Filesys whose newly created files fail writes while fail is
+// set.
+type failingFs struct {
+	fs.Filesys
+	fail *bool
+}
+
+type failingFile struct {
+	fs.File
+	fail *bool
+}
+
+func (f failingFile) Write(p []byte) (int, error) {
+	if *f.fail {
+		return 0, errInjected
+	}
+	return f.File.Write(p)
+}
+
+func (filesys failingFs) Create(fname string) (fs.File, error) {
+	f, err := filesys.Filesys.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	return failingFile{f, filesys.fail}, nil
+}
+
+func TestWriteFailure(t *testing.T) {
+	assert := assert.New(t)
+	fail := false
+	db := MustInit(failingFs{fs.MemFs(), &fail}, nil)
+	require.NoError(t, db.Put(intKey(1), []byte("val 1")))
+	fail = true
+	err := db.Put(intKey(2), []byte("val 2"))
+	assert.True(errors.Is(err, errInjected), "put should report write failure")
+	fail = false
+	err = db.Put(intKey(3), []byte("val 3"))
+	assert.True(errors.Is(err, errInjected), "database should not accept writes after a failure")
+	v, err := db.Get(intKey(1))
+	assert.NoError(err)
+	assert.Equal(SomeValue([]byte("val 1")), v, "reads should still work")
+	v, err = db.Get(intKey(2))
+	assert.NoError(err)
+	assert.False(v.Present, "failed put should not be visible")
+}
+
+func TestMustStore(t *testing.T) {
+	assert := assert.New(t)
+	s := MustStore{MustInit(fs.MemFs(), nil)}
+	s.Put(intKey(1), []byte("val"))
+	assert.Equal(SomeValue([]byte("val")), s.Get(intKey(1)))
+	s.Delete(intKey(1))
+	assert.Equal(NoValue, s.Get(intKey(1)))
+	s.Close()
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/tchajed/specious-db/fs"
+	"github.com/tchajed/specious-db/log"
+)
+
+// The files in a database directory are:
+//   CURRENT: the name of the current manifest log
+//   MANIFEST-NNNNNN: a manifest log, of changes to the set of tables and value
+//     logs (see manifest_log.go)
+//   log-NNNNNN.log: a write-ahead log
+//   OPTIONS: the options the database was created with
+//   LOCK: locked while the database is open, so only one user can open it
+//   table-NNNNNN.ldb: a table
+//   value-NNNNNN.vlog: a value log
+//
+// CURRENT is written last when creating a database, so a directory with some
+// of the other files but no CURRENT, none of which hold any data, is a database
+// whose creation was interrupted.
+//
+// A database with integer keys has a manifest file and a log file instead
+// (see legacy.go), and is upgraded when it is opened.
+
+// fileType classifies the files in a database directory.
+type fileType int
+
+const (
+	unknownFile fileType = iota
+	currentFileType
+	manifestFile
+	legacyManifestFile
+	legacyLogFile
+	logFile
+	optionsFileType
+	lockFileType
+	tableFile
+	valueLogFile
+)
+
+// parseFileName determines the type of a file in a database directory from
+// its name.
+func parseFileName(name string) fileType {
+	switch name {
+	case currentFile:
+		return currentFileType
+	case legacyManifestName:
+		return legacyManifestFile
+	case legacyLogName:
+		return legacyLogFile
+	case optionsFile:
+		return optionsFileType
+	case lockFile:
+		return lockFileType
+	}
+	if _, ok := parseLogName(name); ok {
+		return logFile
+	}
+	if _, ok := parseManifestName(name); ok {
+		return manifestFile
+	}
+	var ident uint32
+	if _, err := fmt.Sscanf(name, "table-%d.ldb", &ident); err == nil &&
+		identToName(ident) == name {
+		return tableFile
+	}
+	if _, err := fmt.Sscanf(name, "value-%d.vlog", &ident); err == nil &&
+		vlogName(ident) == name {
+		return valueLogFile
+	}
+	return unknownFile
+}
+
+// listFiles lists the files in a database directory by type.
+func listFiles(filesys fs.Filesys) (map[fileType][]string, error) {
+	names, err := filesys.List()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[fileType][]string)
+	for _, name := range names {
+		name = path.Base(name)
+		ty := parseFileName(name)
+		files[ty] = append(files[ty], name)
+	}
+	return files, nil
+}
+
+// checkDatabaseDir determines whether a directory holds a database, reporting
+// an error if it has files that are not part of a database.
+func checkDatabaseDir(filesys fs.Filesys) (exists bool, err error) {
+	files, err := listFiles(filesys)
+	if err != nil {
+		return false, err
+	}
+	if unknown := files[unknownFile]; len(unknown) > 0 {
+		return false, fmt.Errorf("%w: unexpected files %v", ErrNotDatabase, unknown)
+	}
+	if len(files[currentFileType]) > 0 {
+		return true, nil
+	}
+	if len(files[legacyManifestFile]) > 0 {
+		// an integer-key database, which open upgrades
+		return true, nil
+	}
+	if n := len(files[tableFile]) + len(files[valueLogFile]); n > 0 {
+		return false, fmt.Errorf("%w: %d tables and value logs but no manifest",
+			ErrCorruption, n)
+	}
+	for _, name := range files[logFile] {
+		txns, err := recoverLogFile(filesys, name)
+		if err != nil {
+			return false, err
+		}
+		if len(txns) > 0 {
+			return false, fmt.Errorf("%w: log %s has writes but there is no manifest",
+				ErrCorruption, name)
+		}
+	}
+	for _, name := range files[manifestFile] {
+		empty, err := isEmptyManifest(filesys, name)
+		if err != nil {
+			return false, err
+		}
+		if !empty {
+			return false, fmt.Errorf("%w: %s has tables but is not the current manifest",
+				ErrCorruption, name)
+		}
+	}
+	return false, nil
+}
+
+// recoverLogFile returns the transactions in a log file.
+func recoverLogFile(filesys fs.Filesys, name string) ([][]byte, error) {
+	f, err := filesys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	txns, err := log.RecoverTxns(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return txns, nil
+}
+
+// isEmptyManifest reports whether a manifest log was left by an interrupted
+// creation, with at most a snapshot of an empty manifest.
+func isEmptyManifest(filesys fs.Filesys, name string) (bool, error) {
+	txns, err := recoverLogFile(filesys, name)
+	if err != nil {
+		return false, err
+	}
+	if len(txns) < 2 {
+		// the snapshot was not completely written
+		return true, nil
+	}
+	number, _ := parseManifestName(name)
+	v, err := readManifestLog(filesys, number)
+	if err != nil {
+		return false, err
+	}
+	for _, level := range v.levels {
+		if len(level) > 0 {
+			return false, nil
+		}
+	}
+	return len(v.vlogs) == 0, nil
+}
+
+const lockFile = "LOCK"
+
+// lockDatabase locks the database directory, so that only one Database uses it
+// at a time.
+func lockDatabase(filesys fs.Filesys) (fs.Lock, error) {
+	l, err := filesys.Lock(lockFile)
+	if errors.Is(err, fs.ErrLocked) {
+		return nil, ErrInUse
+	}
+	return l, err
+}
+
+// Destroy deletes a database, removing all of its files. Fails with ErrInUse
+// if the database is open.
+//
+// Files that are not part of a database are left alone.
+func Destroy(filesys fs.Filesys) error {
+	l, err := lockDatabase(filesys)
+	if err != nil {
+		return err
+	}
+	if err := destroyFiles(filesys); err != nil {
+		l.Unlock()
+		return err
+	}
+	if err := filesys.Delete(lockFile); err != nil {
+		l.Unlock()
+		return err
+	}
+	return l.Unlock()
+}
+
+// destroyFiles deletes all of the files of a database except its lock file.
+func destroyFiles(filesys fs.Filesys) error {
+	files, err := listFiles(filesys)
+	if err != nil {
+		return err
+	}
+	// delete CURRENT first so that a partially deleted database is not
+	// mistaken for a complete one (Destroy can be called again to finish)
+	for _, ty := range []fileType{currentFileType, legacyManifestFile, manifestFile,
+		logFile, legacyLogFile, optionsFileType, tableFile, valueLogFile} {
+		for _, name := range files[ty] {
+			if err := filesys.Delete(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -22,15 +22,15 @@ func (suite FillSuite) put(key int) {
 func (suite FillSuite) TestFillDatabase() {
 	suite.put(1)
 	suite.put(7)
-	suite.db.compactLog()
+	suite.Require().NoError(suite.db.compactLog())
 	suite.put(2)
 	suite.put(5)
-	suite.db.compactLog()
+	suite.Require().NoError(suite.db.compactLog())
 	suite.put(10)
 	suite.put(3)
-	suite.db.compactLog()
+	suite.Require().NoError(suite.db.compactLog())
 	suite.put(12)
-	suite.db.compactYoung()
+	suite.Require().NoError(suite.db.compactYoung())
 	for key := 0; key < 12; key++ {
 		suite.check(key)
 	}
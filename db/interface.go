@@ -1,6 +1,47 @@
 package db
 
-type Key uint64
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// A Key is an arbitrary byte string. Keys are ordered bytewise (as by
+// bytes.Compare), so a shorter key sorts before any longer key it is a prefix
+// of, and the empty key is the smallest key.
+type Key []byte
+
+// Compare returns an integer comparing two keys bytewise: 0 if k == k2, -1 if
+// k < k2, and +1 if k > k2.
+func (k Key) Compare(k2 Key) int {
+	return bytes.Compare(k, k2)
+}
+
+// Equal reports whether k and k2 are the same key.
+func (k Key) Equal(k2 Key) bool {
+	return bytes.Equal(k, k2)
+}
+
+// Uint64Key converts a uint64 to a key, for applications that use integer
+// keys.
+//
+// The integer is encoded in big-endian so that the ordering of keys matches
+// the ordering of the integers.
+func Uint64Key(n uint64) Key {
+	k := make(Key, 8)
+	binary.BigEndian.PutUint64(k, n)
+	return k
+}
+
+// Uint64 converts a key created by Uint64Key back to an integer.
+//
+// Panics if k is not 8 bytes long.
+func (k Key) Uint64() uint64 {
+	if len(k) != 8 {
+		panic("key is not from Uint64Key")
+	}
+	return binary.BigEndian.Uint64(k)
+}
+
 type Value []byte
 
 type Entry struct {
@@ -19,9 +60,18 @@ func SomeValue(v Value) MaybeValue {
 	return MaybeValue{Present: true, Value: v}
 }
 
+// A KeyUpdate is a put or delete of a key.
+//
+// Every update in the database has a unique sequence number, which increases
+// with each write; the update with the largest sequence number for a key is the
+// current version of that key.
 type KeyUpdate struct {
 	Key
+	Seq uint64
 	MaybeValue
+	// for a put whose value is stored in a value log, points to the value
+	// (and Value is nil)
+	ptr valuePointer
 }
 
 func (u KeyUpdate) IsPut() bool {
@@ -29,23 +79,63 @@ func (u KeyUpdate) IsPut() bool {
 }
 
 type Store interface {
-	Get(k Key) MaybeValue
-	Put(k Key, v Value)
-	Delete(k Key)
-	// TODO: iterator API
-	Close()
+	Get(k Key) (MaybeValue, error)
+	Put(k Key, v Value) error
+	Delete(k Key) error
+	// Write applies all the updates in a batch atomically.
+	Write(b *WriteBatch) error
+	// Scan iterates over the entries with keys in r, in key order.
+	Scan(r KeyRange) Iterator
+	Close() error
 }
 
+// A KeyRange is the set of keys from Min to Max, inclusive.
+//
+// A nil Max means the range has no upper bound (there is no largest byte
+// string), while an empty but non-nil Max is the empty key.
 type KeyRange struct {
 	Min Key
 	Max Key
 }
 
+// AllKeys is a KeyRange that covers every key.
+var AllKeys = KeyRange{Min: Key{}, Max: nil}
+
+// IsUnbounded reports whether r has no upper bound.
+func (r KeyRange) IsUnbounded() bool {
+	return r.Max == nil
+}
+
+// belowMax reports whether k is no larger than r's upper bound.
+func (r KeyRange) belowMax(k Key) bool {
+	return r.IsUnbounded() || k.Compare(r.Max) <= 0
+}
+
 func (r KeyRange) Contains(k Key) bool {
-	return r.Min <= k && k <= r.Max
+	return r.Min.Compare(k) <= 0 && r.belowMax(k)
 }
 
+// Overlaps reports whether any key is in both r and r2.
+func (r KeyRange) Overlaps(r2 KeyRange) bool {
+	return r.belowMax(r2.Min) && r2.belowMax(r.Min)
+}
+
+// An UpdateIterator produces a sequence of updates.
+//
+// If reading the updates fails, HasNext returns false and Err reports the
+// error.
 type UpdateIterator interface {
 	HasNext() bool
 	Next() KeyUpdate
+	Err() error
+}
+
+// An Iterator produces the entries of a Store in key order.
+//
+// If iteration fails, HasNext returns false and Err reports the error; check
+// Err once HasNext returns false.
+type Iterator interface {
+	HasNext() bool
+	Next() Entry
+	Err() error
 }
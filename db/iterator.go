@@ -1,57 +1,263 @@
 package db
 
-// Maintains invariant that updates[i] is always the next value from
-// iterators[i] (or nil iff the iterator is empty). This is established at
-// initialization by MergeUpdates.
-type mergedIterator struct {
-	iterators []UpdateIterator
-	updates   []*KeyUpdate
+import "container/heap"
+
+// mergeInput is the next update from one of a mergedIterator's iterators.
+type mergeInput struct {
+	update KeyUpdate
+	// the index of the iterator, which breaks ties between equal updates
+	// (lower indices first)
+	priority int
 }
 
-// advance attempts to store the next result of iterators[i] (or nil if the
-// iterator is empty)
-func (mi mergedIterator) advance(i int) {
-	if mi.iterators[i].HasNext() {
-		next := mi.iterators[i].Next()
-		mi.updates[i] = &next
-	} else {
-		mi.updates[i] = nil
+// mergeHeap is a min-heap of inputs, ordered by update and then by priority.
+type mergeHeap []mergeInput
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if updateLess(h[i].update, h[j].update) {
+		return true
 	}
+	if updateLess(h[j].update, h[i].update) {
+		return false
+	}
+	return h[i].priority < h[j].priority
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeInput)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// Maintains invariant that the heap holds the next value from each non-empty
+// iterator. This is established at initialization by MergeUpdates.
+type mergedIterator struct {
+	iterators []UpdateIterator
+	heap      mergeHeap
+	// the first error from an iterator, noticed once it stops producing
+	// updates
+	err error
 }
 
 // MergeUpdates takes several iterators and produces a merged iterator.
 //
-// iterators should be sorted by key, and MergeUpdates will produce an iterator
-// that is also sorted.
+// iterators should be sorted by key and then from newest to oldest (the order
+// of updateLess), and MergeUpdates will produce an iterator that is also
+// sorted. The merge is stable: equal updates are produced in the order of the
+// iterators that hold them, so earlier iterators have priority.
+//
+// The iterators are merged with a heap, so each update takes O(log k) time
+// with k iterators.
 func MergeUpdates(iterators []UpdateIterator) UpdateIterator {
-	mi := mergedIterator{iterators, make([]*KeyUpdate, len(iterators))}
-	for i := range iterators {
-		mi.advance(i)
+	mi := &mergedIterator{iterators: iterators, heap: make(mergeHeap, 0, len(iterators))}
+	for i, it := range iterators {
+		if it.HasNext() {
+			mi.heap = append(mi.heap, mergeInput{it.Next(), i})
+		} else if err := it.Err(); err != nil && mi.err == nil {
+			mi.err = err
+		}
 	}
+	heap.Init(&mi.heap)
 	return mi
 }
 
-func (mi mergedIterator) HasNext() bool {
-	for _, up := range mi.updates {
-		if up != nil {
-			return true
+func (mi *mergedIterator) HasNext() bool {
+	if mi.err != nil {
+		// stop early rather than produce updates that skip over the failed
+		// iterator's remaining updates
+		return false
+	}
+	return len(mi.heap) > 0
+}
+
+// Err returns the first error from any of the merged iterators.
+func (mi *mergedIterator) Err() error {
+	return mi.err
+}
+
+func (mi *mergedIterator) Next() KeyUpdate {
+	next := mi.heap[0]
+	it := mi.iterators[next.priority]
+	if it.HasNext() {
+		mi.heap[0].update = it.Next()
+		heap.Fix(&mi.heap, 0)
+	} else {
+		if err := it.Err(); err != nil && mi.err == nil {
+			mi.err = err
+		}
+		heap.Pop(&mi.heap)
+	}
+	return next.update
+}
+
+// compactionIterator filters a merged stream of updates for a compaction,
+// dropping the versions that no reader can see.
+//
+// The updates must be sorted by key with newer updates to the same key first,
+// with duplicate updates (to the same key with the same sequence number) in
+// order of priority (the order MergeUpdates produces from inputs ordered from
+// newest to oldest). Only the first of a set of duplicates is kept. Every
+// reader reads as of smallestSnapshot or later, so an update is dropped if a
+// newer update to its key is no newer than smallestSnapshot. A delete that
+// every reader sees is also dropped if isBaseLevel reports that no older
+// update to its key can be in a deeper level.
+type compactionIterator struct {
+	updates          UpdateIterator
+	smallestSnapshot uint64
+	isBaseLevel      func(k Key) bool
+	// the next update to return, if it has been found already
+	next *KeyUpdate
+	// the key and sequence number of the last update read from updates
+	lastKey Key
+	lastSeq uint64
+	started bool
+}
+
+func newCompactionIterator(updates UpdateIterator, smallestSnapshot uint64, isBaseLevel func(k Key) bool) *compactionIterator {
+	return &compactionIterator{
+		updates:          updates,
+		smallestSnapshot: smallestSnapshot,
+		isBaseLevel:      isBaseLevel,
+	}
+}
+
+func (it *compactionIterator) HasNext() bool {
+	for it.next == nil && it.updates.HasNext() {
+		u := it.updates.Next()
+		if it.started && u.Key.Equal(it.lastKey) {
+			if u.Seq == it.lastSeq {
+				// a duplicate of an update from a newer input
+				continue
+			}
+			if it.lastSeq <= it.smallestSnapshot {
+				// shadowed by a newer update every reader sees
+				it.lastSeq = u.Seq
+				continue
+			}
+		}
+		it.started = true
+		it.lastKey = u.Key
+		it.lastSeq = u.Seq
+		if !u.IsPut() && u.Seq <= it.smallestSnapshot && it.isBaseLevel(u.Key) {
+			// every reader sees the delete, and there is nothing left for it
+			// to shadow (the older updates are dropped above)
+			continue
 		}
+		it.next = &u
 	}
-	return false
+	return it.next != nil
+}
+
+func (it *compactionIterator) Err() error {
+	return it.updates.Err()
+}
+
+func (it *compactionIterator) Next() KeyUpdate {
+	// HasNext has returned true, so the next update has been found.
+	u := *it.next
+	it.next = nil
+	return u
 }
 
-func (mi mergedIterator) Next() KeyUpdate {
-	minIndex := 0
-	var minUpdate *KeyUpdate
-	for i, up := range mi.updates {
-		if up == nil {
+// sliceUpdateIterator iterates over an in-memory, sorted list of updates.
+type sliceUpdateIterator []KeyUpdate
+
+func (it sliceUpdateIterator) HasNext() bool {
+	return len(it) > 0
+}
+
+func (it *sliceUpdateIterator) Next() KeyUpdate {
+	up := (*it)[0]
+	*it = (*it)[1:]
+	return up
+}
+
+func (it sliceUpdateIterator) Err() error {
+	return nil
+}
+
+// dbIterator turns a merged stream of updates into the entries it represents
+// as of sequence number seq.
+//
+// The updates must be sorted by key with newer updates to the same key first
+// (the order MergeUpdates produces); updates newer than seq are ignored, only
+// the first remaining update to each key counts, and keys whose newest update
+// is a delete are skipped. Values stored in value logs are read from vlogs.
+type dbIterator struct {
+	updates UpdateIterator
+	seq     uint64
+	vlogs   valueLogs
+	// the next entry to return, if it has been found already
+	next *Entry
+	// the last key read from updates, to skip older updates to the same key
+	lastKey Key
+	started bool
+	err     error
+	// release (if not nil) is called once the iterator is exhausted, to
+	// release the files it reads
+	release func()
+}
+
+func newDbIterator(updates UpdateIterator, seq uint64, vlogs valueLogs) *dbIterator {
+	return &dbIterator{updates: updates, seq: seq, vlogs: vlogs}
+}
+
+func (it *dbIterator) HasNext() bool {
+	for it.next == nil && it.err == nil && it.updates.HasNext() {
+		u := it.updates.Next()
+		if u.Seq > it.seq {
+			// not visible at this sequence number
 			continue
 		}
-		if minUpdate == nil || up.Key < minUpdate.Key {
-			minIndex = i
-			minUpdate = up
+		if it.started && u.Key.Equal(it.lastKey) {
+			// shadowed by a newer update
+			continue
+		}
+		it.started = true
+		it.lastKey = u.Key
+		if u.IsPut() {
+			u, err := it.vlogs.Resolve(u)
+			if err != nil {
+				it.err = err
+				it.finish()
+				return false
+			}
+			it.next = &Entry{u.Key, u.Value}
 		}
 	}
-	mi.advance(minIndex)
-	return *minUpdate
+	if it.next == nil {
+		it.finish()
+		return false
+	}
+	return true
+}
+
+// finish releases the iterator's files once it has no more entries.
+func (it *dbIterator) finish() {
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+}
+
+func (it *dbIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.updates.Err()
+}
+
+func (it *dbIterator) Next() Entry {
+	// HasNext has returned true, so the next entry has been found.
+	e := *it.next
+	it.next = nil
+	return e
 }
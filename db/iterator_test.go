@@ -1,23 +1,13 @@
 package db
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
-type sliceUpdateIterator []KeyUpdate
-
-func (it sliceUpdateIterator) HasNext() bool {
-	return len(it) > 0
-}
-
-func (it *sliceUpdateIterator) Next() KeyUpdate {
-	up := (*it)[0]
-	*it = (*it)[1:]
-	return up
-}
-
 func combineUpdates(data [][]KeyUpdate) (its []UpdateIterator) {
 	for _, updates := range data {
 		it := sliceUpdateIterator(updates)
@@ -69,3 +59,134 @@ func TestMergedIterator(t *testing.T) {
 		assert.Equal(expected, actual)
 	}
 }
+
+func TestMergedIteratorStable(t *testing.T) {
+	assert := assert.New(t)
+	it := MergeUpdates(combineUpdates([][]KeyUpdate{
+		{putU(1, "new"), putU(3, "new")},
+		{deleteU(1), putU(2, "old")},
+		{putU(1, "oldest")},
+	}))
+	var actual []KeyUpdate
+	for it.HasNext() {
+		actual = append(actual, it.Next())
+	}
+	assert.Equal([]KeyUpdate{
+		putU(1, "new"), deleteU(1), putU(1, "oldest"),
+		putU(2, "old"),
+		putU(3, "new"),
+	}, actual, "equal keys should be merged in iterator order")
+}
+
+// failingIterator produces some updates and then fails
+type failingIterator struct {
+	sliceUpdateIterator
+}
+
+func (it *failingIterator) Err() error {
+	if it.HasNext() {
+		return nil
+	}
+	return errors.New("read failed")
+}
+
+func TestMergedIteratorError(t *testing.T) {
+	assert := assert.New(t)
+	ok := sliceUpdateIterator{putU(1, ""), putU(3, ""), putU(5, "")}
+	it := MergeUpdates([]UpdateIterator{
+		&ok,
+		&failingIterator{sliceUpdateIterator{putU(2, "")}},
+	})
+	var actual []KeyUpdate
+	for it.HasNext() {
+		actual = append(actual, it.Next())
+	}
+	assert.Error(it.Err())
+	assert.Equal([]KeyUpdate{putU(1, ""), putU(2, "")}, actual,
+		"merge should stop at the failed iterator")
+}
+
+// linearMergedIterator is the straightforward merge that scans every input
+// for each update, for comparison in BenchmarkMergeUpdates.
+type linearMergedIterator struct {
+	iterators []UpdateIterator
+	updates   []*KeyUpdate
+}
+
+func linearMergeUpdates(iterators []UpdateIterator) UpdateIterator {
+	mi := linearMergedIterator{iterators, make([]*KeyUpdate, len(iterators))}
+	for i := range iterators {
+		mi.advance(i)
+	}
+	return mi
+}
+
+func (mi linearMergedIterator) advance(i int) {
+	if mi.iterators[i].HasNext() {
+		next := mi.iterators[i].Next()
+		mi.updates[i] = &next
+	} else {
+		mi.updates[i] = nil
+	}
+}
+
+func (mi linearMergedIterator) HasNext() bool {
+	for _, up := range mi.updates {
+		if up != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (mi linearMergedIterator) Err() error {
+	return nil
+}
+
+func (mi linearMergedIterator) Next() KeyUpdate {
+	minIndex := 0
+	var minUpdate *KeyUpdate
+	for i, up := range mi.updates {
+		if up == nil {
+			continue
+		}
+		if minUpdate == nil || updateLess(*up, *minUpdate) {
+			minIndex = i
+			minUpdate = up
+		}
+	}
+	mi.advance(minIndex)
+	return *minUpdate
+}
+
+// interleavedUpdates spreads n keys over k sorted inputs
+func interleavedUpdates(n, k int) [][]KeyUpdate {
+	data := make([][]KeyUpdate, k)
+	for i := 0; i < n; i++ {
+		data[i%k] = append(data[i%k], putU(i, ""))
+	}
+	return data
+}
+
+func BenchmarkMergeUpdates(b *testing.B) {
+	const n = 1 << 14
+	for _, k := range []int{2, 16, 128} {
+		data := interleavedUpdates(n, k)
+		for _, impl := range []struct {
+			name  string
+			merge func([]UpdateIterator) UpdateIterator
+		}{
+			{"heap", MergeUpdates},
+			{"linear", linearMergeUpdates},
+		} {
+			b.Run(fmt.Sprintf("k=%d/%s", k, impl.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					it := impl.merge(combineUpdates(data))
+					for it.HasNext() {
+						it.Next()
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package db
+
+// Upgrading integer-key databases
+//
+// Before keys were byte strings, keys were uint64s and a database had these
+// files (with no format version):
+//   manifest: the tables
+//   log: a version 1 log (see the log package) of updates
+//   table-NNNNNN.ldb: a table
+//
+// manifest:
+//   numTables uint32
+//   tables [numTables](level uint8, ident uint32)
+//
+// table:
+//   updates: update*
+//   index: (offset varint, length varint, min varint, max varint)*
+//   index_ptr: (offset uint64, length uint32)
+//
+// update:
+//   key varint
+//   value Array16 (a length of 0xffff marks a delete)
+//
+// The young tables (L0) are in the order they were written, and are newer
+// than the tables in L1.
+//
+// Open upgrades such a database by rewriting each of its tables, oldest first,
+// and then its log, as an L0 table in the current format. Keys are converted
+// with Uint64Key, which preserves their order, and sequence numbers are
+// assigned in the order the updates were written. CURRENT is written last, so
+// an interrupted upgrade is started over, and the old files are deleted once
+// it is complete.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/tchajed/specious-db/fs"
+	"github.com/tchajed/specious-db/log"
+)
+
+const (
+	legacyManifestName = "manifest"
+	legacyLogName      = "log"
+	// legacyIndexPtrSize is the size of a legacy table's index_ptr
+	legacyIndexPtrSize = 8 + 4
+	// legacyDeleteLength is the value length that marks a delete
+	legacyDeleteLength = 0xffff
+)
+
+// readLegacyManifest returns the table idents in a legacy manifest, oldest
+// first.
+func readLegacyManifest(filesys fs.Filesys) ([]uint32, error) {
+	f, err := filesys.Open(legacyManifestName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == manifestMagic {
+		// versions 1 to 8 had a single manifest file, which was rewritten for
+		// every change
+		return nil, fmt.Errorf("%w: manifest is from an unsupported format version",
+			ErrCorruption)
+	}
+	dec := newDecoder(data)
+	numTables := dec.Uint32()
+	var levels [2][]uint32
+	for i := 0; i < int(numTables) && dec.Err() == nil; i++ {
+		level := dec.Uint8()
+		ident := dec.Uint32()
+		if int(level) >= len(levels) {
+			return nil, fmt.Errorf("%w: invalid level %d in legacy manifest",
+				ErrCorruption, level)
+		}
+		levels[level] = append(levels[level], ident)
+	}
+	if err := dec.Err(); err != nil {
+		return nil, fmt.Errorf("legacy manifest: %w", err)
+	}
+	if dec.RemainingBytes() > 0 {
+		return nil, fmt.Errorf("%w: legacy manifest has %d leftover bytes",
+			ErrCorruption, dec.RemainingBytes())
+	}
+	return append(levels[1], levels[0]...), nil
+}
+
+// legacyUpdate decodes an update from a legacy table or log.
+func (r Decoder) legacyUpdate() KeyUpdate {
+	key := Uint64Key(r.VarInt())
+	length := r.Uint16()
+	if length == legacyDeleteLength {
+		return KeyUpdate{Key: key, MaybeValue: NoValue}
+	}
+	return KeyUpdate{Key: key, MaybeValue: SomeValue(r.Bytes(int(length)))}
+}
+
+// readLegacyTable calls put with each update in a legacy table, in key order.
+//
+// A legacy compaction could write a key to a table more than once; reads used
+// the first occurrence, so only that one is kept.
+func readLegacyTable(filesys fs.Filesys, ident uint32, put func(KeyUpdate)) error {
+	name := identToName(ident)
+	f, err := filesys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+	if size < legacyIndexPtrSize {
+		return fmt.Errorf("%w: %s is too small for a legacy table", ErrCorruption, name)
+	}
+	data, err := f.ReadAt(size-legacyIndexPtrSize, legacyIndexPtrSize)
+	if err != nil {
+		return err
+	}
+	dec := newDecoder(data)
+	indexOffset, indexLength := dec.Uint64(), dec.Uint32()
+	if indexOffset+uint64(indexLength) > uint64(size-legacyIndexPtrSize) {
+		return fmt.Errorf("%w: %s has an invalid index pointer", ErrCorruption, name)
+	}
+	data, err = f.ReadAt(int(indexOffset), int(indexLength))
+	if err != nil {
+		return err
+	}
+	index := newDecoder(data)
+	var lastKey Key
+	for index.RemainingBytes() > 0 {
+		offset, length := index.VarInt(), index.VarInt()
+		index.VarInt() // the entry's key range
+		index.VarInt()
+		if index.Err() != nil || offset+length > indexOffset {
+			return fmt.Errorf("%w: %s has an invalid index", ErrCorruption, name)
+		}
+		data, err := f.ReadAt(int(offset), int(length))
+		if err != nil {
+			return err
+		}
+		r := newDecoder(data)
+		for r.RemainingBytes() > 0 {
+			u := r.legacyUpdate()
+			if err := r.Err(); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if lastKey != nil && u.Key.Equal(lastKey) {
+				continue
+			}
+			lastKey = u.Key
+			put(u)
+		}
+	}
+	return nil
+}
+
+// readLegacyLog returns the updates in a legacy log, keeping only the last
+// update to each key (in key order).
+func readLegacyLog(filesys fs.Filesys) ([]KeyUpdate, error) {
+	f, err := filesys.Open(legacyLogName)
+	if errors.Is(err, fs.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	txns, err := log.RecoverTxns(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	cache := newSearchTree()
+	for _, txn := range txns {
+		r := newDecoder(txn)
+		for r.RemainingBytes() > 0 {
+			u := r.legacyUpdate()
+			if err := r.Err(); err != nil {
+				return nil, fmt.Errorf("%s: %w", legacyLogName, err)
+			}
+			cache.Add(u, 0)
+		}
+	}
+	return cache.Updates(), nil
+}
+
+// isLegacyDatabase reports whether a directory holds a database that needs to
+// be upgraded (or a database whose upgrade was interrupted).
+func isLegacyDatabase(filesys fs.Filesys) (bool, error) {
+	files, err := listFiles(filesys)
+	if err != nil {
+		return false, err
+	}
+	return len(files[currentFileType]) == 0 && len(files[legacyManifestFile]) > 0, nil
+}
+
+// upgradeLegacyDatabase converts an integer-key database to the current format.
+func upgradeLegacyDatabase(filesys fs.Filesys, o Options) error {
+	idents, err := readLegacyManifest(filesys)
+	if err != nil {
+		return err
+	}
+	if err := deleteUpgradeLeftovers(filesys, idents); err != nil {
+		return err
+	}
+	maxIdent := uint32(0)
+	for _, ident := range idents {
+		if ident > maxIdent {
+			maxIdent = ident
+		}
+	}
+	m := Manifest{filesys, make([][]Table, numLevels), maxIdent + 1, 0, 0, nil, o,
+		new(ReadStats), nil, nil}
+	closed := false
+	defer func() {
+		if !closed {
+			m.Close()
+		}
+	}()
+	// writeTable writes updates (in key order) as the next L0 table
+	writeTable := func(write func(put func(KeyUpdate)) error) error {
+		c, err := m.CreateTableSeparating(o.valueThreshold())
+		if err != nil {
+			return err
+		}
+		empty := true
+		err = write(func(u KeyUpdate) {
+			m.lastSeq++
+			u.Seq = m.lastSeq
+			c.Put(u)
+			empty = false
+		})
+		if err != nil || empty {
+			c.Abort()
+			return err
+		}
+		t, err := c.Close()
+		if err != nil {
+			return err
+		}
+		m.tables[0] = append(m.tables[0], t)
+		if l := c.ValueLog(); l != nil {
+			m.vlogs = append(m.vlogs, *l)
+		}
+		return nil
+	}
+	for _, ident := range idents {
+		err := writeTable(func(put func(KeyUpdate)) error {
+			return readLegacyTable(filesys, ident, put)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	updates, err := readLegacyLog(filesys)
+	if err != nil {
+		return err
+	}
+	err = writeTable(func(put func(KeyUpdate)) error {
+		for _, u := range updates {
+			put(u)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := o.save(filesys); err != nil {
+		return err
+	}
+	m.logNumber = m.nextIdent
+	m.nextIdent++
+	l, err := initLog(filesys, m.logNumber, o.Sync)
+	if err != nil {
+		return err
+	}
+	if err := l.Close(); err != nil {
+		return err
+	}
+	// the upgrade is complete once CURRENT is written
+	if err := m.writeSnapshot(); err != nil {
+		return err
+	}
+	closed = true
+	if err := m.Close(); err != nil {
+		return err
+	}
+	// failing to delete the old files only wastes space, and cleanup() will
+	// try again on recovery
+	for _, ident := range idents {
+		filesys.Delete(identToName(ident))
+	}
+	filesys.Delete(legacyLogName)
+	filesys.Delete(legacyManifestName)
+	return nil
+}
+
+// deleteUpgradeLeftovers deletes the files written by an interrupted upgrade,
+// which are all of the files other than the old manifest, log, and tables.
+func deleteUpgradeLeftovers(filesys fs.Filesys, idents []uint32) error {
+	files, err := listFiles(filesys)
+	if err != nil {
+		return err
+	}
+	legacyTables := make(map[string]bool)
+	for _, ident := range idents {
+		legacyTables[identToName(ident)] = true
+	}
+	var leftovers []string
+	for _, ty := range []fileType{optionsFileType, logFile, manifestFile, valueLogFile} {
+		leftovers = append(leftovers, files[ty]...)
+	}
+	for _, name := range files[tableFile] {
+		if !legacyTables[name] {
+			leftovers = append(leftovers, name)
+		}
+	}
+	for _, name := range leftovers {
+		if err := filesys.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
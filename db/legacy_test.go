@@ -0,0 +1,193 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tchajed/specious-db/fs"
+)
+
+// legacyPut is an update in an integer-key database (a nil value is a delete)
+type legacyPut struct {
+	key   uint64
+	value []byte
+}
+
+func encodeLegacyUpdate(w *Encoder, u legacyPut) {
+	w.VarInt(u.key)
+	if u.value == nil {
+		w.Uint16(legacyDeleteLength)
+	} else {
+		w.Array16(u.value)
+	}
+}
+
+// writeLegacyTable writes a table in the integer-key format
+func writeLegacyTable(t *testing.T, filesys fs.Filesys, ident uint32, updates []legacyPut) {
+	var buf bytes.Buffer
+	w := newEncoder(&buf)
+	var index bytes.Buffer
+	iw := newEncoder(&index)
+	for start := 0; start < len(updates); start += 10 {
+		end := start + 10
+		if end > len(updates) {
+			end = len(updates)
+		}
+		offset := w.BytesWritten()
+		for _, u := range updates[start:end] {
+			encodeLegacyUpdate(&w, u)
+		}
+		iw.VarInt(uint64(offset))
+		iw.VarInt(uint64(w.BytesWritten() - offset))
+		iw.VarInt(updates[start].key)
+		iw.VarInt(updates[end-1].key)
+	}
+	indexOffset := w.BytesWritten()
+	w.Bytes(index.Bytes())
+	w.Uint64(uint64(indexOffset))
+	w.Uint32(uint32(index.Len()))
+	writeFile(t, filesys, identToName(ident), buf.Bytes())
+}
+
+// writeLegacyDatabase writes an integer-key database with tables (given as
+// level and ident) and a log with a transaction for each update in logged
+func writeLegacyDatabase(t *testing.T, filesys fs.Filesys, tables [][2]uint32, logged []legacyPut) {
+	var manifest bytes.Buffer
+	w := newEncoder(&manifest)
+	w.Uint32(uint32(len(tables)))
+	for _, table := range tables {
+		w.Uint8(uint8(table[0]))
+		w.Uint32(table[1])
+	}
+	writeFile(t, filesys, legacyManifestName, manifest.Bytes())
+	var log bytes.Buffer
+	lw := newEncoder(&log)
+	for _, u := range logged {
+		var txn bytes.Buffer
+		tw := newEncoder(&txn)
+		encodeLegacyUpdate(&tw, u)
+		// a version 1 log record: a data record and then a commit record
+		lw.Uint8(1)
+		lw.Array16(txn.Bytes())
+		lw.Uint8(2)
+	}
+	writeFile(t, filesys, legacyLogName, log.Bytes())
+}
+
+func writeFile(t *testing.T, filesys fs.Filesys, fname string, data []byte) {
+	f, err := filesys.Create(fname)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+// newLegacyDb creates an integer-key database where key k has the value
+// expected[k] (with missing keys deleted)
+func newLegacyDb(t *testing.T) (filesys fs.Filesys, expected map[uint64]string) {
+	filesys = fs.MemFs()
+	expected = make(map[uint64]string)
+	var old []legacyPut
+	for k := uint64(1); k <= 30; k++ {
+		old = append(old, legacyPut{k, []byte(fmt.Sprintf("old %d", k))})
+		expected[k] = fmt.Sprintf("old %d", k)
+	}
+	writeLegacyTable(t, filesys, 3, old)
+	var young []legacyPut
+	for k := uint64(5); k <= 8; k++ {
+		young = append(young, legacyPut{k, []byte("young")})
+		expected[k] = "young"
+	}
+	young = append(young, legacyPut{9, nil})
+	delete(expected, 9)
+	writeLegacyTable(t, filesys, 4, young)
+	writeLegacyTable(t, filesys, 5, []legacyPut{{5, []byte("newer")}})
+	expected[5] = "newer"
+	writeLegacyDatabase(t, filesys, [][2]uint32{{1, 3}, {0, 4}, {0, 5}},
+		[]legacyPut{{1, []byte("log")}, {2, nil}, {40, []byte("new key")}})
+	expected[1] = "log"
+	delete(expected, 2)
+	expected[40] = "new key"
+	return filesys, expected
+}
+
+func checkLegacyValues(t *testing.T, db *Database, expected map[uint64]string) {
+	for k := uint64(0); k <= 50; k++ {
+		v, err := db.Get(Uint64Key(k))
+		require.NoError(t, err)
+		if val, ok := expected[k]; ok {
+			assert.Equal(t, SomeValue([]byte(val)), v, "key %d", k)
+		} else {
+			assert.False(t, v.Present, "key %d should be missing", k)
+		}
+	}
+}
+
+func TestUpgradeLegacyDatabase(t *testing.T) {
+	filesys, expected := newLegacyDb(t)
+	db, err := Open(filesys, nil)
+	require.NoError(t, err)
+	checkLegacyValues(t, db, expected)
+	files, err := listFiles(filesys)
+	require.NoError(t, err)
+	assert.Empty(t, files[legacyManifestFile], "old files should be deleted")
+	assert.Empty(t, files[legacyLogFile], "old files should be deleted")
+	require.NoError(t, db.Put(Uint64Key(2), []byte("new")))
+	expected[2] = "new"
+	require.NoError(t, db.Compact())
+	checkLegacyValues(t, db, expected)
+	require.NoError(t, db.Close())
+
+	db, err = Open(filesys, nil)
+	require.NoError(t, err)
+	checkLegacyValues(t, db, expected)
+	require.NoError(t, db.Close())
+}
+
+func TestUpgradeDuplicateKeys(t *testing.T) {
+	filesys := fs.MemFs()
+	// legacy compactions could write a key twice to the same table, and reads
+	// returned the first occurrence (key 0 makes some duplicates span two
+	// index entries)
+	updates := []legacyPut{{0, []byte("zero")}}
+	for k := uint64(1); k <= 12; k++ {
+		updates = append(updates, legacyPut{k, []byte("first")},
+			legacyPut{k, []byte("second")})
+	}
+	writeLegacyTable(t, filesys, 3, updates)
+	writeLegacyTable(t, filesys, 4, []legacyPut{{1, []byte("a")}, {1, []byte("b")}, {2, []byte("c")}})
+	writeLegacyDatabase(t, filesys, [][2]uint32{{1, 3}, {0, 4}}, nil)
+	expected := map[uint64]string{0: "zero", 1: "a", 2: "c"}
+	for k := uint64(3); k <= 12; k++ {
+		expected[k] = "first"
+	}
+	db, err := Open(filesys, nil)
+	require.NoError(t, err)
+	checkLegacyValues(t, db, expected)
+	require.NoError(t, db.Compact())
+	checkLegacyValues(t, db, expected)
+	require.NoError(t, db.Close())
+}
+
+func TestUpgradeInterrupted(t *testing.T) {
+	filesys, expected := newLegacyDb(t)
+	// an upgrade that wrote some files but not CURRENT
+	require.NoError(t, DefaultOptions().save(filesys))
+	createFile(t, filesys, identToName(6))
+	createFile(t, filesys, logName(9))
+	db, err := Open(filesys, nil)
+	require.NoError(t, err)
+	checkLegacyValues(t, db, expected)
+	require.NoError(t, db.Close())
+}
+
+func TestUpgradeReadOnly(t *testing.T) {
+	filesys, _ := newLegacyDb(t)
+	_, err := Open(filesys, &Options{ReadOnly: true})
+	assert.Error(t, err)
+	_, err = filesys.Open(legacyManifestName)
+	assert.NoError(t, err, "read-only open should not change the database")
+}
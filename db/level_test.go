@@ -0,0 +1,208 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/tchajed/specious-db/fs"
+)
+
+type LevelSuite struct {
+	*DbSuite
+}
+
+func TestLevelSuite(t *testing.T) {
+	suite.Run(t, LevelSuite{&DbSuite{opts: &Options{
+		WriteBufferSize:      1024,
+		MaxBytesForLevelBase: 4096,
+		LevelSizeMultiplier:  2,
+		TargetFileSize:       1024,
+	}}})
+}
+
+// overwrite puts every key in [1, n] several times, so that compactions merge
+// overlapping tables
+func (suite LevelSuite) overwrite(n int, rounds int) {
+	for round := 0; round < rounds; round++ {
+		for i := 1; i <= n; i++ {
+			suite.db.Put(i, fmt.Sprintf("round %d val %d", round, i))
+		}
+	}
+	suite.Require().NoError(suite.db.waitForCompactions())
+}
+
+// deepestLevel returns the deepest level with any tables
+func (suite LevelSuite) deepestLevel() int {
+	deepest := 0
+	for level, tables := range suite.db.mf.tables {
+		if len(tables) > 0 {
+			deepest = level
+		}
+	}
+	return deepest
+}
+
+func tableIdents(tables []Table) []uint32 {
+	var idents []uint32
+	for _, t := range tables {
+		idents = append(idents, t.ident)
+	}
+	return idents
+}
+
+// checkDisjoint checks that the tables at each level other than L0 are sorted
+// and do not overlap
+func (suite LevelSuite) checkDisjoint() {
+	for level, tables := range suite.db.mf.tables[1:] {
+		for i := 1; i < len(tables); i++ {
+			suite.Less(tables[i-1].Keys().Max.Compare(tables[i].Keys().Min), 0,
+				"tables %d and %d at L%d overlap", i-1, i, level+1)
+		}
+	}
+}
+
+func (suite LevelSuite) TestMaxBytesForLevel() {
+	opts := suite.db.opts
+	suite.Equal(4096.0, opts.maxBytesForLevel(1))
+	suite.Equal(8192.0, opts.maxBytesForLevel(2))
+	suite.Equal(4096.0*32, opts.maxBytesForLevel(6))
+}
+
+func (suite LevelSuite) TestDataMovesToDeeperLevels() {
+	suite.overwrite(300, 5)
+	suite.GreaterOrEqual(suite.deepestLevel(), 2,
+		"data should be compacted past L1")
+	for level := 1; level < numLevels-1; level++ {
+		suite.Less(suite.db.levelScore(level), 1.0,
+			"L%d should be under its target size", level)
+	}
+	suite.checkDisjoint()
+	for i := 1; i <= 300; i++ {
+		suite.check(i)
+	}
+	suite.crashRestart()
+	suite.checkDisjoint()
+	for i := 1; i <= 300; i++ {
+		suite.check(i)
+	}
+}
+
+func (suite LevelSuite) TestPickCompactionLevel() {
+	suite.overwrite(300, 5)
+	_, ok := suite.db.pickCompactionLevel()
+	suite.False(ok, "no level should need compaction")
+	db := suite.db.Database
+	db.l.Lock()
+	defer db.l.Unlock()
+	// shrink the targets so that every non-empty level is oversized
+	db.opts.MaxBytesForLevelBase = 1
+	defer func() { db.opts.MaxBytesForLevelBase = 4096 }()
+	level, ok := db.pickCompactionLevel()
+	suite.Require().True(ok)
+	for l := 0; l < numLevels-1; l++ {
+		suite.LessOrEqual(db.levelScore(l), db.levelScore(level),
+			"L%d should have the highest score", level)
+	}
+}
+
+func (suite LevelSuite) TestCompactToDeepestLevel() {
+	suite.overwrite(300, 5)
+	deepest := suite.deepestLevel()
+	suite.Require().NoError(suite.db.Compact())
+	for level, tables := range suite.db.mf.tables {
+		if level != deepest {
+			suite.Empty(tables, "L%d should be compacted", level)
+		}
+	}
+	suite.checkDisjoint()
+	for i := 1; i <= 300; i++ {
+		suite.check(i)
+	}
+}
+
+func (suite LevelSuite) TestSplitCompactionOutput() {
+	suite.putValues(1, 300)
+	// many versions of one key, which should not be split across tables
+	for i := 0; i < 100; i++ {
+		suite.db.Put(150, fmt.Sprintf("version %d", i))
+	}
+	suite.Require().NoError(suite.db.Compact())
+	tables := suite.db.mf.tables[suite.deepestLevel()]
+	suite.Greater(len(tables), 2, "compaction output should be split")
+	for _, t := range tables[:len(tables)-1] {
+		suite.GreaterOrEqual(t.Size(), uint64(1024))
+		// a table only goes over the target by the versions of its last key
+		suite.Less(t.Size(), uint64(4096))
+	}
+	suite.checkDisjoint()
+	for i := 1; i <= 300; i++ {
+		suite.check(i)
+	}
+	suite.crashRestart()
+	suite.Equal(tableIdents(tables),
+		tableIdents(suite.db.mf.tables[suite.deepestLevel()]))
+	for i := 1; i <= 300; i++ {
+		suite.check(i)
+	}
+}
+
+func (suite LevelSuite) TestSnapshotAcrossLevels() {
+	suite.putValues(1, 300)
+	snap := suite.db.Snapshot()
+	defer snap.Release()
+	suite.overwrite(300, 5)
+	suite.GreaterOrEqual(suite.deepestLevel(), 2)
+	for i := 1; i <= 300; i += 10 {
+		v, err := snap.Get(intKey(i))
+		suite.Require().NoError(err)
+		suite.Equal(SomeValue(Value(fmt.Sprintf("val %d", i))), v)
+	}
+}
+
+func TestYoungCompactionKeepsOtherTables(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	db := newStringStore(MustInit(fs.MemFs(), &Options{
+		WriteBufferSize: 1024,
+		TargetFileSize:  1024,
+	}))
+	for i := 1; i <= 300; i++ {
+		db.Put(i, fmt.Sprintf("val %d", i))
+	}
+	require.NoError(db.Compact())
+	require.Greater(len(db.mf.tables[1]), 2)
+	before := tableIdents(db.mf.tables[1])
+
+	// new keys past the end of L1 overlap none of its tables
+	for i := 1000; i <= 1010; i++ {
+		db.Put(i, fmt.Sprintf("val %d", i))
+	}
+	require.NoError(db.Compact())
+	assert.Subset(tableIdents(db.mf.tables[1]), before,
+		"non-overlapping L1 tables should be kept")
+	assert.Len(db.mf.tables[1], len(before)+1)
+
+	// an update to one key should only replace the table holding it
+	before = tableIdents(db.mf.tables[1])
+	var replaced uint32
+	for _, t := range db.mf.tables[1] {
+		if t.Keys().Contains(intKey(150)) {
+			replaced = t.ident
+		}
+	}
+	db.Put(150, "new val")
+	require.NoError(db.Compact())
+	after := tableIdents(db.mf.tables[1])
+	assert.NotContains(after, replaced)
+	for _, ident := range before {
+		if ident != replaced {
+			assert.Contains(after, ident)
+		}
+	}
+	for _, i := range []int{1, 150, 300, 1000, 1010} {
+		assert.Equal(db.Expected(i), db.Get(i))
+	}
+}
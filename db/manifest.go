@@ -5,21 +5,26 @@ package db
 // This includes an on-disk representation for crash safety as well as in-memory
 // cache to lookup keys by first finding the right tables to search.
 //
-// on-disk representation:
-//   numTables uint32
-//   tables [numTables]tableInfo
+// The on-disk representation is a log of changes to the manifest (see
+// manifest_log.go), which records:
+//   - the tables at each level (between 0 and numLevels-1)
+//   - the value logs
+//   - lastSeq, (at least) the largest sequence number in any table
+//   - logNumber: the updates in logs numbered below logNumber are all in
+//     tables, so recovery only replays the logs numbered logNumber and above
+//   - nextIdent, the next unused ident
 //
-// tableInfo:
-//   level uint8
-//   ident uint32
+// The manifest's format version identifies the format of the manifest, tables,
+// and log, so that a database written in an older format is rejected rather
+// than misread.
 //
-// We only support two levels, so the level is always either 0 or 1.
+// Tables and value logs are identified by their ident, which (like log and
+// manifest numbers) is allocated from a single counter.
 
 import (
-	"bytes"
 	"fmt"
-	"io/ioutil"
-	"path"
+	"sort"
+	"sync/atomic"
 
 	"github.com/tchajed/specious-db/fs"
 )
@@ -33,17 +38,51 @@ type Manifest struct {
 	fs        fs.Filesys
 	tables    [][]Table
 	nextIdent uint32
+	// the largest sequence number used by the database, saved with the
+	// manifest so it survives after the log is cleared
+	lastSeq uint64
+	// the number of the oldest log that has not been flushed to a table
+	logNumber uint32
+	// the value logs holding values the tables point to
+	vlogs valueLogs
+	// configuration for new tables
+	opts Options
+	// shared by all the tables
+	stats *ReadStats
+	cache *blockCache
+	// the manifest log changes are appended to (nil if read-only)
+	w *manifestWriter
 }
 
-func initManifest(fs fs.Filesys) Manifest {
-	f := fs.Create("manifest")
-	defer f.Close()
-	e := newEncoder(f)
-	e.Uint32(0)
-	return Manifest{fs, make([][]Table, 2), 1}
+// numLevels is the number of levels of tables (L0 to L6).
+//
+// L0 holds the young tables, which may overlap; each other level holds
+// disjoint tables.
+const numLevels = 7
+
+const (
+	manifestMagic uint32 = 0x5ec10db5
+	// formatVersion is the current on-disk format
+	//
+	// version 2 switched from integer keys to byte-string keys, version 3 to
+	// varint value lengths and 64-bit table handles, version 4 added value
+	// logs, version 5 numbered logs, version 6 added table filters, version
+	// 7 compressed blocks, version 8 added table checksums, and version 9
+	// made the manifest a log of edits
+	formatVersion uint32 = 9
+)
+
+// initManifest creates the manifest of a new database, whose first log is
+// numbered logNumber.
+func initManifest(fs fs.Filesys, opts Options, logNumber uint32) (Manifest, error) {
+	m := Manifest{fs, make([][]Table, numLevels), logNumber + 1, 0, logNumber, nil, opts,
+		new(ReadStats), newBlockCache(opts.blockCacheSize()), nil}
+	err := m.writeSnapshot()
+	return m, err
 }
 
-func (m Manifest) isKnownTable(name string) bool {
+// isKnownFile reports whether name is a table or value log in the manifest.
+func (m Manifest) isKnownFile(name string) bool {
 	for _, tables := range m.tables {
 		for _, t := range tables {
 			if name == t.Name() {
@@ -51,22 +90,57 @@ func (m Manifest) isKnownTable(name string) bool {
 			}
 		}
 	}
+	for _, l := range m.vlogs {
+		if name == l.Name() {
+			return true
+		}
+	}
 	return false
 }
 
-func (m Manifest) cleanup() {
-	for _, f := range m.fs.List() {
-		f = path.Base(f)
-		if f == "log" || f == "manifest" || m.isKnownTable(f) {
-			continue
+// cleanup deletes tables and value logs that are not in the manifest (for
+// example, a table that was being written when the database crashed), logs
+// that have been flushed to tables, old manifest logs, and the files of an
+// upgraded integer-key database.
+//
+// Other files are left alone.
+func (m Manifest) cleanup() error {
+	files, err := listFiles(m.fs)
+	if err != nil {
+		return err
+	}
+	var obsolete []string
+	for _, f := range append(files[tableFile], files[valueLogFile]...) {
+		if !m.isKnownFile(f) {
+			obsolete = append(obsolete, f)
+		}
+	}
+	for _, f := range files[logFile] {
+		if n, _ := parseLogName(f); n < m.logNumber {
+			obsolete = append(obsolete, f)
+		}
+	}
+	for _, f := range files[manifestFile] {
+		if f != manifestName(m.w.number) {
+			obsolete = append(obsolete, f)
 		}
+	}
+	// left by an upgrade of an integer-key database
+	obsolete = append(obsolete, files[legacyManifestFile]...)
+	obsolete = append(obsolete, files[legacyLogFile]...)
+	for _, f := range obsolete {
 		fmt.Println("deleting obsolete file", f)
-		m.fs.Delete(f)
+		err = m.fs.Delete(f)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-// Get reads a key from the tables managed by the manifest file.
-func (m Manifest) Get(k Key) MaybeValue {
+// Get reads a key from the tables managed by the manifest file, as of sequence
+// number seq.
+func (m Manifest) Get(k Key, seq uint64) (MaybeValue, error) {
 	// NOTE: need to traverse in reverse _chronological_ order so later updates
 	// overwrite earlier ones
 	//
@@ -76,144 +150,516 @@ func (m Manifest) Get(k Key) MaybeValue {
 			if !tables[i].Keys().Contains(k) {
 				continue
 			}
-			mu := tables[i].Get(k)
-			if mu.Valid {
-				return mu.MaybeValue
+			u, ok, err := tables[i].find(k, seq)
+			if err != nil {
+				return NoValue, err
+			}
+			if ok {
+				u, err = m.vlogs.Resolve(u)
+				if err != nil {
+					return NoValue, err
+				}
+				return u.MaybeValue, nil
+			}
+		}
+	}
+	return NoValue, nil
+}
+
+// UpdatesIn returns iterators over the updates in range r from every table that
+// overlaps it, ordered from newest to oldest.
+//
+// The iterators read the table files lazily, so callers that use them after
+// the manifest might change should hold a reference to the files (see
+// Acquire).
+func (m Manifest) UpdatesIn(r KeyRange) []UpdateIterator {
+	var its []UpdateIterator
+	for _, tables := range m.tables {
+		for i := len(tables) - 1; i >= 0; i-- {
+			if !tables[i].Keys().Overlaps(r) {
+				continue
 			}
+			its = append(its, tables[i].UpdatesIn(r))
 		}
 	}
-	return NoValue
+	return its
+}
+
+// Acquire adds a reference to the files of the manifest's tables and value
+// logs, so they stay open until the returned function releases them.
+func (m Manifest) Acquire() (release func()) {
+	levels := append([][]Table(nil), m.tables...)
+	vlogs := m.vlogs
+	acquireTables(levels, vlogs)
+	return func() { releaseTables(levels, vlogs) }
 }
 
-func recoverManifest(fs fs.Filesys) Manifest {
-	f := fs.Open("manifest")
-	data, err := ioutil.ReadAll(f)
+func recoverManifest(fs fs.Filesys, opts Options) (Manifest, error) {
+	number, err := readCurrent(fs)
+	if err != nil {
+		return Manifest{}, err
+	}
+	v, err := readManifestLog(fs, number)
 	if err != nil {
-		panic(err)
-	}
-	f.Close()
-	dec := newDecoder(data)
-	numTables := dec.Uint32()
-	tables := make([][]Table, 2)
-	maxIdent := uint32(1)
-	for i := 0; i < int(numTables); i++ {
-		if dec.RemainingBytes() == 0 {
-			panic(fmt.Errorf("manifest with %d entries is cut off", numTables))
-		}
-		level := dec.Uint8()
-		if int(level) >= len(tables) {
-			panic(fmt.Errorf("invalid level %d", level))
-		}
-		ident := dec.Uint32()
+		return Manifest{}, err
+	}
+	tables := make([][]Table, numLevels)
+	stats := new(ReadStats)
+	cache := newBlockCache(opts.blockCacheSize())
+	maxIdent := number
+	if v.logNumber > maxIdent {
+		maxIdent = v.logNumber
+	}
+	for level, idents := range v.levels {
+		for _, ident := range idents {
+			if ident > maxIdent {
+				maxIdent = ident
+			}
+			t, err := OpenTable(ident, fs)
+			if err != nil {
+				return Manifest{}, err
+			}
+			t.stats = stats
+			t.cache = cache
+			tables[level] = append(tables[level], t)
+		}
+	}
+	var vlogs valueLogs
+	for _, ident := range v.vlogs {
 		if ident > maxIdent {
 			maxIdent = ident
 		}
-		tables[level] = append(tables[level], OpenTable(ident, fs))
+		l, err := openValueLog(ident, fs)
+		if err != nil {
+			return Manifest{}, err
+		}
+		vlogs = append(vlogs, l)
+	}
+	for _, level := range tables[1:] {
+		sortByKeys(level)
 	}
-	if dec.RemainingBytes() > 0 {
-		panic(fmt.Errorf("manifest has %d leftover bytes", dec.RemainingBytes()))
+	nextIdent := maxIdent + 1
+	if v.nextIdent > nextIdent {
+		nextIdent = v.nextIdent
 	}
+	m := Manifest{fs, tables, nextIdent, v.lastSeq, v.logNumber, vlogs, opts, stats, cache, nil}
+	if !opts.ReadOnly {
+		// the manifest log cannot be appended to, so continue with a new one
+		// (which also drops a torn final edit)
+		if err := m.writeSnapshot(); err != nil {
+			return Manifest{}, err
+		}
+		if err := fs.Delete(manifestName(number)); err != nil {
+			return Manifest{}, err
+		}
+		if err := m.cleanup(); err != nil {
+			return Manifest{}, err
+		}
+	}
+	return m, nil
+}
+
+// A sharedFile is the file of a table or value log, which the manifest and
+// iterators over the database read. The file is closed once all of them have
+// released it, so it stays open for iterators after its table is replaced.
+type sharedFile struct {
+	fs.ReadFile
+	refs int32
+}
 
-	m := Manifest{fs, tables, maxIdent + 1}
-	m.cleanup()
-	return m
+func newSharedFile(f fs.ReadFile) *sharedFile {
+	return &sharedFile{ReadFile: f, refs: 1}
+}
+
+// Acquire adds a reference to the file.
+func (f *sharedFile) Acquire() {
+	atomic.AddInt32(&f.refs, 1)
+}
+
+// Release drops a reference to the file, closing it if that was the last one.
+func (f *sharedFile) Release() {
+	if atomic.AddInt32(&f.refs, -1) == 0 {
+		f.ReadFile.Close()
+	}
+}
+
+// acquireTables adds a reference to the files of tables and value logs.
+func acquireTables(levels [][]Table, vlogs valueLogs) {
+	for _, tables := range levels {
+		for _, t := range tables {
+			t.f.Acquire()
+		}
+	}
+	for _, l := range vlogs {
+		l.f.Acquire()
+	}
+}
+
+// releaseTables drops a reference to the files of tables and value logs.
+func releaseTables(levels [][]Table, vlogs valueLogs) {
+	for _, tables := range levels {
+		for _, t := range tables {
+			t.f.Release()
+		}
+	}
+	for _, l := range vlogs {
+		l.f.Release()
+	}
 }
 
 type tableCreator struct {
 	// think of the tableCreator as being a set of methods on a manifest, keyed
 	// by a (new, uninstalled) table ident
-	fs             fs.Filesys
-	ident          uint32
-	w              *tableWriter
+	fs    fs.Filesys
+	ident uint32
+	w     *tableWriter
+	stats *ReadStats
+	cache *blockCache
+	// the size of the value log's write buffer
+	bufSize int
+	// values at least this large are moved to a value log (if non-zero)
+	valueThreshold int
+	vlogIdent      uint32
+	// created once there is a value to separate
+	vlogWriter *valueLogWriter
+	// the finished value log, once the table is closed
+	vlog *valueLog
+	// the value log bytes the table points to
+	refs valueRefs
+	// the first error creating the value log
+	err error
 }
 
-// CreateTable initializes a new table writer
+// CreateTable initializes a new table writer, for a table to be installed at
+// level.
 //
 // This operation requires write permissions (for silly reasons - it only
 // protects the identifier counter)
-func (m *Manifest) CreateTable() tableCreator {
+func (m *Manifest) CreateTable(level int) (*tableCreator, error) {
 	id := m.nextIdent
 	m.nextIdent++
-	f := m.fs.Create(identToName(id))
-	return tableCreator{m.fs, id, newTableWriter(f)}
+	f, err := m.fs.Create(identToName(id))
+	if err != nil {
+		return nil, err
+	}
+	return &tableCreator{fs: m.fs, ident: id, w: newTableWriter(f, m.opts, level),
+		stats: m.stats, cache: m.cache, refs: make(valueRefs)}, nil
+}
+
+// CreateTableSeparating initializes a new L0 table writer that moves values
+// of at least valueThreshold bytes to a new value log (if valueThreshold is
+// positive).
+func (m *Manifest) CreateTableSeparating(valueThreshold int) (*tableCreator, error) {
+	c, err := m.CreateTable(0)
+	if err != nil || valueThreshold <= 0 {
+		return c, err
+	}
+	c.valueThreshold = valueThreshold
+	c.bufSize = m.opts.WriteBufferIOSize
+	c.vlogIdent = m.nextIdent
+	m.nextIdent++
+	return c, nil
 }
 
 // Put adds to an in-progress background table.
 //
 // This operation is logically _read-only_ on the manifest's table, including
 // wrt crashes.
-func (c tableCreator) Put(e KeyUpdate) {
+//
+// Write errors are deferred until the table is closed.
+func (c *tableCreator) Put(e KeyUpdate) {
+	if c.valueThreshold > 0 && e.IsPut() && !e.ptr.IsValid() &&
+		len(e.Value) >= c.valueThreshold && c.err == nil {
+		if c.vlogWriter == nil {
+			f, err := c.fs.Create(vlogName(c.vlogIdent))
+			if err != nil {
+				c.err = err
+				return
+			}
+			c.vlogWriter = newValueLogWriter(c.vlogIdent, f, c.bufSize)
+		}
+		e.ptr = c.vlogWriter.Add(e)
+		e.Value = nil
+	}
+	if e.ptr.IsValid() {
+		c.refs[e.ptr.vlog] += e.ptr.length
+	}
 	c.w.Put(e)
 }
 
+// ValueLog returns the value log the table's large values were moved to, or
+// nil if there were none.
+//
+// Only valid after a successful Close.
+func (c *tableCreator) ValueLog() *valueLog {
+	return c.vlog
+}
+
+// Size estimates the size of the table so far.
+func (c *tableCreator) Size() uint64 {
+	return c.w.Size()
+}
+
+// Abort stops writing a table (for example, due to an error reading its
+// updates) and deletes it.
+func (c *tableCreator) Abort() {
+	if c.vlogWriter != nil {
+		c.vlogWriter.Close()
+		c.fs.Delete(vlogName(c.vlogIdent))
+	}
+	c.w.f.Close()
+	c.fs.Delete(identToName(c.ident))
+}
+
 // Close finishes writing out a background table.
 //
 // This operation is logically _read-only_.
-func (c tableCreator) Close() Table {
-	entries := c.w.Close()
-	f := c.fs.Open(identToName(c.ident))
-	newTable := NewTable(c.ident, f, entries)
-	return newTable
+func (c *tableCreator) Close() (Table, error) {
+	if c.err == nil && c.vlogWriter != nil {
+		c.err = c.vlogWriter.Close()
+		c.vlogWriter = nil
+		if c.err != nil {
+			c.fs.Delete(vlogName(c.vlogIdent))
+		} else {
+			l, err := openValueLog(c.vlogIdent, c.fs)
+			c.vlog, c.err = &l, err
+		}
+	}
+	if c.err != nil {
+		c.Abort()
+		return Table{}, c.err
+	}
+	entries, filter, err := c.w.Close()
+	if err != nil {
+		// the table is incomplete and would otherwise be garbage collected
+		// by cleanup() on recovery
+		c.fs.Delete(identToName(c.ident))
+		if c.vlog != nil {
+			c.fs.Delete(vlogName(c.vlogIdent))
+		}
+		return Table{}, err
+	}
+	f, err := c.fs.Open(identToName(c.ident))
+	if err != nil {
+		return Table{}, err
+	}
+	size, err := f.Size()
+	if err != nil {
+		f.Close()
+		return Table{}, err
+	}
+	newTable := NewTable(c.ident, f, entries, filter, uint64(size))
+	newTable.stats = c.stats
+	newTable.cache = c.cache
+	*newTable.refs = c.refs
+	return newTable, nil
 }
 
-func subsumedTables(youngTables []uint32, level1tables []uint32) map[uint32]bool {
-	tablesSubsumed := make(map[uint32]bool, len(youngTables)+len(level1tables))
-	for _, ident := range youngTables {
+func subsumedTables(inputs []uint32, overlapping []uint32) map[uint32]bool {
+	tablesSubsumed := make(map[uint32]bool, len(inputs)+len(overlapping))
+	for _, ident := range inputs {
 		tablesSubsumed[ident] = true
 	}
-	for _, ident := range level1tables {
+	for _, ident := range overlapping {
 		tablesSubsumed[ident] = true
 	}
 	return tablesSubsumed
 }
 
+// sortByKeys orders the disjoint tables of a level other than L0 by key.
+func sortByKeys(tables []Table) {
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].Keys().Min.Compare(tables[j].Keys().Min) < 0
+	})
+}
+
+// levelSize is the total size of a level's tables.
+func levelSize(tables []Table) uint64 {
+	var size uint64
+	for _, t := range tables {
+		size += t.Size()
+	}
+	return size
+}
+
+// tablesRange gives the smallest range covering the keys in tables, which
+// must be non-empty.
+func tablesRange(tables []Table) KeyRange {
+	r := tables[0].Keys()
+	for _, t := range tables[1:] {
+		keys := t.Keys()
+		if keys.Min.Compare(r.Min) < 0 {
+			r.Min = keys.Min
+		}
+		if keys.Max.Compare(r.Max) > 0 {
+			r.Max = keys.Max
+		}
+	}
+	return r
+}
+
+// overlappingTables returns the tables that have keys in r.
+func overlappingTables(tables []Table, r KeyRange) []Table {
+	var overlapping []Table
+	for _, t := range tables {
+		if t.Keys().Overlaps(r) {
+			overlapping = append(overlapping, t)
+		}
+	}
+	return overlapping
+}
+
 // InstallTable adds a previously created table to the tracked tables in the manifest.
 //
 // Requires that the table already be stored in the right place (using
-// m.CreateTable() and its associated operations).
+// m.CreateTable() and its associated operations). If the table's values were
+// separated, vlog is its value log (and is otherwise nil). lastSeq should be
+// the largest sequence number used by the database so far, which is at least
+// as large as any in the new table.
+//
+// If logging the change fails, the manifest is unchanged.
 //
 // This operation requires write permissions to the manifest.
-func (m *Manifest) InstallTable(newTable Table, youngTables []uint32, level1tables []uint32, level int) {
-	tablesSubsumed := subsumedTables(youngTables, level1tables)
-	levels := make([][]Table, 2)
+func (m *Manifest) InstallTable(newTable Table, vlog *valueLog, inputs []uint32, overlapping []uint32, level int, lastSeq uint64) error {
+	return m.installTables([]Table{newTable}, vlog, inputs, overlapping, level, lastSeq, m.logNumber)
+}
+
+// InstallTables is like InstallTable, but adds several (disjoint) tables to
+// level in a single update to the manifest.
+func (m *Manifest) InstallTables(newTables []Table, inputs []uint32, overlapping []uint32, level int, lastSeq uint64) error {
+	return m.installTables(newTables, nil, inputs, overlapping, level, lastSeq, m.logNumber)
+}
+
+// InstallFlushedTable adds a table holding the updates from the logs numbered
+// below logNumber to L0, recording that those logs are no longer needed.
+func (m *Manifest) InstallFlushedTable(newTable Table, vlog *valueLog, lastSeq uint64, logNumber uint32) error {
+	return m.installTables([]Table{newTable}, vlog, nil, nil, 0, lastSeq, logNumber)
+}
+
+func (m *Manifest) installTables(newTables []Table, vlog *valueLog, inputs []uint32, overlapping []uint32, level int, lastSeq uint64, logNumber uint32) error {
+	tablesSubsumed := subsumedTables(inputs, overlapping)
+	var edit versionEdit
+	for ident := range tablesSubsumed {
+		edit.DeleteTable(ident)
+	}
+	for _, t := range newTables {
+		edit.AddTable(level, t.ident)
+	}
+	levels := make([][]Table, numLevels)
+	var subsumed []Table
 	for level, tables := range m.tables {
 		for _, t := range tables {
-			if !tablesSubsumed[t.ident] {
+			if tablesSubsumed[t.ident] {
+				subsumed = append(subsumed, t)
+			} else {
 				levels[level] = append(levels[level], t)
 			}
 		}
 	}
-	levels[level] = append(levels[level], newTable)
-	m.tables = levels
-	m.save()
-	for ident := range tablesSubsumed {
-		m.fs.Delete(identToName(ident))
+	levels[level] = append(levels[level], newTables...)
+	if level > 0 {
+		sortByKeys(levels[level])
 	}
-
+	newManifest := *m
+	newManifest.tables = levels
+	if vlog != nil {
+		newManifest.vlogs = append(append(valueLogs{}, m.vlogs...), *vlog)
+		edit.AddValueLog(vlog.ident)
+	}
+	if lastSeq > newManifest.lastSeq {
+		newManifest.lastSeq = lastSeq
+	}
+	newManifest.logNumber = logNumber
+	if err := m.logEdit(newManifest, edit); err != nil {
+		return err
+	}
+	for _, t := range subsumed {
+		m.cache.EvictTable(t.ident)
+		// the file is closed once iterators still reading it are done
+		t.f.Release()
+		// failing to delete a table only wastes space, and cleanup() will
+		// try again on recovery
+		m.fs.Delete(identToName(t.ident))
+	}
+	return nil
 }
 
-func (c tableCreator) CloseAndInstall(level int) {
+// MoveTable moves a table to the next level without rewriting it, which is
+// only correct if it does not overlap any table at the next level.
+//
+// If logging the change fails, the manifest is unchanged.
+func (m *Manifest) MoveTable(ident uint32, level int) error {
+	levels := make([][]Table, numLevels)
+	for l, tables := range m.tables {
+		for _, t := range tables {
+			if t.ident == ident && l == level {
+				levels[level+1] = append(levels[level+1], t)
+				continue
+			}
+			levels[l] = append(levels[l], t)
+		}
+	}
+	sortByKeys(levels[level+1])
+	newManifest := *m
+	newManifest.tables = levels
+	var edit versionEdit
+	edit.DeleteTable(ident)
+	edit.AddTable(level+1, ident)
+	return m.logEdit(newManifest, edit)
 }
 
-// Save writes out a representation of the manifest to disk (atomically).
-func (m *Manifest) save() {
-	var buf bytes.Buffer
-	enc := newEncoder(&buf)
-	numTables := 0
-	for _, tables := range m.tables {
-		numTables += len(tables)
-	}
-	enc.Uint32(uint32(numTables))
+// InstallValueLogRewrite replaces tables after garbage collecting value logs.
+//
+// Each table in replacements (keyed by ident) takes the place of the old table
+// at the same level and position. newLog (if not nil) is added and the value
+// logs in collected are removed.
+//
+// If logging the change fails, the manifest is unchanged.
+func (m *Manifest) InstallValueLogRewrite(replacements map[uint32]Table, newLog *valueLog, collected map[uint32]bool) error {
+	var edit versionEdit
+	levels := make([][]Table, len(m.tables))
+	var replaced []Table
 	for level, tables := range m.tables {
 		for _, t := range tables {
-			enc.Uint8(uint8(level))
-			enc.Uint32(t.ident)
+			if newTable, ok := replacements[t.ident]; ok {
+				edit.ReplaceTable(t.ident, newTable.ident)
+				replaced = append(replaced, t)
+				t = newTable
+			}
+			levels[level] = append(levels[level], t)
 		}
 	}
-	// NOTE: we use the file system's atomic rename to create the manifest, but
-	// could attempt to use the logging implementation
-	m.fs.AtomicCreateWith("manifest", buf.Bytes())
+	var vlogs, removed valueLogs
+	for _, l := range m.vlogs {
+		if !collected[l.ident] {
+			vlogs = append(vlogs, l)
+		} else {
+			edit.DeleteValueLog(l.ident)
+			removed = append(removed, l)
+		}
+	}
+	if newLog != nil {
+		vlogs = append(vlogs, *newLog)
+		edit.AddValueLog(newLog.ident)
+	}
+	newManifest := *m
+	newManifest.tables = levels
+	newManifest.vlogs = vlogs
+	if err := m.logEdit(newManifest, edit); err != nil {
+		return err
+	}
+	// as in InstallTable, the files are closed once iterators are done with
+	// them, and failing to delete files only wastes space
+	for _, t := range replaced {
+		m.cache.EvictTable(t.ident)
+		m.fs.Delete(identToName(t.ident))
+	}
+	for _, l := range removed {
+		m.fs.Delete(l.Name())
+	}
+	releaseTables([][]Table{replaced}, removed)
+	return nil
 }
 
-// TODO: implement streaming construction of multiple tables, splitting at some
-// file size
+func (c tableCreator) CloseAndInstall(level int) {
+}
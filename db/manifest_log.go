@@ -0,0 +1,431 @@
+package db
+
+// Manifest log
+//
+// The manifest is stored as a log of version edits (using the log package), so
+// each change to the set of tables appends a small edit rather than rewriting
+// the whole manifest.
+//
+// A manifest log is named MANIFEST-NNNNNN, and the CURRENT file holds the name
+// of the database's current manifest log. Each manifest log starts with a
+// snapshot of the whole manifest (an edit applied to an empty manifest), so
+// once CURRENT points to a new manifest log the older ones are obsolete. The
+// manifest is rewritten as a snapshot in a new manifest log whenever the
+// database is opened (the filesystem cannot append to an existing file) and
+// after every Options.ManifestSnapshotEdits edits.
+//
+// The log discards a record that was torn by a crash, so an edit that was
+// being logged during a crash is simply not applied on recovery; the files it
+// would have installed are deleted by cleanup() as unknown files.
+//
+// manifest log: (each item is a log transaction)
+//   header
+//   versionEdit*
+//
+// header:
+//   magic uint32
+//   version uint32
+//
+// versionEdit:
+//   lastSeq uint64
+//   logNumber uint32
+//   nextIdent uint32
+//   change*
+//
+// change: a tag followed by its fields
+//   editDeleteTable ident uint32
+//   editAddTable level uint8, ident uint32
+//   editReplaceTable old uint32, new uint32
+//   editAddValueLog ident uint32
+//   editDeleteValueLog ident uint32
+//
+// Added tables are appended to their level (so the young tables stay in
+// chronological order), while a replaced table keeps its position.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/tchajed/specious-db/fs"
+	"github.com/tchajed/specious-db/log"
+)
+
+const (
+	editDeleteTable uint8 = iota + 1
+	editAddTable
+	editReplaceTable
+	editAddValueLog
+	editDeleteValueLog
+)
+
+const currentFile = "CURRENT"
+
+func manifestName(number uint32) string {
+	return fmt.Sprintf("MANIFEST-%06d", number)
+}
+
+// parseManifestName gets the number of a manifest log from its filename.
+func parseManifestName(name string) (number uint32, ok bool) {
+	if !strings.HasPrefix(name, "MANIFEST-") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(name[len("MANIFEST-"):], 10, 32)
+	if err != nil || manifestName(uint32(n)) != name {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// A versionEdit is a change to the manifest.
+type versionEdit struct {
+	lastSeq   uint64
+	logNumber uint32
+	nextIdent uint32
+	changes   []editChange
+}
+
+type editChange struct {
+	tag   uint8
+	level int
+	ident uint32
+	// the table being replaced (for editReplaceTable)
+	old uint32
+}
+
+func (e *versionEdit) DeleteTable(ident uint32) {
+	e.changes = append(e.changes, editChange{tag: editDeleteTable, ident: ident})
+}
+
+func (e *versionEdit) AddTable(level int, ident uint32) {
+	e.changes = append(e.changes, editChange{tag: editAddTable, level: level, ident: ident})
+}
+
+func (e *versionEdit) ReplaceTable(old uint32, ident uint32) {
+	e.changes = append(e.changes, editChange{tag: editReplaceTable, ident: ident, old: old})
+}
+
+func (e *versionEdit) AddValueLog(ident uint32) {
+	e.changes = append(e.changes, editChange{tag: editAddValueLog, ident: ident})
+}
+
+func (e *versionEdit) DeleteValueLog(ident uint32) {
+	e.changes = append(e.changes, editChange{tag: editDeleteValueLog, ident: ident})
+}
+
+func (e versionEdit) encode() []byte {
+	var buf bytes.Buffer
+	enc := newEncoder(&buf)
+	enc.Uint64(e.lastSeq)
+	enc.Uint32(e.logNumber)
+	enc.Uint32(e.nextIdent)
+	for _, c := range e.changes {
+		enc.Uint8(c.tag)
+		switch c.tag {
+		case editAddTable:
+			enc.Uint8(uint8(c.level))
+		case editReplaceTable:
+			enc.Uint32(c.old)
+		}
+		enc.Uint32(c.ident)
+	}
+	return buf.Bytes()
+}
+
+func decodeVersionEdit(data []byte) (versionEdit, error) {
+	dec := newDecoder(data)
+	var e versionEdit
+	e.lastSeq = dec.Uint64()
+	e.logNumber = dec.Uint32()
+	e.nextIdent = dec.Uint32()
+	for dec.RemainingBytes() > 0 {
+		c := editChange{tag: dec.Uint8()}
+		switch c.tag {
+		case editDeleteTable, editAddValueLog, editDeleteValueLog:
+		case editAddTable:
+			c.level = int(dec.Uint8())
+		case editReplaceTable:
+			c.old = dec.Uint32()
+		default:
+			return versionEdit{}, fmt.Errorf("%w: invalid version edit tag %d",
+				ErrCorruption, c.tag)
+		}
+		c.ident = dec.Uint32()
+		e.changes = append(e.changes, c)
+	}
+	if err := dec.Err(); err != nil {
+		return versionEdit{}, fmt.Errorf("version edit: %w", err)
+	}
+	return e, nil
+}
+
+// A version is the contents of the manifest, identifying tables and value logs
+// by ident, which is built up by applying edits.
+type version struct {
+	levels    [numLevels][]uint32
+	vlogs     []uint32
+	lastSeq   uint64
+	logNumber uint32
+	nextIdent uint32
+}
+
+// findTable returns the level and index of table ident, or -1 if it is not in
+// the version.
+func (v *version) findTable(ident uint32) (level int, index int) {
+	for level, idents := range v.levels {
+		for i, id := range idents {
+			if id == ident {
+				return level, i
+			}
+		}
+	}
+	return -1, -1
+}
+
+func (v *version) apply(e versionEdit) error {
+	if e.lastSeq > v.lastSeq {
+		v.lastSeq = e.lastSeq
+	}
+	v.logNumber = e.logNumber
+	if e.nextIdent > v.nextIdent {
+		v.nextIdent = e.nextIdent
+	}
+	for _, c := range e.changes {
+		switch c.tag {
+		case editDeleteTable:
+			level, i := v.findTable(c.ident)
+			if level < 0 {
+				return fmt.Errorf("%w: deleting unknown table %d", ErrCorruption, c.ident)
+			}
+			v.levels[level] = append(v.levels[level][:i:i], v.levels[level][i+1:]...)
+		case editAddTable:
+			if c.level >= numLevels {
+				return fmt.Errorf("%w: invalid level %d in manifest", ErrCorruption, c.level)
+			}
+			v.levels[c.level] = append(v.levels[c.level], c.ident)
+		case editReplaceTable:
+			level, i := v.findTable(c.old)
+			if level < 0 {
+				return fmt.Errorf("%w: replacing unknown table %d", ErrCorruption, c.old)
+			}
+			v.levels[level][i] = c.ident
+		case editAddValueLog:
+			v.vlogs = append(v.vlogs, c.ident)
+		case editDeleteValueLog:
+			found := false
+			for i, ident := range v.vlogs {
+				if ident == c.ident {
+					v.vlogs = append(v.vlogs[:i:i], v.vlogs[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%w: deleting unknown value log %d", ErrCorruption, c.ident)
+			}
+		}
+	}
+	return nil
+}
+
+// manifestWriter appends edits to a manifest log.
+type manifestWriter struct {
+	number uint32
+	f      fs.File
+	log    log.Writer
+	// the number of edits logged after the snapshot
+	edits int
+	// broken is set if an edit could not be logged, after which the log may
+	// end with a partial edit and must not be appended to
+	broken bool
+}
+
+func encodeManifestHeader() []byte {
+	var buf bytes.Buffer
+	enc := newEncoder(&buf)
+	enc.Uint32(manifestMagic)
+	enc.Uint32(formatVersion)
+	return buf.Bytes()
+}
+
+// createManifestLog creates a manifest log starting with snapshot, and syncs
+// it.
+func createManifestLog(filesys fs.Filesys, number uint32, snapshot versionEdit) (*manifestWriter, error) {
+	f, err := filesys.Create(manifestName(number))
+	if err != nil {
+		return nil, err
+	}
+	w := &manifestWriter{number: number, f: f, log: log.New(f)}
+	err = w.log.Add(encodeManifestHeader())
+	if err == nil {
+		err = w.log.Add(snapshot.encode())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		filesys.Delete(manifestName(number))
+		return nil, err
+	}
+	return w, nil
+}
+
+// Append durably logs an edit.
+func (w *manifestWriter) Append(e versionEdit) error {
+	if err := w.log.Add(e.encode()); err != nil {
+		w.broken = true
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.broken = true
+		return err
+	}
+	w.edits++
+	return nil
+}
+
+func (w *manifestWriter) Close() error {
+	return w.log.Close()
+}
+
+// setCurrent makes manifest log number the database's manifest.
+func setCurrent(filesys fs.Filesys, number uint32) error {
+	return filesys.AtomicCreateWith(currentFile, []byte(manifestName(number)+"\n"))
+}
+
+// readCurrent returns the number of the database's manifest log.
+func readCurrent(filesys fs.Filesys) (uint32, error) {
+	f, err := filesys.Open(currentFile)
+	if err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	name := strings.TrimSuffix(string(data), "\n")
+	number, ok := parseManifestName(name)
+	if !ok {
+		return 0, fmt.Errorf("%w: CURRENT has invalid manifest name %q", ErrCorruption, name)
+	}
+	return number, nil
+}
+
+// readManifestLog replays a manifest log.
+func readManifestLog(filesys fs.Filesys, number uint32) (version, error) {
+	f, err := filesys.Open(manifestName(number))
+	if err != nil {
+		return version{}, err
+	}
+	recovered, err := log.Recover(f)
+	f.Close()
+	if err != nil {
+		return version{}, err
+	}
+	txns := recovered.Txns
+	if len(txns) < 2 {
+		return version{}, fmt.Errorf("%w: manifest has no snapshot", ErrCorruption)
+	}
+	dec := newDecoder(txns[0])
+	if dec.Uint32() != manifestMagic {
+		return version{}, fmt.Errorf("%w: manifest is from an unsupported format version",
+			ErrCorruption)
+	}
+	if v := dec.Uint32(); v != formatVersion || dec.Err() != nil {
+		return version{}, fmt.Errorf("%w: unsupported format version %d",
+			ErrCorruption, v)
+	}
+	var v version
+	for _, txn := range txns[1:] {
+		e, err := decodeVersionEdit(txn)
+		if err == nil {
+			err = v.apply(e)
+		}
+		if err != nil {
+			return version{}, fmt.Errorf("%s: %w", manifestName(number), err)
+		}
+	}
+	return v, nil
+}
+
+// snapshot returns an edit that creates m from an empty manifest.
+func (m Manifest) snapshot() versionEdit {
+	e := versionEdit{lastSeq: m.lastSeq, logNumber: m.logNumber, nextIdent: m.nextIdent}
+	for level, tables := range m.tables {
+		for _, t := range tables {
+			e.AddTable(level, t.ident)
+		}
+	}
+	for _, l := range m.vlogs {
+		e.AddValueLog(l.ident)
+	}
+	return e
+}
+
+// writeSnapshot writes m to a new manifest log, makes it current, and deletes
+// the old manifest log.
+func (m *Manifest) writeSnapshot() error {
+	number := m.nextIdent
+	m.nextIdent++
+	w, err := createManifestLog(m.fs, number, m.snapshot())
+	if err != nil {
+		return err
+	}
+	if err := setCurrent(m.fs, number); err != nil {
+		w.Close()
+		m.fs.Delete(manifestName(number))
+		return err
+	}
+	if old := m.w; old != nil {
+		old.Close()
+		// cleanup() will try again on recovery
+		m.fs.Delete(manifestName(old.number))
+	}
+	m.w = w
+	return nil
+}
+
+// logEdit durably records an edit that changes m into newManifest, and then
+// installs newManifest.
+//
+// If logging fails, m is unchanged.
+func (m *Manifest) logEdit(newManifest Manifest, e versionEdit) error {
+	if m.w.broken {
+		// start over with a new manifest log, which the edit is appended to
+		if err := m.writeSnapshot(); err != nil {
+			return err
+		}
+		newManifest.w = m.w
+		if m.nextIdent > newManifest.nextIdent {
+			newManifest.nextIdent = m.nextIdent
+		}
+	}
+	e.lastSeq = newManifest.lastSeq
+	e.logNumber = newManifest.logNumber
+	e.nextIdent = newManifest.nextIdent
+	if err := m.w.Append(e); err != nil {
+		return err
+	}
+	*m = newManifest
+	if m.w.edits >= m.opts.ManifestSnapshotEdits {
+		// the edit is already durable, so if the snapshot fails the current
+		// manifest log is kept and the snapshot is retried after the next edit
+		m.writeSnapshot()
+	}
+	return nil
+}
+
+// Close closes the manifest log and releases the files of the tables and value
+// logs.
+func (m Manifest) Close() error {
+	releaseTables(m.tables, m.vlogs)
+	if m.w == nil {
+		// a read-only manifest
+		return nil
+	}
+	return m.w.Close()
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tchajed/specious-db/fs"
+)
+
+func TestVersionEditEncoding(t *testing.T) {
+	e := versionEdit{lastSeq: 20, logNumber: 7, nextIdent: 12}
+	e.DeleteTable(3)
+	e.AddTable(1, 10)
+	e.ReplaceTable(4, 11)
+	e.AddValueLog(9)
+	e.DeleteValueLog(5)
+	decoded, err := decodeVersionEdit(e.encode())
+	require.NoError(t, err)
+	assert.Equal(t, e, decoded)
+
+	_, err = decodeVersionEdit(e.encode()[:10])
+	assert.True(t, errors.Is(err, ErrCorruption), "error %v should be corruption", err)
+}
+
+func TestVersionApply(t *testing.T) {
+	assert := assert.New(t)
+	var v version
+	var snapshot versionEdit
+	snapshot.AddTable(0, 1)
+	snapshot.AddTable(0, 2)
+	snapshot.AddTable(0, 3)
+	snapshot.AddValueLog(4)
+	require.NoError(t, v.apply(snapshot))
+
+	var e versionEdit
+	e.ReplaceTable(2, 5)
+	e.DeleteTable(3)
+	e.AddTable(1, 6)
+	e.DeleteValueLog(4)
+	require.NoError(t, v.apply(e))
+	assert.Equal([]uint32{1, 5}, v.levels[0], "replaced table should keep its position")
+	assert.Equal([]uint32{6}, v.levels[1])
+	assert.Empty(v.vlogs)
+
+	var bad versionEdit
+	bad.DeleteTable(3)
+	err := v.apply(bad)
+	assert.True(errors.Is(err, ErrCorruption), "error %v should be corruption", err)
+}
+
+func TestManifestSnapshots(t *testing.T) {
+	assert := assert.New(t)
+	filesys := fs.MemFs()
+	opts := &Options{ManifestSnapshotEdits: 3}
+	db := MustInit(filesys, opts)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put(intKey(i), []byte("val")))
+		require.NoError(t, db.compactLog())
+	}
+	manifest := onlyFile(t, filesys, manifestFile)
+	assert.Equal(currentManifest(t, filesys), manifest)
+	assert.Less(db.mf.w.edits, 3)
+	require.NoError(t, db.Close())
+
+	db, err := Open(filesys, opts)
+	require.NoError(t, err)
+	assert.NotEqual(manifest, onlyFile(t, filesys, manifestFile),
+		"open should start a new manifest log")
+	for i := 0; i < 10; i++ {
+		v, err := db.Get(intKey(i))
+		assert.NoError(err)
+		assert.True(v.Present, "key %d should be present", i)
+	}
+	assert.NoError(db.Close())
+}
+
+func TestOpenTornManifestEdit(t *testing.T) {
+	filesys := newClosedDb(t)
+	manifest := currentManifest(t, filesys)
+	data := readFile(t, filesys, manifest)
+	// the start of a record, with a length and a checksum but only some of
+	// its data
+	data = append(data, 20, 0, 0, 0, 1, 2, 3, 4, 5)
+	overwriteFile(t, filesys, manifest, data)
+
+	db, err := Open(filesys, nil)
+	require.NoError(t, err)
+	v, err := db.Get(intKey(1))
+	assert.NoError(t, err)
+	assert.Equal(t, SomeValue([]byte("val 1")), v)
+	assert.NoError(t, db.Close())
+}
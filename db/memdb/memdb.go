@@ -1,6 +1,7 @@
 package memdb
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/tchajed/specious-db/db"
@@ -9,41 +10,97 @@ import (
 // Database is an in-memory, non-persistent database mainly for testing purposes.
 type Database struct {
 	l *sync.Mutex
-	m map[db.Key]db.Value
+	// keys are stored as strings, since slices cannot be map keys
+	m map[string]db.Value
 }
 
+// Operations on an in-memory database never fail, so all the errors returned
+// are nil.
+
 // Get looks up a key.
-func (s Database) Get(k db.Key) db.MaybeValue {
+func (s Database) Get(k db.Key) (db.MaybeValue, error) {
 	s.l.Lock()
 	defer s.l.Unlock()
-	val, ok := s.m[k]
+	val, ok := s.m[string(k)]
 	if !ok {
-		return db.NoValue
+		return db.NoValue, nil
 	}
-	return db.SomeValue(val)
+	return db.SomeValue(val), nil
 }
 
 // Put stores data in the database.
-func (s *Database) Put(k db.Key, v db.Value) {
+func (s *Database) Put(k db.Key, v db.Value) error {
 	s.l.Lock()
 	defer s.l.Unlock()
-	s.m[k] = v
+	s.m[string(k)] = v
+	return nil
 }
 
 // Delete deletes a key.
-func (s *Database) Delete(k db.Key) {
+func (s *Database) Delete(k db.Key) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	delete(s.m, string(k))
+	return nil
+}
+
+// Write applies a batch of updates atomically.
+func (s *Database) Write(b *db.WriteBatch) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for _, u := range b.Updates() {
+		if u.IsPut() {
+			s.m[string(u.Key)] = u.Value
+		} else {
+			delete(s.m, string(u.Key))
+		}
+	}
+	return nil
+}
+
+type entryIterator []db.Entry
+
+func (it entryIterator) HasNext() bool {
+	return len(it) > 0
+}
+
+func (it *entryIterator) Next() db.Entry {
+	e := (*it)[0]
+	*it = (*it)[1:]
+	return e
+}
+
+func (it entryIterator) Err() error {
+	return nil
+}
+
+// Scan iterates over the entries with keys in r, in key order.
+//
+// The entries are copied at the time of the call, so the iterator is not
+// affected by later writes.
+func (s Database) Scan(r db.KeyRange) db.Iterator {
 	s.l.Lock()
 	defer s.l.Unlock()
-	delete(s.m, k)
+	var entries []db.Entry
+	for k, v := range s.m {
+		if r.Contains(db.Key(k)) {
+			entries = append(entries, db.Entry{Key: db.Key(k), Value: v})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key.Compare(entries[j].Key) < 0
+	})
+	it := entryIterator(entries)
+	return &it
 }
 
 // Close does nothing
-func (s *Database) Close() {}
+func (s *Database) Close() error { return nil }
 
 // Compact does nothing. In-memory databases are always compact.
-func (s *Database) Compact() {}
+func (s *Database) Compact() error { return nil }
 
 // New creates an empty in-memory database.
 func New() *Database {
-	return &Database{l: new(sync.Mutex), m: make(map[db.Key]db.Value)}
+	return &Database{l: new(sync.Mutex), m: make(map[string]db.Value)}
 }
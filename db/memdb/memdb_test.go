@@ -9,10 +9,10 @@ import (
 
 const missing = "<missing>"
 
-type StringStore struct{ store db.Store }
+type StringStore struct{ store db.MustStore }
 
 func (s StringStore) Get(k int) string {
-	v := s.store.Get(db.Key(k))
+	v := s.store.Get(db.Uint64Key(uint64(k)))
 	if v.Present {
 		return string(v.Value)
 	}
@@ -20,15 +20,15 @@ func (s StringStore) Get(k int) string {
 }
 
 func (s StringStore) Put(k int, v string) {
-	s.store.Put(db.Key(k), []byte(v))
+	s.store.Put(db.Uint64Key(uint64(k)), []byte(v))
 }
 
 func (s StringStore) Delete(k int) {
-	s.store.Delete(db.Key(k))
+	s.store.Delete(db.Uint64Key(uint64(k)))
 }
 
 func newDb() StringStore {
-	return StringStore{New()}
+	return StringStore{db.MustStore{Store: New()}}
 }
 
 func TestPutGet(t *testing.T) {
@@ -44,7 +44,7 @@ func TestGet0(t *testing.T) {
 	s := newDb()
 	assert.Equal(missing, s.Get(0))
 	s.Put(0, "val")
-	assert.Equal("val", s.Get(0), "the empty key should be an ordinary key")
+	assert.Equal("val", s.Get(0), "the zero key should be an ordinary key")
 }
 
 func TestDelete(t *testing.T) {
@@ -65,3 +65,34 @@ func TestDoublePut(t *testing.T) {
 	s.Put(1, "val_1'")
 	assert.Equal("val_1'", s.Get(1), "later puts should overwrite earlier ones")
 }
+
+func TestScan(t *testing.T) {
+	assert := assert.New(t)
+	s := newDb()
+	s.Put(3, "val_3")
+	s.Put(1, "val_1")
+	s.Put(7, "val_7")
+	s.Put(5, "val_5")
+	s.Delete(5)
+	var keys []db.Key
+	it := s.store.Scan(db.KeyRange{Min: db.Uint64Key(1), Max: db.Uint64Key(6)})
+	for it.HasNext() {
+		keys = append(keys, it.Next().Key)
+	}
+	assert.Equal([]db.Key{db.Uint64Key(1), db.Uint64Key(3)}, keys, "scan should return keys in order")
+}
+
+func TestWriteBatch(t *testing.T) {
+	assert := assert.New(t)
+	s := newDb()
+	s.Put(1, "val_1")
+	b := db.NewWriteBatch()
+	b.Put(db.Uint64Key(2), []byte("val_2"))
+	b.Delete(db.Uint64Key(1))
+	b.Put(db.Uint64Key(3), []byte("val_3"))
+	b.Put(db.Uint64Key(3), []byte("val_3'"))
+	s.store.Write(b)
+	assert.Equal(missing, s.Get(1), "batch delete should apply")
+	assert.Equal("val_2", s.Get(2), "batch put should apply")
+	assert.Equal("val_3'", s.Get(3), "later updates in a batch should win")
+}
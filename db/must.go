@@ -0,0 +1,58 @@
+package db
+
+import "github.com/tchajed/specious-db/fs"
+
+// This file provides the original, panicking API of the database as a thin
+// wrapper around the error-returning API, for callers that have no way to
+// handle errors.
+
+// MustInit is like Init but panics on error.
+func MustInit(fs fs.Filesys, opts *Options) *Database {
+	db, err := Init(fs, opts)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// MustOpen is like Open but panics on error.
+func MustOpen(fs fs.Filesys, opts *Options) *Database {
+	db, err := Open(fs, opts)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// A MustStore wraps a Store and panics on any error.
+type MustStore struct {
+	Store
+}
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s MustStore) Get(k Key) MaybeValue {
+	v, err := s.Store.Get(k)
+	must(err)
+	return v
+}
+
+func (s MustStore) Put(k Key, v Value) {
+	must(s.Store.Put(k, v))
+}
+
+func (s MustStore) Delete(k Key) {
+	must(s.Store.Delete(k))
+}
+
+func (s MustStore) Write(b *WriteBatch) {
+	must(s.Store.Write(b))
+}
+
+func (s MustStore) Close() {
+	must(s.Store.Close())
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tchajed/specious-db/fs"
+)
+
+func createFile(t *testing.T, filesys fs.Filesys, fname string) {
+	f, err := filesys.Create(fname)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestOpenCreateIfMissing(t *testing.T) {
+	filesys := fs.MemFs()
+	db, err := Open(filesys, &Options{CreateIfMissing: true})
+	require.NoError(t, err)
+	require.NoError(t, db.Put(intKey(1), []byte("val 1")))
+	require.NoError(t, db.Close())
+	// opening again should recover the database rather than create a new one
+	db, err = Open(filesys, &Options{CreateIfMissing: true})
+	require.NoError(t, err)
+	v, err := db.Get(intKey(1))
+	require.NoError(t, err)
+	assert.Equal(t, SomeValue(Value("val 1")), v)
+}
+
+func TestOpenErrorIfExists(t *testing.T) {
+	filesys := newClosedDb(t)
+	_, err := Open(filesys, &Options{ErrorIfExists: true})
+	assert.True(t, errors.Is(err, ErrExists), "error %v should be exists", err)
+	db, err := Open(filesys, nil)
+	require.NoError(t, err)
+	v, err := db.Get(intKey(1))
+	require.NoError(t, err)
+	assert.Equal(t, SomeValue(Value("val 1")), v, "database should be unaffected")
+}
+
+func TestOpenNotDatabase(t *testing.T) {
+	filesys := fs.MemFs()
+	createFile(t, filesys, "important.txt")
+	_, err := Open(filesys, &Options{CreateIfMissing: true})
+	assert.True(t, errors.Is(err, ErrNotDatabase), "error %v should be not a database", err)
+	_, err = filesys.Open("important.txt")
+	assert.NoError(t, err, "unexpected file should not be deleted")
+}
+
+func TestOpenInterruptedCreate(t *testing.T) {
+	filesys := fs.MemFs()
+	// creation wrote the options and log but not the manifest
+	require.NoError(t, DefaultOptions().save(filesys))
+	createFile(t, filesys, logName(1))
+	_, err := Open(filesys, nil)
+	assert.True(t, errors.Is(err, fs.ErrNotFound), "error %v should be not found", err)
+	_, err = Open(filesys, &Options{CreateIfMissing: true, ErrorIfExists: true})
+	assert.NoError(t, err)
+}
+
+func TestOpenInterruptedCreateManifest(t *testing.T) {
+	filesys := fs.MemFs()
+	db := MustInit(filesys, nil)
+	require.NoError(t, db.lock.Unlock())
+	// creation wrote an empty manifest but not CURRENT
+	require.NoError(t, filesys.Delete(currentFile))
+	_, err := Open(filesys, &Options{CreateIfMissing: true, ErrorIfExists: true})
+	assert.NoError(t, err)
+}
+
+func TestOpenLogWithoutManifest(t *testing.T) {
+	filesys := fs.MemFs()
+	db := MustInit(filesys, nil)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put(intKey(i), []byte("val")))
+	}
+	require.NoError(t, db.lock.Unlock())
+	require.NoError(t, filesys.Delete(currentFile))
+	_, err := Open(filesys, &Options{CreateIfMissing: true})
+	assert.True(t, errors.Is(err, ErrCorruption), "error %v should be corruption", err)
+	f, err := filesys.Open(logName(1))
+	if assert.NoError(t, err, "the log should not be deleted") {
+		f.Close()
+	}
+}
+
+func TestOpenTablesWithoutManifest(t *testing.T) {
+	filesys := newClosedDb(t)
+	require.NoError(t, filesys.Delete(currentManifest(t, filesys)))
+	require.NoError(t, filesys.Delete(currentFile))
+	_, err := Open(filesys, &Options{CreateIfMissing: true})
+	assert.True(t, errors.Is(err, ErrCorruption), "error %v should be corruption", err)
+}
+
+func TestDestroy(t *testing.T) {
+	filesys := newClosedDb(t)
+	createFile(t, filesys, "important.txt")
+	require.NoError(t, Destroy(filesys))
+	files, err := filesys.List()
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "only the unrelated file should be left")
+	_, err = filesys.Open("important.txt")
+	assert.NoError(t, err)
+}
+
+func TestOpenInUse(t *testing.T) {
+	filesys := fs.MemFs()
+	db := MustInit(filesys, nil)
+	_, err := Open(filesys, nil)
+	assert.True(t, errors.Is(err, ErrInUse), "error %v should be in use", err)
+	assert.True(t, errors.Is(Destroy(filesys), ErrInUse), "open database should not be destroyed")
+	require.NoError(t, db.Close())
+	db, err = Open(filesys, nil)
+	require.NoError(t, err, "database should be available after close")
+	require.NoError(t, db.Close())
+}
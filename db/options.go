@@ -0,0 +1,289 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/tchajed/specious-db/fs"
+)
+
+// SyncPolicy controls when the database syncs the log to disk.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing the log to the operating system, so a
+	// machine crash can lose recent writes (but not corrupt the database).
+	SyncNever SyncPolicy = iota
+	// SyncAlways syncs the log after every write.
+	SyncAlways
+	// SyncPeriodic syncs the log every SyncInterval in the background, so a
+	// machine crash loses at most the writes from the last interval.
+	SyncPeriodic
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncNever:
+		return "never"
+	case SyncAlways:
+		return "always"
+	case SyncPeriodic:
+		return "periodic"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// Options configures a database.
+//
+// The zero value of each field selects its default, so a nil *Options or an
+// empty Options uses the default configuration.
+type Options struct {
+	// WriteBufferSize is how large (in bytes) the log grows before its
+	// updates are moved to a table. Defaults to 4MiB.
+	WriteBufferSize int
+	// L0CompactionTrigger is the number of young (level 0) tables that
+	// triggers a compaction into level 1. Defaults to 4.
+	L0CompactionTrigger int
+	// MaxBytesForLevelBase is the target size (in bytes) of level 1; a level
+	// that grows past its target is compacted into the next level. Defaults
+	// to 10MiB.
+	MaxBytesForLevelBase int
+	// LevelSizeMultiplier is how much larger each level's target size is than
+	// the previous level's. Defaults to 10.
+	LevelSizeMultiplier int
+	// TargetFileSize is the size (in bytes) at which a compaction starts a
+	// new output table (at the next key, so the tables can be slightly
+	// larger). Defaults to 2MiB.
+	TargetFileSize int
+	// IndexInterval is the number of keys in each table index entry; larger
+	// intervals make the index smaller but each read slower. Defaults to 10.
+	IndexInterval int
+	// IndexEntrySize is the size (in bytes) at which a table index entry is
+	// ended even if it has fewer than IndexInterval keys. Defaults to 64KiB.
+	IndexEntrySize int
+	// WriteBufferIOSize is the size of the buffer used to write tables and
+	// value logs. Defaults to 4MiB.
+	WriteBufferIOSize int
+	// ValueThreshold is the size (in bytes) at which values are stored in a
+	// value log rather than in tables. A negative threshold disables value
+	// separation. Defaults to 16KiB.
+	ValueThreshold int
+	// BloomBitsPerKey is the size of each table's Bloom filter, which lets
+	// reads skip tables that don't have a key; more bits make the filters
+	// larger but more accurate. A negative value disables the filters.
+	// Defaults to 10 (about 1% false positives).
+	BloomBitsPerKey int
+	// BlockCacheSize is the size (in bytes) of the cache of table data shared
+	// by all of the tables. A negative size disables the cache. Defaults to
+	// 8MiB.
+	BlockCacheSize int
+	// Compression is how tables compress their data. Defaults to
+	// NoCompression.
+	Compression CompressionType
+	// CompressionPerLevel overrides Compression for the first levels: level i
+	// uses CompressionPerLevel[i], and the levels past its end use its last
+	// element. For example, {NoCompression, NoCompression, FlateCompression}
+	// leaves the young tables and L1 uncompressed, since they are soon
+	// rewritten, and compresses the deeper levels.
+	CompressionPerLevel []CompressionType
+	// ManifestSnapshotEdits is the number of changes logged to the manifest
+	// (for example, installing a table) after which the manifest is rewritten
+	// as a snapshot in a new file, to keep it from growing without bound.
+	// Defaults to 1000.
+	ManifestSnapshotEdits int
+	// Sync is the policy for syncing the log. Defaults to SyncNever (individual
+	// writes can still be synced with WriteOptions).
+	Sync SyncPolicy
+	// SyncInterval is how often the log is synced with SyncPeriodic. Defaults
+	// to 100ms.
+	SyncInterval time.Duration
+
+	// CreateIfMissing makes Open create a new database if there is none.
+	CreateIfMissing bool
+	// ErrorIfExists makes Open fail with ErrExists if there already is a
+	// database.
+	ErrorIfExists bool
+	// ReadOnly opens the database without modifying any of its files: updates
+	// in the log are kept in memory rather than moved to a table, and writes
+	// and compactions fail with ErrReadOnly. A read-only database does not
+	// lock the directory.
+	ReadOnly bool
+}
+
+// DefaultOptions returns the default configuration.
+func DefaultOptions() Options {
+	return Options{
+		WriteBufferSize:       4 * 1024 * 1024,
+		L0CompactionTrigger:   4,
+		MaxBytesForLevelBase:  10 * 1024 * 1024,
+		LevelSizeMultiplier:   10,
+		TargetFileSize:        2 * 1024 * 1024,
+		IndexInterval:         10,
+		IndexEntrySize:        64 * 1024,
+		WriteBufferIOSize:     4 * 1024 * 1024,
+		ValueThreshold:        16 * 1024,
+		BloomBitsPerKey:       10,
+		BlockCacheSize:        8 * 1024 * 1024,
+		ManifestSnapshotEdits: 1000,
+		Sync:                  SyncNever,
+		SyncInterval:          100 * time.Millisecond,
+	}
+}
+
+// withDefaults returns a copy of opts with unset fields filled in from the
+// defaults.
+func (opts *Options) withDefaults() Options {
+	o := DefaultOptions()
+	if opts == nil {
+		return o
+	}
+	setDefault := func(field *int, def int) {
+		if *field == 0 {
+			*field = def
+		}
+	}
+	filled := *opts
+	setDefault(&filled.WriteBufferSize, o.WriteBufferSize)
+	setDefault(&filled.L0CompactionTrigger, o.L0CompactionTrigger)
+	setDefault(&filled.MaxBytesForLevelBase, o.MaxBytesForLevelBase)
+	setDefault(&filled.LevelSizeMultiplier, o.LevelSizeMultiplier)
+	setDefault(&filled.TargetFileSize, o.TargetFileSize)
+	setDefault(&filled.IndexInterval, o.IndexInterval)
+	setDefault(&filled.IndexEntrySize, o.IndexEntrySize)
+	setDefault(&filled.WriteBufferIOSize, o.WriteBufferIOSize)
+	setDefault(&filled.ValueThreshold, o.ValueThreshold)
+	setDefault(&filled.BloomBitsPerKey, o.BloomBitsPerKey)
+	setDefault(&filled.BlockCacheSize, o.BlockCacheSize)
+	setDefault(&filled.ManifestSnapshotEdits, o.ManifestSnapshotEdits)
+	if filled.SyncInterval == 0 {
+		filled.SyncInterval = o.SyncInterval
+	}
+	return filled
+}
+
+// validate checks that every setting is in range.
+func (opts Options) validate() error {
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"WriteBufferSize", opts.WriteBufferSize},
+		{"L0CompactionTrigger", opts.L0CompactionTrigger},
+		{"MaxBytesForLevelBase", opts.MaxBytesForLevelBase},
+		{"LevelSizeMultiplier", opts.LevelSizeMultiplier},
+		{"TargetFileSize", opts.TargetFileSize},
+		{"IndexInterval", opts.IndexInterval},
+		{"IndexEntrySize", opts.IndexEntrySize},
+		{"WriteBufferIOSize", opts.WriteBufferIOSize},
+		{"ManifestSnapshotEdits", opts.ManifestSnapshotEdits},
+	} {
+		if setting.value <= 0 {
+			return fmt.Errorf("%w: %s must be positive (got %d)",
+				ErrInvalidOptions, setting.name, setting.value)
+		}
+	}
+	switch opts.Sync {
+	case SyncNever, SyncAlways, SyncPeriodic:
+	default:
+		return fmt.Errorf("%w: unknown sync policy %v", ErrInvalidOptions, opts.Sync)
+	}
+	if opts.SyncInterval < 0 {
+		return fmt.Errorf("%w: SyncInterval must be positive (got %v)",
+			ErrInvalidOptions, opts.SyncInterval)
+	}
+	for _, c := range append([]CompressionType{opts.Compression}, opts.CompressionPerLevel...) {
+		if !c.isValid() {
+			return fmt.Errorf("%w: unknown compression type %v", ErrInvalidOptions, c)
+		}
+	}
+	if opts.ReadOnly && opts.CreateIfMissing {
+		return fmt.Errorf("%w: cannot create a read-only database", ErrInvalidOptions)
+	}
+	return nil
+}
+
+// maxBytesForLevel is the target size of a level (other than L0, which is
+// limited by its number of tables).
+func (opts Options) maxBytesForLevel(level int) float64 {
+	size := float64(opts.MaxBytesForLevelBase)
+	for l := 1; l < level; l++ {
+		size *= float64(opts.LevelSizeMultiplier)
+	}
+	return size
+}
+
+// valueThreshold is the threshold for value separation, or 0 if values should
+// not be separated.
+func (opts Options) valueThreshold() int {
+	if opts.ValueThreshold < 0 {
+		return 0
+	}
+	return opts.ValueThreshold
+}
+
+// bloomBitsPerKey is the size of table filters, or 0 if tables should not have
+// filters.
+func (opts Options) bloomBitsPerKey() int {
+	if opts.BloomBitsPerKey < 0 {
+		return 0
+	}
+	return opts.BloomBitsPerKey
+}
+
+// blockCacheSize is the capacity of the block cache, or 0 if there should not
+// be a cache.
+func (opts Options) blockCacheSize() int {
+	if opts.BlockCacheSize < 0 {
+		return 0
+	}
+	return opts.BlockCacheSize
+}
+
+// compressionForLevel is the compression used for tables at level.
+func (opts Options) compressionForLevel(level int) CompressionType {
+	if n := len(opts.CompressionPerLevel); n > 0 {
+		if level >= n {
+			level = n - 1
+		}
+		return opts.CompressionPerLevel[level]
+	}
+	return opts.Compression
+}
+
+// WriteOptions configures an individual write.
+type WriteOptions struct {
+	// Sync makes the write durable before it returns, by syncing the log
+	// (regardless of the database's sync policy).
+	Sync bool
+}
+
+const optionsFile = "OPTIONS"
+
+// save records the options in the database, in a human-readable format.
+func (opts Options) save(fs fs.Filesys) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# options this database was created with\n")
+	fmt.Fprintf(&buf, "format_version=%d\n", formatVersion)
+	fmt.Fprintf(&buf, "write_buffer_size=%d\n", opts.WriteBufferSize)
+	fmt.Fprintf(&buf, "l0_compaction_trigger=%d\n", opts.L0CompactionTrigger)
+	fmt.Fprintf(&buf, "max_bytes_for_level_base=%d\n", opts.MaxBytesForLevelBase)
+	fmt.Fprintf(&buf, "level_size_multiplier=%d\n", opts.LevelSizeMultiplier)
+	fmt.Fprintf(&buf, "target_file_size=%d\n", opts.TargetFileSize)
+	fmt.Fprintf(&buf, "index_interval=%d\n", opts.IndexInterval)
+	fmt.Fprintf(&buf, "index_entry_size=%d\n", opts.IndexEntrySize)
+	fmt.Fprintf(&buf, "write_buffer_io_size=%d\n", opts.WriteBufferIOSize)
+	fmt.Fprintf(&buf, "value_threshold=%d\n", opts.ValueThreshold)
+	fmt.Fprintf(&buf, "bloom_bits_per_key=%d\n", opts.BloomBitsPerKey)
+	fmt.Fprintf(&buf, "block_cache_size=%d\n", opts.BlockCacheSize)
+	fmt.Fprintf(&buf, "compression=%v\n", opts.Compression)
+	if len(opts.CompressionPerLevel) > 0 {
+		fmt.Fprintf(&buf, "compression_per_level=%v\n", opts.CompressionPerLevel)
+	}
+	fmt.Fprintf(&buf, "manifest_snapshot_edits=%d\n", opts.ManifestSnapshotEdits)
+	fmt.Fprintf(&buf, "sync=%v\n", opts.Sync)
+	if opts.Sync == SyncPeriodic {
+		fmt.Fprintf(&buf, "sync_interval=%v\n", opts.SyncInterval)
+	}
+	return fs.AtomicCreateWith(optionsFile, buf.Bytes())
+}
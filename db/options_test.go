@@ -0,0 +1,63 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tchajed/specious-db/fs"
+)
+
+func TestInvalidOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{WriteBufferSize: -1},
+		{L0CompactionTrigger: -4},
+		{MaxBytesForLevelBase: -1},
+		{LevelSizeMultiplier: -10},
+		{TargetFileSize: -1},
+		{IndexInterval: -1},
+		{ManifestSnapshotEdits: -1},
+		{Sync: SyncPolicy(100)},
+		{Sync: SyncPeriodic, SyncInterval: -time.Second},
+	} {
+		_, err := Init(fs.MemFs(), &opts)
+		assert.True(t, errors.Is(err, ErrInvalidOptions),
+			"options %+v should be invalid (got %v)", opts, err)
+	}
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	var opts *Options
+	assert.Equal(t, DefaultOptions(), opts.withDefaults())
+	assert.Equal(t, 100, (&Options{IndexInterval: 100}).withDefaults().IndexInterval)
+}
+
+func TestOptionsRecorded(t *testing.T) {
+	filesys := fs.MemFs()
+	db := MustInit(filesys, &Options{WriteBufferSize: 1024, Sync: SyncAlways})
+	require.NoError(t, db.Close())
+	f, err := filesys.Open(optionsFile)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Contains(t, string(data), "write_buffer_size=1024\n")
+	assert.Contains(t, string(data), "sync=always\n")
+	// the options file should survive cleanup on recovery
+	_, err = Open(filesys, nil)
+	require.NoError(t, err)
+	_, err = filesys.Open(optionsFile)
+	assert.NoError(t, err)
+}
+
+func TestIndexInterval(t *testing.T) {
+	db := newStringStore(MustInit(fs.MemFs(), &Options{IndexInterval: 1}))
+	for i := 0; i < 10; i++ {
+		db.Put(i, "val")
+	}
+	require.NoError(t, db.compactLog())
+	assert.Len(t, db.mf.tables[0][0].index.entries, 10)
+}
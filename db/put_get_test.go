@@ -1,7 +1,11 @@
 package db
 
-import "testing"
-import "github.com/stretchr/testify/suite"
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
 
 type PutGetSuite struct {
 	*DbSuite
@@ -55,3 +59,46 @@ func (suite PutGetSuite) TestPutOther() {
 	suite.check(1)
 	suite.check(2)
 }
+
+// checkReusedBuffers checks the keys "k00".."k49" written with values
+// "v00".."v49", both from reused buffers.
+func (suite PutGetSuite) checkReusedBuffers() {
+	it := suite.db.Scan(AllKeys)
+	n := 0
+	for it.HasNext() {
+		e := it.Next()
+		suite.Equal(fmt.Sprintf("k%02d", n), string(e.Key))
+		suite.Equal(fmt.Sprintf("v%02d", n), string(e.Value))
+		n++
+	}
+	suite.NoError(it.Err())
+	suite.Equal(50, n)
+}
+
+func (suite PutGetSuite) TestReusedBuffers() {
+	key := make(Key, 3)
+	val := make(Value, 3)
+	for i := 0; i < 50; i++ {
+		copy(key, fmt.Sprintf("k%02d", i))
+		copy(val, fmt.Sprintf("v%02d", i))
+		suite.Require().NoError(suite.db.Database.Put(key, val))
+	}
+	suite.checkReusedBuffers()
+	suite.Require().NoError(suite.db.Compact())
+	suite.checkReusedBuffers()
+}
+
+func (suite PutGetSuite) TestBatchReusedBuffers() {
+	key := make(Key, 3)
+	val := make(Value, 3)
+	b := NewWriteBatch()
+	for i := 0; i < 50; i++ {
+		copy(key, fmt.Sprintf("k%02d", i))
+		copy(val, fmt.Sprintf("v%02d", i))
+		b.Put(key, val)
+	}
+	suite.Require().NoError(suite.db.Write(b))
+	suite.checkReusedBuffers()
+	suite.Require().NoError(suite.db.Compact())
+	suite.checkReusedBuffers()
+}
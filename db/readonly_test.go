@@ -0,0 +1,108 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tchajed/specious-db/fs"
+)
+
+var errMutation = errors.New("file system is read-only")
+
+// readOnlyFs rejects all modifications to a file system
+type readOnlyFs struct {
+	fs.Filesys
+}
+
+func (readOnlyFs) Create(fname string) (fs.File, error) {
+	return nil, &fs.Error{Op: "create", Name: fname, Err: errMutation}
+}
+
+func (readOnlyFs) Delete(fname string) error {
+	return &fs.Error{Op: "delete", Name: fname, Err: errMutation}
+}
+
+func (readOnlyFs) Truncate(fname string) error {
+	return &fs.Error{Op: "truncate", Name: fname, Err: errMutation}
+}
+
+func (readOnlyFs) Rename(src, dst string) error {
+	return &fs.Error{Op: "rename", Name: src, Err: errMutation}
+}
+
+func (readOnlyFs) AtomicCreateWith(fname string, data []byte) error {
+	return &fs.Error{Op: "create", Name: fname, Err: errMutation}
+}
+
+func (readOnlyFs) Lock(fname string) (fs.Lock, error) {
+	return nil, &fs.Error{Op: "lock", Name: fname, Err: errMutation}
+}
+
+// fileContents reads every file in a file system
+func fileContents(t *testing.T, filesys fs.Filesys) map[string][]byte {
+	names, err := filesys.List()
+	require.NoError(t, err)
+	contents := make(map[string][]byte)
+	for _, name := range names {
+		f, err := filesys.Open(name)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		f.Close()
+		contents[name] = data
+	}
+	return contents
+}
+
+// newCrashedDb creates a database with updates in both a table and the log,
+// which recovery would normally move to a table
+func newCrashedDb(t *testing.T) fs.Filesys {
+	filesys := fs.MemFs()
+	db := newStringStore(MustInit(filesys, nil))
+	db.Put(1, "table")
+	db.Put(2, "table")
+	require.NoError(t, db.compactLog())
+	db.Put(2, "log")
+	db.Put(3, "log")
+	require.NoError(t, db.lock.Unlock())
+	return filesys
+}
+
+func TestReadOnly(t *testing.T) {
+	filesys := newCrashedDb(t)
+	before := fileContents(t, filesys)
+	db, err := Open(readOnlyFs{filesys}, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	for k, expected := range map[int]string{1: "table", 2: "log", 3: "log"} {
+		v, err := db.Get(intKey(k))
+		require.NoError(t, err)
+		assert.Equal(t, SomeValue(Value(expected)), v)
+	}
+	it := db.Scan(AllKeys)
+	n := 0
+	for it.HasNext() {
+		it.Next()
+		n++
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, 3, n)
+
+	assert.True(t, errors.Is(db.Put(intKey(4), []byte("val")), ErrReadOnly))
+	assert.True(t, errors.Is(db.Delete(intKey(1)), ErrReadOnly))
+	b := NewWriteBatch()
+	b.Put(intKey(4), []byte("val"))
+	assert.True(t, errors.Is(db.Write(b), ErrReadOnly))
+	assert.True(t, errors.Is(db.Compact(), ErrReadOnly))
+	assert.NoError(t, db.Close())
+	assert.Equal(t, before, fileContents(t, filesys), "files should not be modified")
+}
+
+func TestReadOnlyMissing(t *testing.T) {
+	_, err := Open(fs.MemFs(), &Options{ReadOnly: true})
+	assert.True(t, errors.Is(err, fs.ErrNotFound), "error %v should be not found", err)
+	_, err = Open(fs.MemFs(), &Options{ReadOnly: true, CreateIfMissing: true})
+	assert.True(t, errors.Is(err, ErrInvalidOptions), "error %v should be invalid options", err)
+}
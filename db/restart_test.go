@@ -1,6 +1,7 @@
 package db
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -58,14 +59,14 @@ func (suite RestartSuite) Restart() {
 	switch suite.restartType {
 	case noRestart:
 	case compactOnlyLog:
-		suite.db.compactLog()
+		suite.Require().NoError(suite.db.compactLog())
 	case compactAll:
-		suite.db.Compact()
+		suite.Require().NoError(suite.db.Compact())
 	case forceRestart:
-		suite.db.Database = Open(suite.fs)
+		suite.crashRestart()
 	case cleanRestart:
-		suite.db.Database.Close()
-		suite.db.Database = Open(suite.fs)
+		suite.Require().NoError(suite.db.Database.Close())
+		suite.db.Database = MustOpen(suite.fs, suite.opts)
 	}
 	// fs.Debug(suite.fs)
 }
@@ -124,3 +125,15 @@ func (suite RestartSuite) TestOutOfOrderWrites() {
 	suite.Restart()
 	suite.check(2, "out-of-order write")
 }
+
+func (suite RestartSuite) TestLargeValues() {
+	medium := strings.Repeat("m", 100*1024)
+	large := strings.Repeat("L", 1024*1024)
+	suite.db.Put(1, medium)
+	suite.db.Put(2, large)
+	suite.db.Put(3, "small")
+	suite.Restart()
+	suite.check(1)
+	suite.check(2)
+	suite.check(3)
+}
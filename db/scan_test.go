@@ -0,0 +1,119 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ScanSuite struct {
+	*DbSuite
+}
+
+func TestScanSuite(t *testing.T) {
+	suite.Run(t, ScanSuite{new(DbSuite)})
+}
+
+// checkScan compares a scan over [min, max] against the expected contents
+func (suite ScanSuite) checkScan(min, max int) {
+	var expected []string
+	var keys []int
+	for k := range suite.db.gold {
+		if min <= k && k <= max {
+			keys = append(keys, k)
+		}
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		expected = append(expected, fmt.Sprintf("%d: %s", k, suite.db.gold[k]))
+	}
+	var actual []string
+	it := suite.db.Scan(KeyRange{intKey(min), intKey(max)})
+	for it.HasNext() {
+		e := it.Next()
+		actual = append(actual, fmt.Sprintf("%d: %s", e.Key.Uint64(), e.Value))
+	}
+	suite.NoError(it.Err())
+	suite.Equal(expected, actual, "scan [%d, %d]", min, max)
+}
+
+func (suite ScanSuite) TestScanEmpty() {
+	suite.checkScan(0, 100)
+}
+
+func (suite ScanSuite) TestScanLog() {
+	suite.putValues(1, 20)
+	suite.db.Put(5, missing)
+	suite.checkScan(0, 100)
+	suite.checkScan(3, 7)
+}
+
+func (suite ScanSuite) TestScanTables() {
+	suite.putValues(1, 30)
+	suite.Require().NoError(suite.db.compactLog())
+	suite.db.Put(3, "new val 3")
+	suite.db.Put(4, missing)
+	suite.Require().NoError(suite.db.compactLog())
+	suite.db.Put(25, missing)
+	suite.db.Put(40, "val 40")
+	suite.checkScan(0, 100)
+	suite.checkScan(2, 26)
+	suite.checkScan(15, 15)
+	suite.checkScan(31, 39)
+}
+
+func (suite ScanSuite) TestScanLevels() {
+	suite.putValues(1, 50)
+	suite.Require().NoError(suite.db.compactLog())
+	suite.Require().NoError(suite.db.compactYoung())
+	suite.db.Put(10, missing)
+	suite.db.Put(12, "new val 12")
+	suite.Require().NoError(suite.db.compactLog())
+	suite.db.Put(12, missing)
+	suite.checkScan(0, 100)
+	suite.checkScan(11, 30)
+}
+
+func (suite ScanSuite) TestScanAllKeys() {
+	max := Key(bytes.Repeat([]byte{0xff}, 20))
+	suite.Require().NoError(suite.db.Database.Put(max, []byte("max")))
+	suite.Require().NoError(suite.db.Database.Put(Key{}, []byte("min")))
+	it := suite.db.Scan(AllKeys)
+	suite.Require().True(it.HasNext())
+	suite.Equal(Key{}, it.Next().Key)
+	suite.Require().True(it.HasNext())
+	suite.Equal(max, it.Next().Key)
+	suite.False(it.HasNext())
+}
+
+func (suite ScanSuite) TestScanUnbounded() {
+	suite.putValues(1, 10)
+	suite.Require().NoError(suite.db.compactLog())
+	it := suite.db.Scan(KeyRange{Min: intKey(8)})
+	var keys []uint64
+	for it.HasNext() {
+		keys = append(keys, it.Next().Key.Uint64())
+	}
+	suite.NoError(it.Err())
+	suite.Equal([]uint64{8, 9, 10}, keys)
+}
+
+func (suite ScanSuite) TestScanByteOrder() {
+	db := suite.db.Database
+	// bytewise order puts a key before any key it is a prefix of
+	for _, k := range []string{"b", "a", "ab", "", "abc", "b\x00"} {
+		suite.Require().NoError(db.Put(Key(k), []byte("val "+k)))
+	}
+	suite.Require().NoError(db.compactLog())
+	suite.Require().NoError(db.Put(Key("aa"), []byte("val aa")))
+	var keys []string
+	it := db.Scan(KeyRange{Min: Key("a"), Max: Key("b")})
+	for it.HasNext() {
+		keys = append(keys, string(it.Next().Key))
+	}
+	suite.NoError(it.Err())
+	suite.Equal([]string{"a", "aa", "ab", "abc", "b"}, keys)
+}
@@ -0,0 +1,88 @@
+package db
+
+// A Snapshot is a consistent, read-only view of the database at the time the
+// snapshot was taken.
+//
+// Reads from a snapshot do not see any later writes, even once those writes
+// have been compacted into tables. A snapshot should be released when it is no
+// longer needed, so the database can discard the old versions it retains.
+type Snapshot struct {
+	db  *Database
+	seq uint64
+}
+
+// snapshotList tracks the live snapshots.
+//
+// Snapshots are created with increasing sequence numbers, so the list is
+// always sorted by sequence number. Several snapshots can share a sequence
+// number, so they are removed by handle.
+type snapshotList struct {
+	snapshots []*Snapshot
+}
+
+func newSnapshotList() *snapshotList {
+	return &snapshotList{}
+}
+
+func (l *snapshotList) add(s *Snapshot) {
+	l.snapshots = append(l.snapshots, s)
+}
+
+// remove removes s from the list, if it is still there.
+func (l *snapshotList) remove(s *Snapshot) {
+	for i, s2 := range l.snapshots {
+		if s2 == s {
+			l.snapshots = append(l.snapshots[:i], l.snapshots[i+1:]...)
+			return
+		}
+	}
+}
+
+// Latest returns the sequence number of the newest live snapshot, or 0 if
+// there are none.
+func (l *snapshotList) Latest() uint64 {
+	if len(l.snapshots) == 0 {
+		return 0
+	}
+	return l.snapshots[len(l.snapshots)-1].seq
+}
+
+// Oldest returns the sequence number of the oldest live snapshot, or seq if
+// there are none (seq should be the database's current sequence number).
+func (l *snapshotList) Oldest(seq uint64) uint64 {
+	if len(l.snapshots) == 0 {
+		return seq
+	}
+	return l.snapshots[0].seq
+}
+
+// Snapshot creates a snapshot of the current state of the database.
+func (db *Database) Snapshot() *Snapshot {
+	db.l.Lock()
+	defer db.l.Unlock()
+	s := &Snapshot{db, db.seq}
+	db.snapshots.add(s)
+	return s
+}
+
+// Get reads a key as of the snapshot.
+func (s *Snapshot) Get(k Key) (MaybeValue, error) {
+	s.db.l.RLock()
+	defer s.db.l.RUnlock()
+	return s.db.get(k, s.seq)
+}
+
+// Scan iterates over the entries with keys in r as of the snapshot.
+func (s *Snapshot) Scan(r KeyRange) Iterator {
+	s.db.l.RLock()
+	defer s.db.l.RUnlock()
+	return s.db.scan(r, s.seq)
+}
+
+// Release frees the snapshot. The snapshot should not be used afterward.
+// Releasing a snapshot again has no effect.
+func (s *Snapshot) Release() {
+	s.db.l.Lock()
+	defer s.db.l.Unlock()
+	s.db.snapshots.remove(s)
+}
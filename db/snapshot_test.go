@@ -0,0 +1,151 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SnapshotSuite struct {
+	*DbSuite
+}
+
+func TestSnapshotSuite(t *testing.T) {
+	suite.Run(t, SnapshotSuite{new(DbSuite)})
+}
+
+func snapshotGet(s *Snapshot, k int) string {
+	v, err := s.Get(intKey(k))
+	must(err)
+	if v.Present {
+		return string(v.Value)
+	}
+	return missing
+}
+
+func snapshotScan(s *Snapshot) (vals []string) {
+	it := s.Scan(AllKeys)
+	for it.HasNext() {
+		vals = append(vals, string(it.Next().Value))
+	}
+	must(it.Err())
+	return
+}
+
+// checkSnapshot checks that s still has the contents it was created with
+func (suite SnapshotSuite) checkSnapshot(s *Snapshot) {
+	suite.Equal("old 1", snapshotGet(s, 1))
+	suite.Equal("val 2", snapshotGet(s, 2))
+	suite.Equal(missing, snapshotGet(s, 3))
+	suite.Equal([]string{"old 1", "val 2"}, snapshotScan(s))
+}
+
+func (suite SnapshotSuite) TestSnapshotGet() {
+	suite.db.Put(1, "old 1")
+	suite.db.Put(2, "val 2")
+	s := suite.db.Snapshot()
+	defer s.Release()
+	suite.db.Put(1, "new 1")
+	suite.db.Put(2, missing)
+	suite.db.Put(3, "val 3")
+	suite.checkSnapshot(s)
+	suite.check(1)
+	suite.check(2)
+	suite.check(3)
+}
+
+func (suite SnapshotSuite) TestSnapshotAcrossCompaction() {
+	suite.db.Put(1, "old 1")
+	suite.db.Put(2, "val 2")
+	suite.Require().NoError(suite.db.compactLog())
+	s := suite.db.Snapshot()
+	defer s.Release()
+	suite.db.Put(1, "new 1")
+	suite.db.Put(1, "newer 1")
+	suite.db.Put(2, missing)
+	suite.db.Put(3, "val 3")
+	suite.checkSnapshot(s)
+	suite.Require().NoError(suite.db.compactLog())
+	suite.checkSnapshot(s)
+	suite.Require().NoError(suite.db.compactYoung())
+	suite.checkSnapshot(s)
+	for k := 1; k <= 3; k++ {
+		suite.check(k)
+	}
+}
+
+func (suite SnapshotSuite) TestSnapshotInLog() {
+	suite.db.Put(1, "old 1")
+	suite.db.Put(2, "val 2")
+	s := suite.db.Snapshot()
+	suite.db.Put(1, "new 1")
+	suite.db.Put(1, "newer 1")
+	suite.db.Put(2, missing)
+	suite.db.Put(3, "val 3")
+	suite.checkSnapshot(s)
+	suite.Require().NoError(suite.db.compactLog())
+	suite.checkSnapshot(s)
+	s.Release()
+	suite.check(1)
+}
+
+func (suite SnapshotSuite) TestMultipleSnapshots() {
+	suite.db.Put(1, "v1")
+	s1 := suite.db.Snapshot()
+	suite.db.Put(1, "v2")
+	s2 := suite.db.Snapshot()
+	suite.db.Put(1, "v3")
+	suite.Require().NoError(suite.db.compactLog())
+	suite.Equal("v1", snapshotGet(s1, 1))
+	suite.Equal("v2", snapshotGet(s2, 1))
+	s1.Release()
+	suite.db.Put(1, missing)
+	suite.Equal("v2", snapshotGet(s2, 1))
+	s2.Release()
+	suite.check(1)
+}
+
+func (suite SnapshotSuite) TestReleaseTwice() {
+	suite.db.Put(1, "v1")
+	s1 := suite.db.Snapshot()
+	s2 := suite.db.Snapshot()
+	s1.Release()
+	s1.Release()
+	suite.db.Put(1, "v2")
+	suite.Require().NoError(suite.db.compactLog())
+	suite.Require().NoError(suite.db.compactYoung())
+	suite.Equal("v1", snapshotGet(s2, 1),
+		"releasing a snapshot twice should not release another snapshot")
+	s2.Release()
+	s2.Release()
+	suite.Equal(suite.db.seq, suite.db.snapshots.Oldest(suite.db.seq))
+	suite.check(1)
+}
+
+func (suite SnapshotSuite) TestLogDiscardsOldVersions() {
+	suite.db.Put(1, "v1")
+	suite.db.Put(1, "v2")
+	suite.Len(suite.db.log.cache.cache[string(intKey(1))], 1,
+		"log should not retain versions without snapshots")
+	s := suite.db.Snapshot()
+	suite.db.Put(1, "v3")
+	suite.db.Put(1, "v4")
+	suite.Len(suite.db.log.cache.cache[string(intKey(1))], 2,
+		"log should retain version visible to snapshot")
+	s.Release()
+}
+
+func (suite SnapshotSuite) TestSeqRecovered() {
+	suite.db.Put(1, "v1")
+	suite.db.Put(2, "v2")
+	suite.db.Put(1, "v3")
+	suite.Equal(uint64(3), suite.db.seq)
+	suite.crashRestart()
+	suite.Equal(uint64(3), suite.db.seq, "sequence number should be recovered from log")
+	suite.Require().NoError(suite.db.Close())
+	suite.db.Database = MustOpen(suite.fs, suite.opts)
+	suite.Equal(uint64(3), suite.db.seq, "sequence number should be recovered from manifest")
+	suite.db.Put(1, "v4")
+	suite.check(1)
+	suite.check(2)
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tchajed/specious-db/fs"
+)
+
+// syncCountingFs counts how many times the log is synced
+type syncCountingFs struct {
+	fs.Filesys
+	syncs *int64
+}
+
+func newSyncCountingFs() syncCountingFs {
+	return syncCountingFs{fs.MemFs(), new(int64)}
+}
+
+type syncCountingFile struct {
+	fs.File
+	syncs *int64
+}
+
+func (f syncCountingFile) Sync() error {
+	atomic.AddInt64(f.syncs, 1)
+	return f.File.Sync()
+}
+
+func (filesys syncCountingFs) Create(fname string) (fs.File, error) {
+	f, err := filesys.Filesys.Create(fname)
+	if err != nil || parseFileName(fname) != logFile {
+		return f, err
+	}
+	return syncCountingFile{f, filesys.syncs}, nil
+}
+
+func (filesys syncCountingFs) Syncs() int {
+	return int(atomic.LoadInt64(filesys.syncs))
+}
+
+func TestSyncNever(t *testing.T) {
+	filesys := newSyncCountingFs()
+	db := MustInit(filesys, nil)
+	require.NoError(t, db.Put(intKey(1), []byte("val")))
+	require.NoError(t, db.Delete(intKey(1)))
+	assert.Equal(t, 0, filesys.Syncs())
+	require.NoError(t, db.PutWith(intKey(1), []byte("val"), WriteOptions{Sync: true}))
+	assert.Equal(t, 1, filesys.Syncs(), "sync write should sync the log")
+	require.NoError(t, db.DeleteWith(intKey(1), WriteOptions{Sync: true}))
+	assert.Equal(t, 2, filesys.Syncs())
+	b := NewWriteBatch()
+	b.Put(intKey(2), []byte("val"))
+	require.NoError(t, db.WriteWith(b, WriteOptions{Sync: true}))
+	assert.Equal(t, 3, filesys.Syncs())
+	require.NoError(t, db.WriteWith(NewWriteBatch(), WriteOptions{Sync: true}))
+	assert.Equal(t, 3, filesys.Syncs(), "synced log should not be synced again")
+}
+
+func TestSyncAlways(t *testing.T) {
+	filesys := newSyncCountingFs()
+	db := MustInit(filesys, &Options{Sync: SyncAlways})
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, db.Put(intKey(i), []byte("val")))
+	}
+	assert.Equal(t, 3, filesys.Syncs())
+}
+
+func TestSyncPeriodic(t *testing.T) {
+	filesys := newSyncCountingFs()
+	db := MustInit(filesys, &Options{Sync: SyncPeriodic, SyncInterval: time.Millisecond})
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, filesys.Syncs(), "an unmodified log should not be synced")
+	require.NoError(t, db.Put(intKey(1), []byte("val")))
+	deadline := time.Now().Add(5 * time.Second)
+	for filesys.Syncs() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 1, filesys.Syncs(), "write should be synced in the background")
+	require.NoError(t, db.Close())
+}
+
+// unsyncedFs records the tables and value logs that are closed without being
+// synced
+type unsyncedFs struct {
+	fs.Filesys
+	m        *sync.Mutex
+	unsynced []string
+}
+
+type unsyncedFile struct {
+	fs.File
+	filesys *unsyncedFs
+	name    string
+	dirty   bool
+}
+
+func (f *unsyncedFile) Write(p []byte) (int, error) {
+	f.dirty = true
+	return f.File.Write(p)
+}
+
+func (f *unsyncedFile) Sync() error {
+	f.dirty = false
+	return f.File.Sync()
+}
+
+func (f *unsyncedFile) Close() error {
+	if f.dirty {
+		f.filesys.m.Lock()
+		f.filesys.unsynced = append(f.filesys.unsynced, f.name)
+		f.filesys.m.Unlock()
+	}
+	return f.File.Close()
+}
+
+func (filesys *unsyncedFs) Create(fname string) (fs.File, error) {
+	f, err := filesys.Filesys.Create(fname)
+	if err != nil {
+		return f, err
+	}
+	if ty := parseFileName(fname); ty != tableFile && ty != valueLogFile {
+		return f, nil
+	}
+	return &unsyncedFile{File: f, filesys: filesys, name: fname}, nil
+}
+
+func TestTablesSynced(t *testing.T) {
+	filesys := &unsyncedFs{Filesys: fs.MemFs(), m: new(sync.Mutex)}
+	db := MustInit(filesys, &Options{ValueThreshold: 10})
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put(intKey(i), []byte(strings.Repeat("x", i*2))))
+		require.NoError(t, db.compactLog())
+	}
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+	filesys.m.Lock()
+	defer filesys.m.Unlock()
+	assert.Empty(t, filesys.unsynced, "tables and value logs should be synced")
+}
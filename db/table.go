@@ -2,7 +2,9 @@ package db
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"sort"
 
 	"github.com/tchajed/specious-db/fs"
 )
@@ -13,23 +15,44 @@ import (
 // disk, with an efficient in-memory index to find keys on disk.
 //
 // table format:
-// entries: KeyUpdate*
-// index: IndexEntry*
-// index_ptr: FixedHandle
+// entries: checksummed(block)*
+// index: checksummed(IndexEntry*)
+// filter: checksummed(bloomFilter)
+// footer: checksummed(index_ptr: FixedHandle, filter_ptr: FixedHandle)
 //
-// We use FixedHandle rather than Handle for the final index ptr so that it can
-// be read with a fixed-offset read.
+// Each part is followed by a checksum (see checksum.go), which is included in
+// the handle pointing to it.
 //
-// The entries and index are not length-prefixed, since SliceHandles delimit
-// what ranges need to be parsed.
+// Entries are sorted by key and then by decreasing sequence number, so the
+// newest version of each key comes first. All the versions of a key are under
+// a single index entry, whose updates (KeyUpdate*) are stored as one
+// (possibly compressed) block (see compression.go).
+//
+// We use FixedHandle rather than Handle for the final pointers so that they
+// can be read with a fixed-offset read.
+//
+// The entries, index and filter are not length-prefixed, since SliceHandles
+// delimit what ranges need to be parsed. The filter is a Bloom filter over the
+// table's keys (see bloom.go); it is empty if the table was written without
+// one.
 
 // A Table is a handle to and index over a table, the basic immutable storage
 // unit of the database (the equivalent of an SSTable in LevelDB, which is the
 // SSTable of Bigtable).
 type Table struct {
 	ident uint32
-	f     fs.ReadFile
+	f     *sharedFile
 	index tableIndex
+	// filter is checked before reading the entries for a key
+	filter bloomFilter
+	// size of the table file in bytes
+	size uint64
+	// counts the reads the filter avoids (may be nil)
+	stats *ReadStats
+	// the cache shared by the database's tables (nil if there is none)
+	cache *blockCache
+	// the value log bytes the table points to, shared by copies of the table
+	refs *valueRefs
 }
 
 func identToName(ident uint32) string {
@@ -41,7 +64,9 @@ func (t Table) Name() string {
 	return identToName(t.ident)
 }
 
-const indexPtrOffset = 8 + 4
+// footerSize is the size of the index and filter pointers (and their
+// checksum) at the end of a table.
+const footerSize = 2*(8+8) + checksumSize
 
 // A SliceHandle represents a slice into a file.
 //
@@ -49,7 +74,7 @@ const indexPtrOffset = 8 + 4
 // notion of a variable-sized block.
 type SliceHandle struct {
 	Offset uint64
-	Length uint32
+	Length uint64
 }
 
 // IsValid reports whether a SliceHandle is valid, which requires that it
@@ -74,10 +99,10 @@ func binSearch(entries []indexEntry, k Key) int {
 		return -1
 	}
 	mid := len(entries) / 2
-	if k < entries[mid].Keys.Min {
+	if k.Compare(entries[mid].Keys.Min) < 0 {
 		lowerHalf := entries[:mid]
 		return binSearch(lowerHalf, k)
-	} else if k > entries[mid].Keys.Max {
+	} else if k.Compare(entries[mid].Keys.Max) > 0 {
 		upperHalf := entries[mid+1:]
 		upperHalfIndex := binSearch(upperHalf, k)
 		if upperHalfIndex == -1 {
@@ -110,28 +135,100 @@ func (i tableIndex) Keys() KeyRange {
 	return KeyRange{first.Min, last.Max}
 }
 
-func readIndexData(f fs.ReadFile) []byte {
-	indexPtrData := f.ReadAt(f.Size()-indexPtrOffset, indexPtrOffset)
-	h := newDecoder(indexPtrData).FixedHandle()
-	data := f.ReadAt(int(h.Offset), int(h.Length))
-	return data
+// readChecksummed reads the data at h and checks its checksum, returning the
+// data without the checksum.
+func readChecksummed(name string, f fs.ReadFile, h SliceHandle) ([]byte, error) {
+	b, err := f.ReadAt(int(h.Offset), int(h.Length))
+	if err != nil {
+		return nil, err
+	}
+	data, err := verifyChecksum(b)
+	if err != nil {
+		return nil, &CorruptionError{name, h.Offset, err}
+	}
+	return data, nil
+}
+
+// readFooter reads the pointers to a table's index and filter.
+func readFooter(name string, f fs.ReadFile) (index SliceHandle, filter SliceHandle, err error) {
+	size, err := f.Size()
+	if err != nil {
+		return SliceHandle{}, SliceHandle{}, err
+	}
+	if size < footerSize {
+		return SliceHandle{}, SliceHandle{}, &CorruptionError{name, 0,
+			fmt.Errorf("%w: table is too small (%d bytes)", ErrCorruption, size)}
+	}
+	dataSize := uint64(size - footerSize)
+	footer, err := readChecksummed(name, f, SliceHandle{dataSize, footerSize})
+	if err != nil {
+		return SliceHandle{}, SliceHandle{}, err
+	}
+	r := newDecoder(footer)
+	index = r.FixedHandle()
+	filter = r.FixedHandle()
+	for _, h := range []SliceHandle{index, filter} {
+		if h.Length > dataSize || h.Offset > dataSize-h.Length {
+			return SliceHandle{}, SliceHandle{}, &CorruptionError{name, dataSize,
+				fmt.Errorf("%w: handle %v is out of bounds", ErrCorruption, h)}
+		}
+	}
+	return index, filter, nil
 }
 
 // NewTable creates the in-memory structure representing a table
-func NewTable(ident uint32, f fs.ReadFile, entries []indexEntry) Table {
-	return Table{ident, f, newTableIndex(entries)}
+func NewTable(ident uint32, f fs.ReadFile, entries []indexEntry, filter bloomFilter, size uint64) Table {
+	return Table{ident: ident, f: newSharedFile(f), index: newTableIndex(entries), filter: filter,
+		size: size, refs: new(valueRefs)}
 }
 
 // OpenTable reads a table on-disk, initializing the in-memory cache.
-func OpenTable(ident uint32, fs fs.Filesys) Table {
-	f := fs.Open(identToName(ident))
-	indexData := readIndexData(f)
+func OpenTable(ident uint32, fs fs.Filesys) (Table, error) {
+	f, err := fs.Open(identToName(ident))
+	if err != nil {
+		return Table{}, err
+	}
+	size, err := f.Size()
+	if err != nil {
+		f.Close()
+		return Table{}, err
+	}
+	index, filter, err := readIndex(identToName(ident), f)
+	if err != nil {
+		f.Close()
+		return Table{}, err
+	}
+	return Table{ident: ident, f: newSharedFile(f), index: index, filter: filter, size: uint64(size),
+		refs: new(valueRefs)}, nil
+}
+
+// readIndex reads a table's index and filter (verifying their checksums).
+func readIndex(name string, f fs.ReadFile) (tableIndex, bloomFilter, error) {
+	indexHandle, filterHandle, err := readFooter(name, f)
+	if err != nil {
+		return tableIndex{}, nil, err
+	}
+	filter, err := readChecksummed(name, f, filterHandle)
+	if err != nil {
+		return tableIndex{}, nil, err
+	}
+	indexData, err := readChecksummed(name, f, indexHandle)
+	if err != nil {
+		return tableIndex{}, nil, err
+	}
 	var index tableIndex
 	r := newDecoder(indexData)
 	for r.RemainingBytes() > 0 {
 		index.entries = append(index.entries, r.IndexEntry())
 	}
-	return Table{ident, f, index}
+	if err := r.Err(); err != nil {
+		return tableIndex{}, nil, &CorruptionError{name, indexHandle.Offset, err}
+	}
+	if len(index.entries) == 0 {
+		return tableIndex{}, nil, &CorruptionError{name, indexHandle.Offset,
+			fmt.Errorf("%w: table has an empty index", ErrCorruption)}
+	}
+	return index, filter, nil
 }
 
 // MaybeMaybeValue is a poor man's option (option Value).
@@ -140,45 +237,107 @@ type MaybeMaybeValue struct {
 	MaybeValue
 }
 
-func (t Table) readIndexEntry(h SliceHandle) Decoder {
-	data := t.f.ReadAt(int(h.Offset), int(h.Length))
-	return newDecoder(data)
+// readIndexEntry reads the updates under an index entry, from the block cache
+// if possible. If fillCache is false, data read from the file is not added to
+// the cache (which is used to keep a compaction's reads from evicting data
+// that is more likely to be read again).
+func (t Table) readIndexEntry(h SliceHandle, fillCache bool) (Decoder, error) {
+	if data, ok := t.cache.Get(t.ident, h.Offset); ok {
+		t.stats.addCacheHit()
+		// decoded updates alias the data, so copy it to keep callers from
+		// modifying the cached data
+		return newDecoder(append([]byte(nil), data...)), nil
+	}
+	block, err := readChecksummed(t.Name(), t.f, h)
+	if err != nil {
+		return Decoder{}, err
+	}
+	data, err := decompressBlock(block)
+	if err != nil {
+		return Decoder{}, &CorruptionError{t.Name(), h.Offset, err}
+	}
+	if t.cache != nil {
+		t.stats.addCacheMiss()
+		if fillCache {
+			t.cache.Insert(t.ident, h.Offset, append([]byte(nil), data...))
+		}
+	}
+	return newDecoder(data), nil
 }
 
-// Get reads a key from the table.
-//
-// Since tables represent only part of the database, this Get returns a
-// MaybeMaybeValue to represent a key that is not part of the table, as opposed
-// to a key the table has a deletion marker for.
-func (t Table) Get(k Key) MaybeMaybeValue {
+// decodeError reports a decoding error from an index entry, with the table and
+// entry as context.
+func (t Table) decodeError(h SliceHandle, r Decoder) error {
+	if err := r.Err(); err != nil {
+		return &CorruptionError{t.Name(), h.Offset, err}
+	}
+	return nil
+}
+
+// find reads the newest update to k in the table with a sequence number no
+// larger than seq, reporting whether there is one.
+func (t Table) find(k Key, seq uint64) (KeyUpdate, bool, error) {
 	h := t.index.Get(k)
 	// if handle is not found in index, then key is not present in table
 	if !h.IsValid() {
-		return MaybeMaybeValue{Valid: false}
+		return KeyUpdate{}, false, nil
+	}
+	if !t.filter.MayContain(k) {
+		t.stats.addFilterAvoided()
+		return KeyUpdate{}, false, nil
+	}
+	r, err := t.readIndexEntry(h, true)
+	if err != nil {
+		return KeyUpdate{}, false, err
 	}
-	r := t.readIndexEntry(h)
 	for r.RemainingBytes() > 0 {
 		e := r.KeyUpdate()
-		if e.Key == k {
-			if e.IsPut() {
-				return MaybeMaybeValue{true, MaybeValue{Present: true, Value: e.Value}}
-			}
-			return MaybeMaybeValue{true, MaybeValue{Present: false}}
+		// versions are ordered newest first, so the first visible one is the
+		// right one
+		if r.Err() == nil && e.Key.Equal(k) && e.Seq <= seq {
+			return e, true, nil
 		}
 	}
+	if err := t.decodeError(h, r); err != nil {
+		return KeyUpdate{}, false, err
+	}
 	// key turned out to be missing
-	return MaybeMaybeValue{Valid: false}
+	return KeyUpdate{}, false, nil
+}
+
+// Get reads a key from the table, as of sequence number seq.
+//
+// Since tables represent only part of the database, this Get returns a
+// MaybeMaybeValue to represent a key that is not part of the table, as opposed
+// to a key the table has a deletion marker for.
+//
+// Get does not read values stored in value logs; the value of such a put is
+// nil.
+func (t Table) Get(k Key, seq uint64) (MaybeMaybeValue, error) {
+	e, ok, err := t.find(k, seq)
+	if err != nil || !ok {
+		return MaybeMaybeValue{Valid: false}, err
+	}
+	return MaybeMaybeValue{true, e.MaybeValue}, nil
 }
 
 type tableIterator struct {
 	t       Table
+	keys    KeyRange
 	updates []KeyUpdate
 	// index of next entry to read for more updates
 	nextEntry int
+	err       error
+	// whether to add the data read to the block cache
+	fillCache bool
 }
 
-func newIterator(t Table) *tableIterator {
-	return &tableIterator{t: t, updates: nil, nextEntry: 0}
+func newIterator(t Table, keys KeyRange, fillCache bool) *tableIterator {
+	// skip entries that are entirely below the range
+	start := sort.Search(len(t.index.entries), func(i int) bool {
+		return t.index.entries[i].Keys.Max.Compare(keys.Min) >= 0
+	})
+	return &tableIterator{t: t, keys: keys, updates: nil, nextEntry: start, fillCache: fillCache}
 }
 
 // fill re-fills the upcoming updates, if possible.
@@ -189,16 +348,44 @@ func (i *tableIterator) fill() {
 	if len(i.updates) != 0 {
 		panic("fill should only be called when no updates are buffered")
 	}
-	if i.nextEntry < len(i.t.index.entries) {
-		r := i.t.readIndexEntry(i.t.index.entries[i.nextEntry].Handle)
+	for len(i.updates) == 0 && i.nextEntry < len(i.t.index.entries) {
+		e := i.t.index.entries[i.nextEntry]
+		if !i.keys.belowMax(e.Keys.Min) {
+			// the remaining entries are all past the range
+			i.nextEntry = len(i.t.index.entries)
+			return
+		}
+		r, err := i.t.readIndexEntry(e.Handle, i.fillCache)
+		if err != nil {
+			i.fail(err)
+			return
+		}
 		i.nextEntry++
 		for r.RemainingBytes() > 0 {
-			i.updates = append(i.updates, r.KeyUpdate())
+			u := r.KeyUpdate()
+			if r.Err() == nil && i.keys.Contains(u.Key) {
+				i.updates = append(i.updates, u)
+			}
+		}
+		if err := i.t.decodeError(e.Handle, r); err != nil {
+			i.fail(err)
+			return
 		}
 	}
 	// could not fill, actually out of updates
 }
 
+// fail stops iteration due to an error
+func (i *tableIterator) fail(err error) {
+	i.err = err
+	i.updates = nil
+	i.nextEntry = len(i.t.index.entries)
+}
+
+func (i *tableIterator) Err() error {
+	return i.err
+}
+
 func (i *tableIterator) HasNext() bool {
 	if len(i.updates) > 0 {
 		return true
@@ -215,8 +402,21 @@ func (i *tableIterator) Next() KeyUpdate {
 }
 
 // Updates returns all the updates (puts an deletes) the table holds.
+//
+// This is used to copy the table (for example, in a compaction), so the data
+// read is not added to the block cache.
 func (t Table) Updates() UpdateIterator {
-	return newIterator(t)
+	return newIterator(t, AllKeys, false)
+}
+
+// UpdatesIn returns the updates the table holds for keys in r.
+func (t Table) UpdatesIn(r KeyRange) UpdateIterator {
+	return newIterator(t, r, true)
+}
+
+// Size returns the size of the table in bytes.
+func (t Table) Size() uint64 {
+	return t.size
 }
 
 // Keys gives the range of keys covered by this table.
@@ -229,15 +429,19 @@ type bufFile struct {
 	*bufio.Writer
 }
 
-func (f bufFile) Close() {
+// Close flushes and syncs the file before closing it, so that the file is
+// durable before it is installed in the manifest (after which the logs or
+// tables it replaces are deleted).
+func (f bufFile) Close() error {
 	err := f.Writer.Flush()
-	if err != nil {
-		panic(err)
+	if err == nil {
+		err = f.f.Sync()
 	}
-	err = f.f.Close()
 	if err != nil {
-		panic(err)
+		f.f.Close()
+		return err
 	}
+	return f.f.Close()
 }
 
 func newBufferedFile(f fs.File, size int) bufFile {
@@ -246,73 +450,136 @@ func newBufferedFile(f fs.File, size int) bufFile {
 }
 
 type tableWriter struct {
-	f            bufFile
-	w            Encoder
+	f bufFile
+	w Encoder
+	// the updates of the current index entry, which are compressed and
+	// written as a block once the entry is finished
+	block        *bytes.Buffer
+	blockW       Encoder
 	currentIndex *indexEntry
 	currentKeys  int
+	// the number of keys and size at which to start a new index entry (the
+	// size limit ensures that reading an entry for one key does not also read
+	// many large values)
+	keysPerEntry  int
+	maxEntryBytes uint64
+	compression   CompressionType
+	// the last update written, to check ordering
+	last *KeyUpdate
 	// cache of entries written, to initialize the in-memory table upon
 	// finishing
 	entries []indexEntry
+	// the size of the Bloom filter (0 for no filter) and the hashes of the
+	// keys to put in it
+	bitsPerKey int
+	keyHashes  []uint64
 }
 
-func newTableWriter(f fs.File) *tableWriter {
-	bw := newBufferedFile(f, 4*1024*1024)
+// newTableWriter creates a writer for a table at level (which determines how
+// it is compressed).
+func newTableWriter(f fs.File, opts Options, level int) *tableWriter {
+	bw := newBufferedFile(f, opts.WriteBufferIOSize)
+	block := new(bytes.Buffer)
 	return &tableWriter{
-		f: bw,
-		w: newEncoder(bw),
+		f:             bw,
+		w:             newEncoder(bw),
+		block:         block,
+		blockW:        newEncoder(block),
+		keysPerEntry:  opts.IndexInterval,
+		maxEntryBytes: uint64(opts.IndexEntrySize),
+		compression:   opts.compressionForLevel(level),
+		bitsPerKey:    opts.bloomBitsPerKey(),
 	}
 }
 
+// offset returns the number of bytes written to the file so far.
 func (w tableWriter) offset() uint64 {
 	return uint64(w.w.BytesWritten())
 }
 
+// Size estimates the size of the table so far, including the current entry
+// (before it is compressed).
+func (w tableWriter) Size() uint64 {
+	return w.offset() + w.currentBytes()
+}
+
 // Put adds an update to an in-progress table.
 //
-// Requires that updates be ordered by key.
+// Requires that updates be ordered by key and then from newest to oldest.
 func (w *tableWriter) Put(e KeyUpdate) {
-	start := w.offset()
-	w.w.KeyUpdate(e)
+	if w.last != nil && updateLess(e, *w.last) {
+		panic("out-of-order updates to table")
+	}
+	// periodic flush to create some index entries, but only between keys so
+	// that all versions of a key are in the same entry
+	if (w.currentKeys >= w.keysPerEntry || w.currentBytes() >= w.maxEntryBytes) &&
+		!e.Key.Equal(w.last.Key) {
+		w.flush()
+	}
+	w.blockW.KeyUpdate(e)
 	if w.currentIndex == nil {
 		// initialize an index entry
-		w.currentIndex = &indexEntry{
-			SliceHandle{Offset: start},
-			KeyRange{Min: e.Key},
-		}
-	}
-	if e.Key < w.currentIndex.Keys.Max {
-		panic("out-of-order updates to table")
+		w.currentIndex = &indexEntry{Keys: KeyRange{Min: e.Key}}
 	}
 	w.currentIndex.Keys.Max = e.Key
 	w.currentKeys++
-	// periodic flush to create some index entries
-	if w.currentKeys >= 10 {
-		w.flush()
+	if w.bitsPerKey > 0 && (w.last == nil || !e.Key.Equal(w.last.Key)) {
+		w.keyHashes = append(w.keyHashes, bloomHash(e.Key))
 	}
+	w.last = &e
 }
 
-// flush the current index entry
+// currentBytes returns the size of the current index entry so far
+func (w tableWriter) currentBytes() uint64 {
+	return uint64(w.block.Len())
+}
+
+// flush the current index entry, writing its block
 func (w *tableWriter) flush() {
 	if w.currentIndex != nil {
-		length := w.offset() - w.currentIndex.Handle.Offset
-		w.currentIndex.Handle.Length = uint32(length)
+		start := w.offset()
+		w.w.Bytes(appendChecksum(compressBlock(w.compression, w.block.Bytes())))
+		w.currentIndex.Handle = SliceHandle{start, w.offset() - start}
 		w.entries = append(w.entries, *w.currentIndex)
 		w.currentIndex = nil
 		w.currentKeys = 0
+		w.block.Reset()
 	}
 }
 
-func (w tableWriter) Close() []indexEntry {
+// Close finishes writing the table, returning its index and filter.
+//
+// Write errors from any of the updates are reported here.
+func (w *tableWriter) Close() ([]indexEntry, bloomFilter, error) {
 	w.flush()
 	if len(w.entries) == 0 {
 		panic("table has no values")
 	}
+	// the index and footer are encoded into the (now empty) block buffer to
+	// checksum them
 	indexStart := w.offset()
 	for _, e := range w.entries {
-		w.w.IndexEntry(e)
+		w.blockW.IndexEntry(e)
+	}
+	w.w.Bytes(appendChecksum(w.block.Bytes()))
+	indexHandle := SliceHandle{indexStart, w.offset() - indexStart}
+	var filter bloomFilter
+	if w.bitsPerKey > 0 {
+		filter = newBloomFilter(w.keyHashes, w.bitsPerKey)
+	}
+	filterStart := w.offset()
+	w.w.Bytes(appendChecksum(append([]byte(nil), filter...)))
+	filterHandle := SliceHandle{filterStart, w.offset() - filterStart}
+	w.block.Reset()
+	w.blockW.FixedHandle(indexHandle)
+	w.blockW.FixedHandle(filterHandle)
+	w.w.Bytes(appendChecksum(w.block.Bytes()))
+	if err := w.w.Err(); err != nil {
+		w.f.Close()
+		return nil, nil, err
+	}
+	if err := w.f.Close(); err != nil {
+		return nil, nil, err
 	}
-	indexHandle := SliceHandle{indexStart, uint32(w.offset() - indexStart)}
-	w.w.FixedHandle(indexHandle)
-	w.f.Close()
-	return w.entries
+	return w.entries, filter, nil
 }
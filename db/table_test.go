@@ -1,6 +1,8 @@
 package db
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -8,11 +10,11 @@ import (
 )
 
 func putU(k int, v string) KeyUpdate {
-	return KeyUpdate{Key(uint64(k)), SomeValue(Value(v))}
+	return KeyUpdate{Key: intKey(k), MaybeValue: SomeValue(Value(v))}
 }
 
 func deleteU(k int) KeyUpdate {
-	return KeyUpdate{Key(uint64(k)), NoValue}
+	return KeyUpdate{Key: intKey(k), MaybeValue: NoValue}
 }
 
 func someval(v string) MaybeMaybeValue {
@@ -40,8 +42,9 @@ func TestTable(t *testing.T) {
 
 func (suite *TableSuite) SetupTest() {
 	suite.fs = fs.MemFs()
-	f := suite.fs.Create(identToName(0))
-	suite.w = newTableWriter(f)
+	f, err := suite.fs.Create(identToName(0))
+	suite.Require().NoError(err)
+	suite.w = newTableWriter(f, DefaultOptions(), 0)
 }
 
 // DoneWriting creates the table and opens it up for reads (with some extra
@@ -49,19 +52,27 @@ func (suite *TableSuite) SetupTest() {
 //
 // Tables are immutable, so tests must finish creating the table, call DoneWriting
 func (suite *TableSuite) DoneWriting() {
-	entries := suite.w.Close()
-	t := OpenTable(0, suite.fs)
+	entries, _, err := suite.w.Close()
+	suite.Require().NoError(err)
+	t, err := OpenTable(0, suite.fs)
+	suite.Require().NoError(err)
 	suite.Table = &t
 	suite.Require().Equal(entries, t.index.entries)
 }
 
+func (suite *TableSuite) get(k int, seq uint64) MaybeMaybeValue {
+	mv, err := suite.Table.Get(intKey(k), seq)
+	suite.Require().NoError(err)
+	return mv
+}
+
 func (suite *TableSuite) TestTableGet() {
 	suite.w.Put(putU(1, "val 1"))
 	suite.w.Put(putU(2, "val 2"))
 	suite.DoneWriting()
-	suite.Equal(someval("val 1"), suite.Get(1))
-	suite.Equal(someval("val 2"), suite.Get(2))
-	suite.Equal(unknownval(), suite.Get(3))
+	suite.Equal(someval("val 1"), suite.get(1, latestSeq))
+	suite.Equal(someval("val 2"), suite.get(2, latestSeq))
+	suite.Equal(unknownval(), suite.get(3, latestSeq))
 }
 
 func (suite *TableSuite) TestTableDelete() {
@@ -69,8 +80,8 @@ func (suite *TableSuite) TestTableDelete() {
 	suite.w.Put(putU(2, "val 2"))
 	suite.w.Put(deleteU(3))
 	suite.DoneWriting()
-	suite.Equal(knowndelete(), suite.Get(3))
-	suite.Equal(unknownval(), suite.Get(7))
+	suite.Equal(knowndelete(), suite.get(3, latestSeq))
+	suite.Equal(unknownval(), suite.get(7, latestSeq))
 }
 
 func (suite *TableSuite) TestUpdates() {
@@ -96,5 +107,130 @@ func (suite *TableSuite) TestUpdates() {
 		}
 		entries = append(entries, it.Next())
 	}
+	suite.NoError(it.Err())
 	suite.Equal(updates, entries)
 }
+
+func putSeq(k int, seq uint64, v string) KeyUpdate {
+	u := putU(k, v)
+	u.Seq = seq
+	return u
+}
+
+func (suite *TableSuite) TestTableVersions() {
+	suite.w.Put(putSeq(1, 5, "val 1"))
+	suite.w.Put(putSeq(2, 7, "new 2"))
+	del := deleteU(2)
+	del.Seq = 4
+	suite.w.Put(del)
+	suite.w.Put(putSeq(2, 2, "old 2"))
+	suite.DoneWriting()
+	suite.Equal(someval("new 2"), suite.get(2, latestSeq))
+	suite.Equal(someval("new 2"), suite.get(2, 7))
+	suite.Equal(knowndelete(), suite.get(2, 6))
+	suite.Equal(someval("old 2"), suite.get(2, 3))
+	suite.Equal(unknownval(), suite.get(2, 1))
+	suite.Equal(unknownval(), suite.get(1, 4))
+}
+
+func (suite *TableSuite) TestVersionsInOneEntry() {
+	for k := 1; k <= 9; k++ {
+		suite.w.Put(putSeq(k, 1, "val"))
+	}
+	for seq := uint64(20); seq > 10; seq-- {
+		suite.w.Put(putSeq(10, seq, "val 10"))
+	}
+	suite.w.Put(putSeq(11, 1, "val 11"))
+	suite.DoneWriting()
+	for _, e := range suite.index.entries {
+		suite.False(e.Keys.Contains(intKey(10)) && !e.Keys.Min.Equal(intKey(1)),
+			"versions of a key should not be split across entries")
+	}
+	suite.Equal(someval("val 10"), suite.get(10, 15))
+	suite.Equal(unknownval(), suite.get(10, 5))
+}
+
+func (suite *TableSuite) TestOutOfOrder() {
+	suite.w.Put(putSeq(2, 1, "val 2"))
+	suite.Panics(func() { suite.w.Put(putSeq(1, 2, "val 1")) },
+		"keys should be increasing")
+	suite.w.Put(putSeq(3, 1, "old 3"))
+	suite.Panics(func() { suite.w.Put(putSeq(3, 2, "new 3")) },
+		"versions should be decreasing")
+}
+
+func (suite *TableSuite) TestLargeValues() {
+	large := strings.Repeat("x", 100*1024)
+	suite.w.Put(putU(1, "val 1"))
+	suite.w.Put(putU(2, large))
+	suite.w.Put(putU(3, "val 3"))
+	suite.w.Put(putU(4, large+large))
+	suite.DoneWriting()
+	suite.Equal(someval(large), suite.get(2, latestSeq))
+	suite.Equal(someval(large+large), suite.get(4, latestSeq))
+	suite.Equal(someval("val 3"), suite.get(3, latestSeq))
+	suite.True(len(suite.index.entries) > 1,
+		"large values should start new index entries")
+}
+
+// corrupt flips a bit of the table's file at offset
+func (suite *TableSuite) corrupt(offset uint64) {
+	f, err := suite.fs.Open(identToName(0))
+	suite.Require().NoError(err)
+	size, err := f.Size()
+	suite.Require().NoError(err)
+	data, err := f.ReadAt(0, size)
+	suite.Require().NoError(err)
+	f.Close()
+	data[offset] ^= 0x10
+	overwriteFile(suite.T(), suite.fs, identToName(0), data)
+}
+
+// checkCorruption checks that err reports corruption in the table at offset
+func (suite *TableSuite) checkCorruption(err error, offset uint64) {
+	var corruption *CorruptionError
+	suite.Require().True(errors.As(err, &corruption), "error %v should be a CorruptionError", err)
+	suite.True(errors.Is(err, ErrCorruption))
+	suite.Equal(identToName(0), corruption.Table)
+	suite.Equal(offset, corruption.Offset)
+}
+
+func (suite *TableSuite) TestCorruptEntry() {
+	suite.w.Put(putU(1, "val 1"))
+	suite.w.flush()
+	suite.w.Put(putU(2, "val 2"))
+	suite.DoneWriting()
+	h := suite.index.entries[1].Handle
+	suite.corrupt(h.Offset + 2)
+	t, err := OpenTable(0, suite.fs)
+	suite.Require().NoError(err, "the index should be intact")
+	defer t.f.Close()
+	mv, err := t.Get(intKey(1), latestSeq)
+	suite.NoError(err, "other entries should be readable")
+	suite.Equal(someval("val 1"), mv)
+	_, err = t.Get(intKey(2), latestSeq)
+	suite.checkCorruption(err, h.Offset)
+	it := t.Updates()
+	for it.HasNext() {
+		it.Next()
+	}
+	suite.checkCorruption(it.Err(), h.Offset)
+}
+
+func (suite *TableSuite) TestCorruptIndex() {
+	suite.w.Put(putU(1, "val 1"))
+	suite.DoneWriting()
+	offset := suite.index.entries[0].Handle.Length
+	suite.corrupt(offset + 1)
+	_, err := OpenTable(0, suite.fs)
+	suite.checkCorruption(err, offset)
+}
+
+func (suite *TableSuite) TestCorruptFooter() {
+	suite.w.Put(putU(1, "val 1"))
+	suite.DoneWriting()
+	footer := suite.Size() - footerSize
+	suite.corrupt(footer)
+	_, err := OpenTable(0, suite.fs)
+	suite.checkCorruption(err, footer)
+}
@@ -0,0 +1,348 @@
+package db
+
+// Key-value separation
+//
+// Large values are stored outside of tables, in append-only value logs, and
+// tables store only a pointer to the value. Compactions then only copy the
+// pointer, so that rewriting tables does not also rewrite large values (this
+// is the design of WiscKey).
+//
+// Values are separated when the log is converted to a table; each such table
+// gets its own value log (if it has any large values). A value log is a
+// sequence of records:
+//
+// record:
+//   key Key
+//   seq varint
+//   value [varint length]byte
+//
+// A value pointer addresses the value bytes of a record directly, so that a
+// value can be read with a single read.
+//
+// Once a value log is mostly dead (few of its values are still referenced by
+// any table), the garbage collector copies its live values to a new value log
+// and rewrites the tables that point to it.
+
+import (
+	"fmt"
+
+	"github.com/tchajed/specious-db/fs"
+)
+
+// gcLiveRatio is the fraction of a value log that must be live for it to be
+// kept; value logs with less live data are garbage collected.
+const gcLiveRatio = 0.5
+
+func vlogName(ident uint32) string {
+	return fmt.Sprintf("value-%06d.vlog", ident)
+}
+
+// A valuePointer locates a value stored in a value log.
+type valuePointer struct {
+	vlog   uint32
+	offset uint64
+	length uint64
+}
+
+// IsValid reports whether p points to a value, rather than being the zero
+// pointer used for updates that store their value inline.
+func (p valuePointer) IsValid() bool {
+	return p.vlog != 0
+}
+
+// A valueLog is a handle to a complete value log.
+type valueLog struct {
+	ident uint32
+	f     *sharedFile
+}
+
+func openValueLog(ident uint32, fs fs.Filesys) (valueLog, error) {
+	f, err := fs.Open(vlogName(ident))
+	if err != nil {
+		return valueLog{}, err
+	}
+	return valueLog{ident, newSharedFile(f)}, nil
+}
+
+// Name returns the filename used to store this value log.
+func (l valueLog) Name() string {
+	return vlogName(l.ident)
+}
+
+// valueLogs is the set of value logs in the database, which resolves value
+// pointers.
+type valueLogs []valueLog
+
+func (ls valueLogs) find(ident uint32) (valueLog, bool) {
+	for _, l := range ls {
+		if l.ident == ident {
+			return l, true
+		}
+	}
+	return valueLog{}, false
+}
+
+// Read reads the value p points to.
+func (ls valueLogs) Read(p valuePointer) (Value, error) {
+	l, ok := ls.find(p.vlog)
+	if !ok {
+		return nil, fmt.Errorf("%w: value log %s is missing",
+			ErrCorruption, vlogName(p.vlog))
+	}
+	data, err := l.f.ReadAt(int(p.offset), int(p.length))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != p.length {
+		return nil, fmt.Errorf("%w: value log %s at offset %d is cut off",
+			ErrCorruption, l.Name(), p.offset)
+	}
+	return data, nil
+}
+
+// Resolve returns u with its value read from a value log, if it has a value
+// pointer.
+func (ls valueLogs) Resolve(u KeyUpdate) (KeyUpdate, error) {
+	if !u.ptr.IsValid() {
+		return u, nil
+	}
+	v, err := ls.Read(u.ptr)
+	if err != nil {
+		return KeyUpdate{}, err
+	}
+	u.Value = v
+	u.ptr = valuePointer{}
+	return u, nil
+}
+
+// valueLogWriter creates a new value log.
+type valueLogWriter struct {
+	ident uint32
+	f     bufFile
+	w     Encoder
+}
+
+func newValueLogWriter(ident uint32, f fs.File, bufSize int) *valueLogWriter {
+	bw := newBufferedFile(f, bufSize)
+	return &valueLogWriter{ident, bw, newEncoder(bw)}
+}
+
+// Add appends the value of u to the value log, returning a pointer to it.
+//
+// Write errors are deferred until the value log is closed.
+func (w *valueLogWriter) Add(u KeyUpdate) valuePointer {
+	w.w.Key(u.Key)
+	w.w.VarInt(u.Seq)
+	w.w.VarInt(uint64(len(u.Value)))
+	offset := uint64(w.w.BytesWritten())
+	w.w.Bytes(u.Value)
+	return valuePointer{w.ident, offset, uint64(len(u.Value))}
+}
+
+// Close finishes writing the value log.
+func (w *valueLogWriter) Close() error {
+	if err := w.w.Err(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// valueRefs counts the bytes of each value log (by ident) that a table's
+// updates point to.
+type valueRefs map[uint32]uint64
+
+// valueRefs returns the bytes of each value log that t points to.
+//
+// Tables written by this process know this already; other tables are read the
+// first time (which is remembered by every copy of the table).
+//
+// Requires that the caller is the running compaction.
+func (t Table) valueRefs() (valueRefs, error) {
+	if *t.refs != nil {
+		return *t.refs, nil
+	}
+	refs := make(valueRefs)
+	it := t.Updates()
+	for it.HasNext() {
+		u := it.Next()
+		if u.ptr.IsValid() {
+			refs[u.ptr.vlog] += u.ptr.length
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	*t.refs = refs
+	return refs, nil
+}
+
+// liveValueBytes computes how many bytes of each value log are referenced by
+// tables, and which tables reference each value log.
+//
+// Requires that the caller is the running compaction.
+func liveValueBytes(levels [][]Table) (live map[uint32]uint64, refs map[uint32][]uint32, err error) {
+	live = make(map[uint32]uint64)
+	refs = make(map[uint32][]uint32)
+	for _, tables := range levels {
+		for _, t := range tables {
+			tableRefs, err := t.valueRefs()
+			if err != nil {
+				return nil, nil, err
+			}
+			for ident, n := range tableRefs {
+				live[ident] += n
+				refs[ident] = append(refs[ident], t.ident)
+			}
+		}
+	}
+	return live, refs, nil
+}
+
+// collectValueLogs garbage collects value logs that are mostly dead.
+//
+// The live values of each such value log are copied to a single new value
+// log, and every table that points to a collected value log is rewritten to
+// point to the new one. The rewritten tables keep all of their updates
+// (including their sequence numbers), so snapshots are unaffected.
+//
+// Requires the write lock (which is released while collecting), and that the
+// caller is the running compaction.
+func (db *Database) collectValueLogs() error {
+	if len(db.mf.vlogs) == 0 {
+		return nil
+	}
+	// only the running compaction changes the tables and value logs, so they
+	// can be read without the lock
+	levels := append([][]Table(nil), db.mf.tables...)
+	vlogs := db.mf.vlogs
+	db.l.Unlock()
+	replacements, newLog, collect, err := db.rewriteValueLogs(levels, vlogs)
+	db.l.Lock()
+	if err != nil || len(collect) == 0 {
+		return err
+	}
+	err = db.mf.InstallValueLogRewrite(replacements, newLog, collect)
+	if err != nil {
+		discardTables(db.fs, tableValues(replacements))
+		if newLog != nil {
+			newLog.f.Release()
+			db.fs.Delete(newLog.Name())
+		}
+	}
+	return err
+}
+
+func tableValues(tables map[uint32]Table) []Table {
+	var ts []Table
+	for _, t := range tables {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// rewriteValueLogs picks the value logs to collect and rewrites the tables
+// that point to them, returning the new tables (keyed by the ident of the
+// table each replaces) and value log (which is nil if the collected value logs
+// are entirely dead).
+//
+// Requires that the caller is the running compaction, and does not hold the
+// lock (which is acquired to create each file).
+func (db *Database) rewriteValueLogs(levels [][]Table, vlogs valueLogs) (replacements map[uint32]Table, newLog *valueLog, collect map[uint32]bool, err error) {
+	live, refs, err := liveValueBytes(levels)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	collect = make(map[uint32]bool)
+	for _, l := range vlogs {
+		size, err := l.f.Size()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if float64(live[l.ident]) < gcLiveRatio*float64(size) {
+			collect[l.ident] = true
+		}
+	}
+	if len(collect) == 0 {
+		return nil, nil, nil, nil
+	}
+	rewrite := make(map[uint32]bool)
+	for ident := range collect {
+		for _, t := range refs[ident] {
+			rewrite[t] = true
+		}
+	}
+	if len(rewrite) == 0 {
+		// the value logs are entirely dead
+		return nil, nil, collect, nil
+	}
+
+	db.l.Lock()
+	vlogIdent := db.mf.nextIdent
+	db.mf.nextIdent++
+	db.l.Unlock()
+	f, err := db.fs.Create(vlogName(vlogIdent))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	vw := newValueLogWriter(vlogIdent, f, db.opts.WriteBufferIOSize)
+	replacements = make(map[uint32]Table)
+	for level, tables := range levels {
+		for _, t := range tables {
+			if !rewrite[t.ident] {
+				continue
+			}
+			newTable, err := db.rewriteTable(t, level, vlogs, collect, vw)
+			if err != nil {
+				vw.Close()
+				db.fs.Delete(vlogName(vlogIdent))
+				discardTables(db.fs, tableValues(replacements))
+				return nil, nil, nil, err
+			}
+			replacements[t.ident] = newTable
+		}
+	}
+	err = vw.Close()
+	var vlog valueLog
+	if err == nil {
+		vlog, err = openValueLog(vlogIdent, db.fs)
+	}
+	if err != nil {
+		db.fs.Delete(vlogName(vlogIdent))
+		discardTables(db.fs, tableValues(replacements))
+		return nil, nil, nil, err
+	}
+	return replacements, &vlog, collect, nil
+}
+
+// rewriteTable copies a table at level, moving the values it points to in the
+// collected value logs to vw.
+//
+// Requires that the caller does not hold the lock.
+func (db *Database) rewriteTable(t Table, level int, vlogs valueLogs, collect map[uint32]bool, vw *valueLogWriter) (Table, error) {
+	db.l.Lock()
+	c, err := db.mf.CreateTable(level)
+	db.l.Unlock()
+	if err != nil {
+		return Table{}, err
+	}
+	it := t.Updates()
+	for it.HasNext() {
+		u := it.Next()
+		if u.ptr.IsValid() && collect[u.ptr.vlog] {
+			u, err = vlogs.Resolve(u)
+			if err != nil {
+				c.Abort()
+				return Table{}, err
+			}
+			u.ptr = vw.Add(u)
+			u.Value = nil
+		}
+		c.Put(u)
+	}
+	if err := it.Err(); err != nil {
+		c.Abort()
+		return Table{}, err
+	}
+	return c.Close()
+}
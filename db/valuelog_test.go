@@ -0,0 +1,189 @@
+package db
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ValueLogSuite struct {
+	*DbSuite
+}
+
+func TestValueLogSuite(t *testing.T) {
+	suite.Run(t, ValueLogSuite{&DbSuite{opts: &Options{ValueThreshold: 100}}})
+}
+
+func largeValue(i int) string {
+	return fmt.Sprintf("%d:", i) + strings.Repeat("x", 1000)
+}
+
+// files returns the names of the files in the database with a given suffix
+func (suite ValueLogSuite) files(suffix string) []string {
+	names, err := suite.fs.List()
+	suite.Require().NoError(err)
+	var files []string
+	for _, name := range names {
+		if strings.HasSuffix(name, suffix) {
+			files = append(files, path.Base(name))
+		}
+	}
+	return files
+}
+
+func (suite ValueLogSuite) TestSeparateLargeValues() {
+	for i := 1; i <= 10; i++ {
+		suite.db.Put(i, largeValue(i))
+	}
+	suite.db.Put(11, "small")
+	suite.Require().NoError(suite.db.compactLog())
+	suite.Len(suite.files(".vlog"), 1)
+	t := suite.db.mf.tables[0][0]
+	size, err := t.f.Size()
+	suite.Require().NoError(err)
+	suite.Less(size, 1000, "table should not hold large values")
+	for i := 1; i <= 11; i++ {
+		suite.check(i)
+	}
+	it := suite.db.Scan(KeyRange{Min: intKey(5), Max: intKey(6)})
+	suite.Require().True(it.HasNext())
+	suite.Equal(Value(largeValue(5)), it.Next().Value)
+	suite.Require().True(it.HasNext())
+	suite.Equal(Value(largeValue(6)), it.Next().Value)
+	suite.False(it.HasNext())
+	suite.NoError(it.Err())
+}
+
+func (suite ValueLogSuite) TestValueLogAcrossCompaction() {
+	suite.db.Put(1, largeValue(1))
+	suite.Require().NoError(suite.db.compactLog())
+	suite.db.Put(2, largeValue(2))
+	suite.db.Put(1, missing)
+	suite.Require().NoError(suite.db.Compact())
+	suite.crashRestart()
+	suite.check(1)
+	suite.check(2)
+}
+
+// collectValueLogs runs the value log garbage collector as a compaction
+func (suite ValueLogSuite) collectValueLogs() {
+	db := suite.db.Database
+	db.l.Lock()
+	defer db.l.Unlock()
+	db.startCompaction()
+	defer db.finishCompaction()
+	suite.Require().NoError(db.collectValueLogs())
+}
+
+// discardMostValues fills a value log and then makes most of it dead,
+// returning the value log's name.
+func (suite ValueLogSuite) discardMostValues() string {
+	for i := 1; i <= 10; i++ {
+		suite.db.Put(i, largeValue(i))
+	}
+	suite.Require().NoError(suite.db.compactLog())
+	oldLogs := suite.files(".vlog")
+	suite.Require().Len(oldLogs, 1)
+
+	// simulate a compaction that discards most of the values, by replacing
+	// the table with one that has only a few of its keys
+	old := suite.db.mf.tables[0][0]
+	c, err := suite.db.mf.CreateTable(0)
+	suite.Require().NoError(err)
+	it := old.Updates()
+	for it.HasNext() {
+		u := it.Next()
+		if u.Key.Compare(intKey(3)) <= 0 {
+			c.Put(u)
+		}
+	}
+	suite.Require().NoError(it.Err())
+	newTable, err := c.Close()
+	suite.Require().NoError(err)
+	suite.Require().NoError(suite.db.mf.InstallTable(newTable, nil,
+		[]uint32{old.ident}, nil, 0, suite.db.seq))
+	for i := 4; i <= 10; i++ {
+		delete(suite.db.gold, i)
+	}
+	return oldLogs[0]
+}
+
+func (suite ValueLogSuite) TestGarbageCollect() {
+	oldLog := suite.discardMostValues()
+	suite.collectValueLogs()
+	newLogs := suite.files(".vlog")
+	suite.Require().Len(newLogs, 1)
+	suite.NotEqual(oldLog, newLogs[0], "old value log should be collected")
+	for i := 1; i <= 10; i++ {
+		suite.check(i)
+	}
+	suite.crashRestart()
+	for i := 1; i <= 10; i++ {
+		suite.check(i)
+	}
+}
+
+func (suite ValueLogSuite) TestGarbageCollectRecoveredTables() {
+	oldLog := suite.discardMostValues()
+	// the recovered tables have to be read to find the live values
+	suite.crashRestart()
+	suite.collectValueLogs()
+	newLogs := suite.files(".vlog")
+	suite.Require().Len(newLogs, 1)
+	suite.NotEqual(oldLog, newLogs[0], "old value log should be collected")
+	for i := 1; i <= 10; i++ {
+		suite.check(i)
+	}
+}
+
+// liveFiles returns the names of the files of the database's tables and value
+// logs
+func (suite ValueLogSuite) liveFiles() []string {
+	var names []string
+	for _, tables := range suite.db.mf.tables {
+		for _, t := range tables {
+			names = append(names, t.Name())
+		}
+	}
+	for _, l := range suite.db.mf.vlogs {
+		names = append(names, l.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (suite ValueLogSuite) TestGarbageCollectClosesFiles() {
+	suite.Require().NoError(suite.db.Close())
+	filesys := newOpenFilesFs()
+	suite.fs = filesys
+	suite.db = newStringStore(MustInit(filesys, suite.opts))
+	oldLog := suite.discardMostValues()
+	suite.Equal(suite.liveFiles(), filesys.OpenFiles(),
+		"compaction should close the tables it replaces")
+	it := suite.db.Scan(AllKeys)
+	suite.collectValueLogs()
+	suite.Contains(filesys.OpenFiles(), oldLog,
+		"collected value log should stay open for an iterator")
+	for i := 1; i <= 3; i++ {
+		suite.Require().True(it.HasNext())
+		suite.Equal(Value(largeValue(i)), it.Next().Value)
+	}
+	suite.False(it.HasNext())
+	suite.NoError(it.Err())
+	suite.Equal(suite.liveFiles(), filesys.OpenFiles(),
+		"garbage collection should close the files it replaces")
+}
+
+func (suite ValueLogSuite) TestGarbageCollectLive() {
+	for i := 1; i <= 10; i++ {
+		suite.db.Put(i, largeValue(i))
+	}
+	suite.Require().NoError(suite.db.compactLog())
+	logs := suite.files(".vlog")
+	suite.collectValueLogs()
+	suite.Equal(logs, suite.files(".vlog"), "live value log should be kept")
+}
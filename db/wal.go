@@ -6,124 +6,302 @@ package db
 // sequence of KeyUpdates. Serves reads from an in-memory cache of the log.
 // Deletes are recorded in order to shadow older puts found in tables.
 
-// NOTE: log format supports multiple key updates in a log record, but the
-// external interface doesn't provides this (the low-level logUpdates supports
-// logging transactional writes and recoverUpdates will correctly handle
-// multiple updates in one record).
+// A log record holds multiple key updates, which is used to atomically log a
+// WriteBatch; recoverUpdates recovers either all or none of a record's updates.
+//
+// Every update carries its sequence number, both in the log and in the cache,
+// so that snapshots can read the cache as of an earlier point.
+//
+// Logs are numbered. Once a log is full, it is frozen (its cache becomes the
+// immutable memtable) and writes go to a new log with a larger number, while
+// the frozen log is flushed to a table in the background. Recovery replays
+// the logs that have not been flushed in order.
 
 import (
 	"bytes"
+	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/tchajed/specious-db/fs"
 	"github.com/tchajed/specious-db/log"
 )
 
+func logName(number uint32) string {
+	return fmt.Sprintf("log-%06d.log", number)
+}
+
+// parseLogName gets the number of a log from its filename.
+func parseLogName(name string) (number uint32, ok bool) {
+	if !strings.HasPrefix(name, "log-") || !strings.HasSuffix(name, ".log") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimSuffix(name[len("log-"):], ".log"), 10, 32)
+	if err != nil || logName(uint32(n)) != name {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
 // higher-level interface to log that supports writing operations and reading
 // from a cache of the log
 type dbLog struct {
-	log   log.Writer
-	cache entrySearchTree
+	number uint32
+	log    log.Writer
+	f      fs.File
+	sync   SyncPolicy
+	// unsynced is set when the log has writes that have not been synced
+	unsynced bool
+	cache    entrySearchTree
 	// an estimate of how big the log is (tracks puts, but does not account for
 	// encoding overhead or subtract for coalesced update)
 	sizeBytes int
 }
 
 type entrySearchTree struct {
-	// works because keys are uint64s
-	cache map[Key]MaybeValue
+	// keys are indexed by their contents (as strings, since slices cannot be
+	// map keys)
+	//
+	// each key maps to its versions from oldest to newest
+	cache map[string][]KeyUpdate
 }
 
 func newSearchTree() entrySearchTree {
-	return entrySearchTree{make(map[Key]MaybeValue)}
+	return entrySearchTree{make(map[string][]KeyUpdate)}
 }
 
-func (t entrySearchTree) Get(k Key) MaybeMaybeValue {
-	mv, ok := t.cache[k]
-	if ok {
-		return MaybeMaybeValue{true, mv}
+// Get finds the newest update to k with a sequence number no larger than seq.
+func (t entrySearchTree) Get(k Key, seq uint64) MaybeMaybeValue {
+	versions := t.cache[string(k)]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Seq <= seq {
+			return MaybeMaybeValue{true, versions[i].MaybeValue}
+		}
 	}
 	return MaybeMaybeValue{Valid: false}
 }
 
-func (t entrySearchTree) Put(k Key, v Value) {
-	t.cache[k] = SomeValue(v)
+// Add records a new version of a key.
+//
+// The previous version is retained only if a snapshot can see it, which is the
+// case if the newest snapshot (with sequence number latestSnapshot, or 0 if
+// there are none) is at least as new as it.
+func (t entrySearchTree) Add(u KeyUpdate, latestSnapshot uint64) {
+	versions := t.cache[string(u.Key)]
+	if n := len(versions); n > 0 && versions[n-1].Seq > latestSnapshot {
+		versions[n-1] = u
+		return
+	}
+	t.cache[string(u.Key)] = append(versions, u)
 }
 
-func (t entrySearchTree) Delete(k Key) {
-	t.cache[k] = NoValue
+// updateLess orders updates by key, with newer updates to the same key first.
+//
+// This is the order updates are stored in within tables.
+func updateLess(u1, u2 KeyUpdate) bool {
+	if c := u1.Key.Compare(u2.Key); c != 0 {
+		return c < 0
+	}
+	return u1.Seq > u2.Seq
 }
 
 func sortUpdates(es []KeyUpdate) {
-	sort.Slice(es, func(i, j int) bool { return es[i].Key < es[j].Key })
+	sort.Slice(es, func(i, j int) bool { return updateLess(es[i], es[j]) })
 }
 
 func (t entrySearchTree) Updates() []KeyUpdate {
-	updates := make([]KeyUpdate, 0, len(t.cache))
-	for k, ku := range t.cache {
-		updates = append(updates, KeyUpdate{k, ku})
+	return t.UpdatesIn(AllKeys)
+}
+
+// UpdatesIn returns all versions of the keys in r, sorted by key and then from
+// newest to oldest.
+func (t entrySearchTree) UpdatesIn(r KeyRange) []KeyUpdate {
+	var updates []KeyUpdate
+	for _, versions := range t.cache {
+		if r.Contains(versions[0].Key) {
+			updates = append(updates, versions...)
+		}
 	}
 	sortUpdates(updates)
 	return updates
 }
 
-func (l dbLog) Get(k Key) MaybeMaybeValue {
-	return l.cache.Get(k)
+// MaxSeq returns the largest sequence number in the cache (or 0 if it is
+// empty).
+func (t entrySearchTree) MaxSeq() uint64 {
+	seq := uint64(0)
+	for _, versions := range t.cache {
+		if s := versions[len(versions)-1].Seq; s > seq {
+			seq = s
+		}
+	}
+	return seq
 }
 
-func (l dbLog) logUpdates(es []KeyUpdate) {
-	b := bytes.NewBuffer(make([]byte, 0, 8+2+len(es[0].Value)))
+func (l dbLog) Get(k Key, seq uint64) MaybeMaybeValue {
+	return l.cache.Get(k, seq)
+}
+
+func (l *dbLog) logUpdates(es []KeyUpdate, sync bool) error {
+	b := bytes.NewBuffer(make([]byte, 0, len(es[0].Key)+8+2+len(es[0].Value)))
 	w := newEncoder(b)
 	for _, e := range es {
 		w.KeyUpdate(e)
 	}
-	l.log.Add(b.Bytes())
+	if err := l.log.Add(b.Bytes()); err != nil {
+		return err
+	}
+	l.unsynced = true
+	if sync || l.sync == SyncAlways {
+		return l.Sync()
+	}
+	return nil
 }
 
-func (l *dbLog) Put(k Key, v Value) {
-	l.logUpdates([]KeyUpdate{{k, SomeValue(v)}})
-	l.cache.Put(k, v)
-	l.sizeBytes += 8 + len(v)
+// Sync makes the logged updates durable, if any have not been synced yet.
+func (l *dbLog) Sync() error {
+	if !l.unsynced {
+		return nil
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.unsynced = false
+	return nil
+}
+
+// Append logs a sequence of updates as a single transaction, syncing the log
+// before returning if sync is set or the sync policy is SyncAlways.
+//
+// Append only writes the log file, and does not add the updates to the cache,
+// so that it can be called without the database lock (the group commit leader
+// does so, since it is the only writer); the caller adds the updates with
+// Apply once they are logged.
+func (l *dbLog) Append(es []KeyUpdate, sync bool) error {
+	if len(es) == 0 {
+		if sync {
+			// make earlier writes durable
+			return l.Sync()
+		}
+		return nil
+	}
+	return l.logUpdates(es, sync)
 }
 
-func (l dbLog) Delete(k Key) {
-	l.logUpdates([]KeyUpdate{{k, NoValue}})
-	l.cache.Delete(k)
+// Apply adds logged updates to the cache.
+//
+// The updates should already have sequence numbers assigned.
+func (l *dbLog) Apply(es []KeyUpdate, latestSnapshot uint64) {
+	for _, e := range es {
+		l.cache.Add(e, latestSnapshot)
+		l.sizeBytes += len(e.Key) + len(e.Value)
+	}
 }
 
 func (l dbLog) Updates() []KeyUpdate {
 	return l.cache.Updates()
 }
 
+// UpdatesIn returns an iterator over a copy of the logged updates to keys in
+// r.
+func (l dbLog) UpdatesIn(r KeyRange) UpdateIterator {
+	it := sliceUpdateIterator(l.cache.UpdatesIn(r))
+	return &it
+}
+
 func (l dbLog) SizeEstimate() int {
 	return l.sizeBytes
 }
 
-func initLog(fs fs.Filesys) *dbLog {
-	f := fs.Create("log")
+// initLog creates a new, empty log.
+func initLog(fs fs.Filesys, number uint32, sync SyncPolicy) (*dbLog, error) {
+	f, err := fs.Create(logName(number))
+	if err != nil {
+		return nil, err
+	}
 	log := log.New(f)
-	return &dbLog{log, newSearchTree(), 0}
+	return &dbLog{number: number, log: log, f: f, sync: sync, cache: newSearchTree()}, nil
+}
+
+// readOnlyLog creates a dbLog that serves reads of updates recovered from the
+// log, but has no file for new writes.
+func readOnlyLog(updates []KeyUpdate) *dbLog {
+	l := &dbLog{cache: newSearchTree()}
+	for _, u := range updates {
+		l.cache.Add(u, 0)
+		l.sizeBytes += len(u.Key) + len(u.Value)
+	}
+	return l
+}
+
+// liveLogs returns the numbers of the logs numbered logNumber or above, which
+// have not been flushed to tables, in order.
+func liveLogs(filesys fs.Filesys, logNumber uint32) ([]uint32, error) {
+	files, err := listFiles(filesys)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []uint32
+	for _, name := range files[logFile] {
+		if n, _ := parseLogName(name); n >= logNumber {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+// recoverUpdates reads the updates in a sequence of logs, returning the newest
+// version of each key (there are no snapshots during recovery) and the
+// largest sequence number used.
+//
+// Each log is replayed up to its first incomplete or corrupt record; the
+// number of bytes discarded from all of the logs is returned as well.
+func recoverUpdates(fs fs.Filesys, numbers []uint32) (updates []KeyUpdate, maxSeq uint64, discarded int, err error) {
+	// replay the updates in order so later updates to a key take precedence
+	cache := newSearchTree()
+	for _, number := range numbers {
+		n, err := replayLog(fs, number, cache)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("%s: %w", logName(number), err)
+		}
+		discarded += n
+	}
+	return cache.Updates(), cache.MaxSeq(), discarded, nil
 }
 
-func recoverUpdates(fs fs.Filesys) []KeyUpdate {
-	f := fs.Open("log")
-	txns := log.RecoverTxns(f)
-	err := f.Close()
+// replayLog adds the updates in a log to cache, returning the number of bytes
+// at the end of the log that were discarded.
+func replayLog(fs fs.Filesys, number uint32, cache entrySearchTree) (discarded int, err error) {
+	f, err := fs.Open(logName(number))
+	if err != nil {
+		return 0, err
+	}
+	recovered, err := log.Recover(f)
+	f.Close()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	updates := make([]KeyUpdate, 0, len(txns))
-	for _, txn := range txns {
+	for _, txn := range recovered.Txns {
 		r := newDecoder(txn)
 		for r.RemainingBytes() > 0 {
-			e := r.KeyUpdate()
-			updates = append(updates, e)
+			u := r.KeyUpdate()
+			if r.Err() == nil {
+				cache.Add(u, 0)
+			}
+		}
+		if err := r.Err(); err != nil {
+			return 0, err
 		}
 	}
-	sortUpdates(updates)
-	return updates
+	return recovered.Discarded, nil
 }
 
-func (l dbLog) Close() {
-	l.log.Close()
+func (l dbLog) Close() error {
+	if l.f == nil {
+		// a read-only log
+		return nil
+	}
+	return l.log.Close()
 }
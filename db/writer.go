@@ -0,0 +1,160 @@
+package db
+
+// Group commit
+//
+// Concurrent writes are queued, and the writer at the front of the queue (the
+// leader) logs its own updates along with those of the writers behind it as a
+// single log record, with a single sync. The other writers in the group wait
+// for the leader to report that their updates are logged, which lets
+// concurrent writers share the cost of writing (and syncing) the log.
+//
+// The leader only holds the database lock to make room for the write and
+// assign sequence numbers, and then to add the updates to the log's cache; it
+// writes and syncs the log without the lock, so that reads are not held up by
+// the log write. Since the leader is the only writer, the queue orders log
+// writes; the log is otherwise only changed by compactLog, which waits for the
+// leader (see logWriting).
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxGroupBytes limits how many bytes of updates the leader combines into a
+// group, so that a large group does not delay its first writer too much.
+const maxGroupBytes = 1 << 20
+
+// A writer is a write waiting in the queue.
+type writer struct {
+	updates []KeyUpdate
+	sync    bool
+	// set by the leader that logs this write
+	done bool
+	err  error
+	// signalled when the write is done or this writer becomes the leader
+	cond *sync.Cond
+}
+
+func (w *writer) size() int {
+	size := 0
+	for _, u := range w.updates {
+		size += len(u.Key) + len(u.Value)
+	}
+	return size
+}
+
+// writeQueue is the queue of pending writes.
+type writeQueue struct {
+	m       *sync.Mutex
+	writers []*writer
+}
+
+func newWriteQueue() *writeQueue {
+	return &writeQueue{m: new(sync.Mutex)}
+}
+
+// Group returns the writers the leader (the front of the queue) should log
+// together.
+//
+// Requires q.m.
+func (q *writeQueue) Group() []*writer {
+	size := q.writers[0].size()
+	n := 1
+	for ; n < len(q.writers); n++ {
+		size += q.writers[n].size()
+		if size > maxGroupBytes {
+			break
+		}
+	}
+	return q.writers[:n]
+}
+
+// Finish removes a group of writers from the front of the queue, reporting err
+// to them, and wakes up the next leader.
+func (q *writeQueue) Finish(n int, err error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for _, w := range q.writers[:n] {
+		w.done = true
+		w.err = err
+		w.cond.Signal()
+	}
+	q.writers = q.writers[n:]
+	if len(q.writers) > 0 {
+		q.writers[0].cond.Signal()
+	}
+}
+
+// write logs updates as a single transaction, possibly in a group with other
+// concurrent writes.
+//
+// Must be called without holding the lock.
+func (db *Database) write(updates []KeyUpdate, wo WriteOptions) error {
+	q := db.writers
+	w := &writer{updates: updates, sync: wo.Sync, cond: sync.NewCond(q.m)}
+	q.m.Lock()
+	q.writers = append(q.writers, w)
+	for !w.done && q.writers[0] != w {
+		w.cond.Wait()
+	}
+	if w.done {
+		// a leader logged this write
+		q.m.Unlock()
+		return w.err
+	}
+	group := q.Group()
+	q.m.Unlock()
+
+	err := db.writeGroup(group)
+	q.Finish(len(group), err)
+	return err
+}
+
+// writeGroup assigns sequence numbers to the updates of a group of writers and
+// logs them as a single transaction.
+//
+// Must be called without holding the lock.
+func (db *Database) writeGroup(group []*writer) error {
+	var es []KeyUpdate
+	syncLog := false
+	for _, w := range group {
+		es = append(es, w.updates...)
+		syncLog = syncLog || w.sync
+	}
+	db.l.Lock()
+	if len(es) > 0 {
+		if err := db.makeRoomForWrite(); err != nil {
+			db.l.Unlock()
+			return err
+		}
+	} else if db.err != nil {
+		db.l.Unlock()
+		return db.err
+	}
+	// the sequence numbers are only used once the updates are in the cache,
+	// so that a snapshot taken in the meantime does not see them
+	seq := db.seq
+	for i := range es {
+		// the updates were copied from the caller's keys and values by
+		// newPut and newDelete, so they can be kept in the log's cache
+		seq++
+		es[i].Seq = seq
+	}
+	l := db.log
+	db.logWriting = true
+	db.l.Unlock()
+
+	err := l.Append(es, syncLog)
+
+	db.l.Lock()
+	defer db.l.Unlock()
+	db.logWriting = false
+	db.bgCond.Broadcast()
+	if err != nil {
+		db.err = fmt.Errorf("database is read-only after log write failed: %w", err)
+		return err
+	}
+	l.Apply(es, db.snapshots.Latest())
+	db.seq = seq
+	return nil
+}
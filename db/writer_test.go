@@ -0,0 +1,144 @@
+package db
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tchajed/specious-db/fs"
+)
+
+// concurrentPuts has each of several goroutines put a range of keys
+func concurrentPuts(db *Database, writers, puts int, wo WriteOptions) {
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < puts; i++ {
+				k := w*puts + i
+				must(db.PutWith(intKey(k), []byte("val"), wo))
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	filesys := fs.MemFs()
+	db := MustInit(filesys, &Options{WriteBufferSize: 1024})
+	concurrentPuts(db, 8, 100, WriteOptions{})
+	require.NoError(t, db.waitForCompactions())
+	assert.Equal(t, uint64(800), db.seq)
+	assert.NotEmpty(t, append(db.mf.tables[0], db.mf.tables[1]...),
+		"full log should be compacted")
+	require.NoError(t, db.Close())
+	db = MustOpen(filesys, nil)
+	for k := 0; k < 800; k++ {
+		v, err := db.Get(intKey(k))
+		require.NoError(t, err)
+		assert.True(t, v.Present, "key %d should be present", k)
+	}
+}
+
+// slowSyncFs makes syncs slow, so that writers queue up behind a sync
+type slowSyncFs struct {
+	syncCountingFs
+}
+
+type slowSyncFile struct {
+	fs.File
+}
+
+func (f slowSyncFile) Sync() error {
+	time.Sleep(time.Millisecond)
+	return f.File.Sync()
+}
+
+func (filesys slowSyncFs) Create(fname string) (fs.File, error) {
+	f, err := filesys.syncCountingFs.Create(fname)
+	if err != nil {
+		return f, err
+	}
+	return slowSyncFile{f}, nil
+}
+
+func TestGroupCommit(t *testing.T) {
+	filesys := slowSyncFs{newSyncCountingFs()}
+	db := MustInit(filesys, nil)
+	concurrentPuts(db, 8, 20, WriteOptions{Sync: true})
+	assert.Less(t, filesys.Syncs(), 8*20, "concurrent writes should share syncs")
+	for k := 0; k < 8*20; k++ {
+		v, err := db.Get(intKey(k))
+		require.NoError(t, err)
+		assert.True(t, v.Present, "key %d should be present", k)
+	}
+}
+
+// blockingSyncFs blocks syncs of the log until released
+type blockingSyncFs struct {
+	fs.Filesys
+	// receives when a sync starts
+	started chan struct{}
+	// closed to let syncs finish
+	release chan struct{}
+}
+
+type blockingSyncFile struct {
+	fs.File
+	filesys blockingSyncFs
+}
+
+func (f blockingSyncFile) Sync() error {
+	select {
+	case f.filesys.started <- struct{}{}:
+	default:
+	}
+	<-f.filesys.release
+	return f.File.Sync()
+}
+
+func (filesys blockingSyncFs) Create(fname string) (fs.File, error) {
+	f, err := filesys.Filesys.Create(fname)
+	if err != nil || parseFileName(fname) != logFile {
+		return f, err
+	}
+	return blockingSyncFile{f, filesys}, nil
+}
+
+func TestReadDuringSync(t *testing.T) {
+	assert := assert.New(t)
+	filesys := blockingSyncFs{fs.MemFs(), make(chan struct{}, 1), make(chan struct{})}
+	db := MustInit(filesys, nil)
+	require.NoError(t, db.Put(intKey(1), []byte("val 1")))
+	putDone := make(chan error)
+	go func() {
+		putDone <- db.PutWith(intKey(2), []byte("val 2"), WriteOptions{Sync: true})
+	}()
+	<-filesys.started
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		v, err := db.Get(intKey(1))
+		assert.NoError(err)
+		assert.Equal(SomeValue([]byte("val 1")), v)
+		v, err = db.Get(intKey(2))
+		assert.NoError(err)
+		assert.False(v.Present, "a write should not be visible until it is logged")
+	}()
+	select {
+	case <-readDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reads should not wait for a log sync")
+	}
+
+	close(filesys.release)
+	require.NoError(t, <-putDone)
+	v, err := db.Get(intKey(2))
+	assert.NoError(err)
+	assert.Equal(SomeValue([]byte("val 2")), v)
+	require.NoError(t, db.Close())
+}
@@ -2,37 +2,57 @@ package fs
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"sync"
 
 	"github.com/spf13/afero"
 )
 
-func (s *Stats) readOp(bytes int) {
-	s.ReadOps++
-	s.ReadBytes += bytes
+// statsCounter accumulates Stats, which can be updated concurrently (for
+// example, by a database's background compaction).
+type statsCounter struct {
+	m     sync.Mutex
+	stats Stats
 }
 
-func (s *Stats) writeOp(bytes int) {
-	s.WriteOps++
-	s.WriteBytes += bytes
+func (s *statsCounter) readOp(bytes int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.stats.ReadOps++
+	s.stats.ReadBytes += bytes
+}
+
+func (s *statsCounter) writeOp(bytes int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.stats.WriteOps++
+	s.stats.WriteBytes += bytes
+}
+
+func (s *statsCounter) get() Stats {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.stats
 }
 
 type aferoFs struct {
 	fs afero.Afero
-	*Stats
+	*statsCounter
+	locker locker
 }
 
 type readFile struct {
 	afero.File
-	*Stats
+	*statsCounter
 }
 
-func (f readFile) Size() int {
+func (f readFile) Size() (int, error) {
 	st, err := f.Stat()
 	if err != nil {
-		panic(err)
+		return 0, &Error{"stat", f.Name(), err}
 	}
-	return int(st.Size())
+	return int(st.Size()), nil
 }
 
 func (f readFile) Read(buf []byte) (int, error) {
@@ -40,119 +60,141 @@ func (f readFile) Read(buf []byte) (int, error) {
 	return f.File.Read(buf)
 }
 
-func (f readFile) ReadAt(offset int, length int) []byte {
+func (f readFile) ReadAt(offset int, length int) ([]byte, error) {
 	defer f.readOp(length)
 	p := make([]byte, length)
 	n, err := f.File.ReadAt(p, int64(offset))
 	if n != len(p) {
-		panic(fmt.Errorf("short ReadAt(%d, %d) -> %d bytes for %s", offset, length, n, f.File.Name()))
+		return nil, &Error{"read", f.Name(),
+			fmt.Errorf("short ReadAt(%d, %d) -> %d bytes", offset, length, n)}
 	}
-	if err != nil {
-		panic(err)
+	// a full read may report io.EOF, which is not an error
+	if err != nil && err != io.EOF {
+		return nil, &Error{"read", f.Name(), err}
 	}
-	return p
+	return p, nil
 }
 
 func abs(fname string) string {
 	return fmt.Sprintf("/%s", fname)
 }
 
-func (fs aferoFs) Open(fname string) ReadFile {
+func (fs aferoFs) Open(fname string) (ReadFile, error) {
 	f, err := fs.fs.Open(abs(fname))
 	if err != nil {
-		panic(err)
+		return nil, &Error{"open", fname, err}
 	}
-	return readFile{f, fs.Stats}
+	return readFile{f, fs.statsCounter}, nil
 }
 
 type writeFile struct {
 	afero.File
-	*Stats
+	*statsCounter
 }
 
-func (f writeFile) Sync() {
+func (f writeFile) Sync() error {
 	err := f.File.Sync()
 	if err != nil {
-		panic(err)
+		return &Error{"sync", f.Name(), err}
 	}
+	return nil
 }
 
 func (f writeFile) Write(p []byte) (n int, err error) {
 	defer f.writeOp(len(p))
-	return f.File.Write(p)
+	n, err = f.File.Write(p)
+	if err != nil {
+		return n, &Error{"write", f.Name(), err}
+	}
+	return n, nil
 }
 
-func (fs aferoFs) Create(fname string) File {
+func (fs aferoFs) Create(fname string) (File, error) {
 	f, err := fs.fs.Create(abs(fname))
 	if err != nil {
-		panic(err)
+		return nil, &Error{"create", fname, err}
 	}
-	return writeFile{f, fs.Stats}
+	return writeFile{f, fs.statsCounter}, nil
 }
 
-func (fs aferoFs) List() []string {
+func (fs aferoFs) List() ([]string, error) {
 	names, err := afero.Glob(fs.fs, abs("*"))
 	if err != nil {
-		panic(err)
+		return nil, &Error{"list", "/", err}
 	}
-	return names
+	return names, nil
 }
 
-func (fs aferoFs) Delete(fname string) {
+func (fs aferoFs) Delete(fname string) error {
 	err := fs.fs.Remove(abs(fname))
 	if err != nil {
-		panic(err)
+		return &Error{"delete", fname, err}
 	}
+	return nil
 }
 
-func (fs aferoFs) Rename(src, dst string) {
+func (fs aferoFs) Rename(src, dst string) error {
 	err := fs.fs.Rename(abs(src), abs(dst))
 	if err != nil {
-		panic(err)
+		return &Error{"rename", src, err}
 	}
+	return nil
 }
 
-func (fs aferoFs) Truncate(fname string) {
+func (fs aferoFs) Truncate(fname string) error {
 	f, err := fs.fs.OpenFile(abs(fname), os.O_WRONLY|os.O_TRUNC, 0)
 	if err != nil {
-		panic(err)
+		return &Error{"truncate", fname, err}
 	}
 	err = f.Close()
 	if err != nil {
-		panic(err)
+		return &Error{"truncate", fname, err}
 	}
+	return nil
 }
 
-func (fs aferoFs) AtomicCreateWith(fname string, data []byte) {
+func (fs aferoFs) AtomicCreateWith(fname string, data []byte) error {
 	tmpFile := abs(fmt.Sprintf("%s.tmp", fname))
 	err := fs.fs.WriteFile(tmpFile, data, 0644)
 	if err != nil {
-		panic(err)
+		return &Error{"create", fname, err}
 	}
-	f, _ := fs.fs.Open(tmpFile)
-	f.Sync()
+	f, err := fs.fs.Open(tmpFile)
+	if err != nil {
+		return &Error{"create", fname, err}
+	}
+	err = f.Sync()
 	f.Close()
+	if err != nil {
+		return &Error{"sync", fname, err}
+	}
 	err = fs.fs.Rename(tmpFile, abs(fname))
 	if err != nil {
-		panic(err)
+		return &Error{"rename", fname, err}
 	}
+	return nil
+}
+
+func (fs aferoFs) Lock(fname string) (Lock, error) {
+	return fs.locker.lock(fname)
 }
 
 func (fs aferoFs) GetStats() Stats {
-	return *fs.Stats
+	return fs.statsCounter.get()
 }
 
-func deleteTmpFiles(fs afero.Fs) {
+func deleteTmpFiles(fs afero.Fs) error {
 	tmpFiles, err := afero.Glob(fs, abs("*.tmp"))
 	if err != nil {
-		panic(err)
+		return &Error{"list", "/", err}
 	}
 	for _, n := range tmpFiles {
 		err = fs.Remove(abs(n))
 		if err != nil {
-			panic(err)
+			return &Error{"delete", n, err}
 		}
 	}
+	return nil
 }
 
 // FromAfero creates an fs.Filesys from any Afero file system.
@@ -162,32 +204,46 @@ func deleteTmpFiles(fs afero.Fs) {
 // particular directory.
 //
 // Deletes all files named *.tmp, as a file-system recovery for AtomicCreateWith.
-func FromAfero(fs afero.Fs) Filesys {
-	deleteTmpFiles(fs)
-	return aferoFs{fs: afero.Afero{Fs: fs}, Stats: new(Stats)}
+//
+// Locks are only exclusive among users of the returned Filesys.
+func FromAfero(fs afero.Fs) (Filesys, error) {
+	return fromAfero(fs, newMemLocker(fs))
+}
+
+func fromAfero(fs afero.Fs, l locker) (Filesys, error) {
+	err := deleteTmpFiles(fs)
+	if err != nil {
+		return nil, err
+	}
+	return aferoFs{fs: afero.Afero{Fs: fs}, statsCounter: new(statsCounter), locker: l}, nil
 }
 
 // MemFs creates an in-memory Filesys
 func MemFs() Filesys {
-	fs := afero.NewMemMapFs()
-	return FromAfero(fs)
+	fs, err := FromAfero(afero.NewMemMapFs())
+	if err != nil {
+		// a new in-memory file system has no files to clean up
+		panic(err)
+	}
+	return fs
 }
 
 // DirFs creates a Filesys backed by the OS, using basedir.
 //
-// Creates basedir if it does not exist.
-func DirFs(basedir string) Filesys {
+// Creates basedir if it does not exist. Locks are exclusive across processes
+// (using flock(2)).
+func DirFs(basedir string) (Filesys, error) {
 	fs := afero.NewOsFs()
 	ok, err := afero.Exists(fs, basedir)
 	if err != nil {
-		panic(err)
+		return nil, &Error{"stat", basedir, err}
 	}
 	if !ok {
 		err = fs.Mkdir(basedir, 0755)
 		if err != nil {
-			panic(err)
+			return nil, &Error{"mkdir", basedir, err}
 		}
 	}
 	baseFs := afero.NewBasePathFs(fs, basedir)
-	return FromAfero(baseFs)
+	return fromAfero(baseFs, newOsLocker(basedir))
 }
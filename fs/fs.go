@@ -1,20 +1,22 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"os"
 )
 
 // File is a writeable file.
 type File interface {
 	io.WriteCloser
-	Sync()
+	Sync() error
 }
 
 // ReadFile is a read-only file.
 type ReadFile interface {
-	Size() int
-	ReadAt(offset int, length int) []byte
+	Size() (int, error)
+	ReadAt(offset int, length int) ([]byte, error)
 	io.ReadCloser
 }
 
@@ -27,6 +29,44 @@ type Stats struct {
 	WriteBytes int
 }
 
+var (
+	// ErrNotFound is reported when opening or modifying a file that does not
+	// exist.
+	ErrNotFound = errors.New("file not found")
+	// ErrIO is reported for any other failed filesystem operation.
+	ErrIO = errors.New("I/O error")
+)
+
+// An Error records a failed filesystem operation.
+//
+// Errors satisfy errors.Is for ErrNotFound, ErrLocked, or ErrIO, depending on
+// the underlying error.
+type Error struct {
+	Op   string
+	Name string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Name, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes Errors match ErrNotFound or ErrIO.
+func (e *Error) Is(target error) bool {
+	notFound := os.IsNotExist(e.Err)
+	switch target {
+	case ErrNotFound:
+		return notFound
+	case ErrIO:
+		return !notFound && e.Err != ErrLocked
+	}
+	return false
+}
+
 // Filesys is a database-specific API for accessing the file system.
 //
 // Note that an instance of this interface only exposes a single directory
@@ -37,36 +77,62 @@ type Stats struct {
 //   Create:    fname should not exist
 //   Delete:    fname should exist
 //   Truncate:  fname should exist
+//
+// Failures are reported as an *Error.
 type Filesys interface {
 	// read-only APIs
 
-	Open(fname string) ReadFile
-	List() []string
+	Open(fname string) (ReadFile, error)
+	List() ([]string, error)
 
 	// modifications
 
-	Create(fname string) File
-	Delete(fname string)
-	Truncate(fname string)
-	Rename(src, dst string)
-	AtomicCreateWith(fname string, data []byte)
+	Create(fname string) (File, error)
+	Delete(fname string) error
+	Truncate(fname string) error
+	Rename(src, dst string) error
+	AtomicCreateWith(fname string, data []byte) error
+
+	// Lock creates fname if necessary and locks it exclusively, failing with
+	// ErrLocked if it is already locked.
+	Lock(fname string) (Lock, error)
 
 	// performance counters
 	GetStats() Stats
 }
 
 // DeleteAll deletes all files within a Filesys (which is a single directory).
-func DeleteAll(fs Filesys) {
-	for _, f := range fs.List() {
-		fs.Delete(f)
+func DeleteAll(fs Filesys) error {
+	files, err := fs.List()
+	if err != nil {
+		return err
 	}
+	for _, f := range files {
+		err = fs.Delete(f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Debug prints out all the files in a Filesys, along with their sizes.
-func Debug(fs Filesys) {
-	for _, fname := range fs.List() {
-		f := fs.Open(fname)
-		fmt.Printf("%-20s %3d bytes\n", fname, f.Size())
+func Debug(fs Filesys) error {
+	files, err := fs.List()
+	if err != nil {
+		return err
+	}
+	for _, fname := range files {
+		f, err := fs.Open(fname)
+		if err != nil {
+			return err
+		}
+		sz, err := f.Size()
 		f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-20s %3d bytes\n", fname, sz)
 	}
+	return nil
 }
@@ -1,10 +1,13 @@
 package fs
 
 import (
-	"fmt"
+	"errors"
 	"io/ioutil"
+	"os"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -22,27 +25,29 @@ func (suite *FsSuite) SetupTest() {
 }
 
 func (suite FsSuite) CreateFile(fname string, contents []byte) {
-	f := suite.fs.Create(fname)
+	f, err := suite.fs.Create(fname)
+	suite.Require().NoError(err)
 	n, err := f.Write(contents)
-	if n < len(contents) {
-		panic(fmt.Errorf("short write %d/%d bytes", n, len(contents)))
-	}
-	if err != nil {
-		panic(err)
-	}
-	f.Close()
+	suite.Require().NoError(err)
+	suite.Require().Equal(len(contents), n, "short write")
+	suite.Require().NoError(f.Close())
 }
 
 func (suite FsSuite) ReadFile(fname string) []byte {
-	f := suite.fs.Open(fname)
+	f, err := suite.fs.Open(fname)
+	suite.Require().NoError(err)
 	data, err := ioutil.ReadAll(f)
-	if err != nil {
-		panic(err)
-	}
+	suite.Require().NoError(err)
 	f.Close()
 	return data
 }
 
+func (suite FsSuite) List() []string {
+	names, err := suite.fs.List()
+	suite.Require().NoError(err)
+	return names
+}
+
 func (suite FsSuite) TestCreate() {
 	suite.CreateFile("foo", []byte{2})
 	suite.Equal([]byte{2}, suite.ReadFile("foo"),
@@ -56,14 +61,14 @@ func (suite FsSuite) TestCreateBar() {
 }
 
 func (suite FsSuite) TestAtomicCreate() {
-	suite.fs.AtomicCreateWith("foo", []byte{2})
+	suite.NoError(suite.fs.AtomicCreateWith("foo", []byte{2}))
 	suite.Equal([]byte{2}, suite.ReadFile("foo"),
 		"file should have correct contents")
 }
 
 func (suite FsSuite) TestTruncate() {
 	suite.CreateFile("foo", []byte{1, 2, 3})
-	suite.fs.Truncate("foo")
+	suite.NoError(suite.fs.Truncate("foo"))
 	suite.Equal([]byte{}, suite.ReadFile("foo"),
 		"truncate should empty file")
 }
@@ -71,42 +76,98 @@ func (suite FsSuite) TestTruncate() {
 func (suite FsSuite) TestList() {
 	suite.CreateFile("foo", []byte{})
 	suite.CreateFile("bar", []byte{})
-	suite.Equal([]string{"/bar", "/foo"}, suite.fs.List())
+	suite.Equal([]string{"/bar", "/foo"}, suite.List())
 }
 
 func (suite FsSuite) TestDelete() {
 	suite.CreateFile("foo", []byte{})
-	suite.Equal([]string{"/foo"}, suite.fs.List())
-	suite.fs.Delete("foo")
-	suite.Empty(suite.fs.List())
+	suite.Equal([]string{"/foo"}, suite.List())
+	suite.NoError(suite.fs.Delete("foo"))
+	suite.Empty(suite.List())
 }
 
 func (suite FsSuite) TestRename() {
 	suite.CreateFile("foo", []byte{1,2,3})
-	suite.fs.Rename("foo", "bar")
-	suite.Equal([]string{"/bar"}, suite.fs.List())
+	suite.NoError(suite.fs.Rename("foo", "bar"))
+	suite.Equal([]string{"/bar"}, suite.List())
 	suite.Equal([]byte{1,2,3}, suite.ReadFile("bar"),
 		"rename should preserve contents")
 }
 
 func (suite FsSuite) TestSize() {
 	suite.CreateFile("foo", []byte{1, 2, 3})
-	f := suite.fs.Open("foo")
-	suite.Equal(3, f.Size())
+	f, err := suite.fs.Open("foo")
+	suite.Require().NoError(err)
+	sz, err := f.Size()
+	suite.NoError(err)
+	suite.Equal(3, sz)
 	f.Close()
 }
 
 func (suite FsSuite) TestReadAt() {
 	suite.CreateFile("foo", []byte{1, 2, 3})
-	f := suite.fs.Open("foo")
-	suite.Equal([]byte{2}, f.ReadAt(1, 1))
-	suite.Equal([]byte{2, 3}, f.ReadAt(1, 2))
+	f, err := suite.fs.Open("foo")
+	suite.Require().NoError(err)
+	data, err := f.ReadAt(1, 1)
+	suite.NoError(err)
+	suite.Equal([]byte{2}, data)
+	data, err = f.ReadAt(1, 2)
+	suite.NoError(err)
+	suite.Equal([]byte{2, 3}, data)
+}
+
+func (suite FsSuite) TestReadAtShort() {
+	suite.CreateFile("foo", []byte{1, 2, 3})
+	f, err := suite.fs.Open("foo")
+	suite.Require().NoError(err)
+	_, err = f.ReadAt(2, 2)
+	suite.True(errors.Is(err, ErrIO), "short read should be an I/O error")
+}
+
+func (suite FsSuite) TestNotFound() {
+	_, err := suite.fs.Open("foo")
+	suite.True(errors.Is(err, ErrNotFound), "open of missing file should be not found")
+	suite.False(errors.Is(err, ErrIO))
+	err = suite.fs.Delete("foo")
+	suite.True(errors.Is(err, ErrNotFound), "delete of missing file should be not found")
 }
 
 func (suite FsSuite) TestDeleteAll() {
 	suite.CreateFile("foo", nil)
 	suite.CreateFile("bar", nil)
-	suite.Equal(2, len(suite.fs.List()))
-	DeleteAll(suite.fs)
-	suite.Empty(suite.fs.List())
+	suite.Equal(2, len(suite.List()))
+	suite.NoError(DeleteAll(suite.fs))
+	suite.Empty(suite.List())
+}
+
+func (suite FsSuite) TestLock() {
+	l, err := suite.fs.Lock("LOCK")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"/LOCK"}, suite.List(), "lock should create the file")
+	_, err = suite.fs.Lock("LOCK")
+	suite.True(errors.Is(err, ErrLocked), "second lock should fail")
+	suite.False(errors.Is(err, ErrIO))
+	suite.NoError(l.Unlock())
+	l, err = suite.fs.Lock("LOCK")
+	suite.Require().NoError(err, "lock should be available after unlock")
+	suite.NoError(l.Unlock())
+}
+
+func TestDirLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "specious-fs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs1, err := DirFs(dir)
+	require.NoError(t, err)
+	fs2, err := DirFs(dir)
+	require.NoError(t, err)
+	l, err := fs1.Lock("LOCK")
+	require.NoError(t, err)
+	_, err = fs2.Lock("LOCK")
+	assert.True(t, errors.Is(err, ErrLocked),
+		"lock through another DirFs should fail (got %v)", err)
+	require.NoError(t, l.Unlock())
+	l, err = fs2.Lock("LOCK")
+	require.NoError(t, err, "lock should be available after unlock")
+	assert.NoError(t, l.Unlock())
 }
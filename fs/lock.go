@@ -0,0 +1,63 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// ErrLocked is reported when locking a file that is already locked.
+var ErrLocked = errors.New("file is locked")
+
+// A Lock is an exclusive lock on a file, obtained from Filesys.Lock.
+type Lock interface {
+	// Unlock releases the lock.
+	Unlock() error
+}
+
+// a locker implements Filesys.Lock
+type locker interface {
+	lock(fname string) (Lock, error)
+}
+
+// memLocker locks files with an in-process registry, which makes locks
+// exclusive among the users of one Filesys.
+type memLocker struct {
+	fs   afero.Fs
+	m    *sync.Mutex
+	held map[string]bool
+}
+
+func newMemLocker(fs afero.Fs) memLocker {
+	return memLocker{fs: fs, m: new(sync.Mutex), held: make(map[string]bool)}
+}
+
+type memLock struct {
+	l     memLocker
+	fname string
+}
+
+func (l memLocker) lock(fname string) (Lock, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.held[fname] {
+		return nil, &Error{"lock", fname, ErrLocked}
+	}
+	// create the lock file, as a file system lock would
+	f, err := l.fs.OpenFile(abs(fname), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, &Error{"lock", fname, err}
+	}
+	f.Close()
+	l.held[fname] = true
+	return memLock{l, fname}, nil
+}
+
+func (l memLock) Unlock() error {
+	l.l.m.Lock()
+	defer l.l.m.Unlock()
+	delete(l.l.held, l.fname)
+	return nil
+}
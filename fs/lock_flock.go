@@ -0,0 +1,49 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// osLocker locks files in a directory with flock(2), which makes locks
+// exclusive across processes (and among separate opens within a process).
+type osLocker struct {
+	basedir string
+}
+
+func newOsLocker(basedir string) locker {
+	return osLocker{basedir}
+}
+
+type osLock struct {
+	f *os.File
+}
+
+func (l osLocker) lock(fname string) (Lock, error) {
+	f, err := os.OpenFile(filepath.Join(l.basedir, fname), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, &Error{"lock", fname, err}
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			err = ErrLocked
+		}
+		return nil, &Error{"lock", fname, err}
+	}
+	return osLock{f}, nil
+}
+
+func (l osLock) Unlock() error {
+	// closing the file releases the lock
+	err := l.f.Close()
+	if err != nil {
+		return &Error{"unlock", filepath.Base(l.f.Name()), err}
+	}
+	return nil
+}
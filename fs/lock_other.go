@@ -0,0 +1,29 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package fs
+
+import (
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	dirLockersM sync.Mutex
+	dirLockers  = make(map[string]memLocker)
+)
+
+// newOsLocker falls back to an in-process registry (shared by every DirFs for
+// the same directory) on platforms without flock, so locks are not exclusive
+// across processes.
+func newOsLocker(basedir string) locker {
+	dirLockersM.Lock()
+	defer dirLockersM.Unlock()
+	l, ok := dirLockers[basedir]
+	if !ok {
+		l = newMemLocker(afero.NewBasePathFs(afero.NewOsFs(), basedir))
+		dirLockers[basedir] = l
+	}
+	return l
+}
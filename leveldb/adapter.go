@@ -1,25 +1,19 @@
 package leveldb
 
 import (
-	"encoding/binary"
-	"sync"
+	"runtime"
 
 	"github.com/jmhodges/levigo"
 	"github.com/tchajed/specious-db/db"
 )
 
 // Database is a wrapper around a LevelDB database
+//
+// Keys are passed to LevelDB unchanged, since LevelDB's default bytewise
+// comparator orders them the same way as db.Key.
 type Database struct {
 	db *levigo.DB
-	// scratch space to create key buffers
-	keyDataPool *sync.Pool
-	wo          *levigo.WriteOptions
-}
-
-func newKeyDataPool() *sync.Pool {
-	return &sync.Pool{New: func() interface{} {
-		return make([]byte, 8)
-	}}
+	wo *levigo.WriteOptions
 }
 
 func levelDbOpts() *levigo.Options {
@@ -39,59 +33,111 @@ func levelDbOpts() *levigo.Options {
 // New creates a LevelDB instance at path.
 //
 // Creates the path if it does not exist.
-func New(path string) *Database {
+func New(path string) (*Database, error) {
 	db, err := levigo.Open(path, levelDbOpts())
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	pool := newKeyDataPool()
 	wo := levigo.NewWriteOptions()
-	return &Database{db, pool, wo}
-}
-
-// fromDbKey converts a db.Key (a uint64) to a byte slice for usage with leveldb
-func (d Database) fromDbKey(k db.Key) []byte {
-	keyScratch := d.keyDataPool.Get().([]byte)
-	binary.LittleEndian.PutUint64(keyScratch, uint64(k))
-	return keyScratch
+	return &Database{db, wo}, nil
 }
 
 // Get retrieves a key from the database.
-func (d Database) Get(k db.Key) db.MaybeValue {
+func (d Database) Get(k db.Key) (db.MaybeValue, error) {
 	ro := levigo.NewReadOptions()
-	data, err := d.db.Get(ro, d.fromDbKey(k))
+	data, err := d.db.Get(ro, k)
 	if err != nil {
-		panic(err)
+		return db.NoValue, err
 	}
 	if data == nil {
-		return db.NoValue
+		return db.NoValue, nil
 	}
-	return db.SomeValue(data)
+	return db.SomeValue(data), nil
 }
 
 // Put inserts a key into the database.
-func (d Database) Put(k db.Key, v db.Value) {
-	err := d.db.Put(d.wo, d.fromDbKey(k), v)
-	if err != nil {
-		panic(err)
-	}
+func (d Database) Put(k db.Key, v db.Value) error {
+	return d.db.Put(d.wo, k, v)
 }
 
 // Delete deletes a key from the database.
-func (d Database) Delete(k db.Key) {
-	err := d.db.Delete(d.wo, d.fromDbKey(k))
-	if err != nil {
-		panic(err)
+func (d Database) Delete(k db.Key) error {
+	return d.db.Delete(d.wo, k)
+}
+
+type iterator struct {
+	it   *levigo.Iterator
+	keys db.KeyRange
+	// set once the underlying iterator has been released
+	closed bool
+	err    error
+}
+
+func (i *iterator) close() {
+	if !i.closed {
+		i.closed = true
+		i.err = i.it.GetError()
+		i.it.Close()
+	}
+}
+
+func (i *iterator) HasNext() bool {
+	if i.closed {
+		return false
+	}
+	if !i.it.Valid() || !i.keys.Contains(i.it.Key()) {
+		i.close()
+		return false
+	}
+	return true
+}
+
+func (i *iterator) Err() error {
+	return i.err
+}
+
+func (i *iterator) Next() db.Entry {
+	e := db.Entry{Key: i.it.Key(), Value: i.it.Value()}
+	i.it.Next()
+	return e
+}
+
+// Scan iterates over the entries with keys in r, in key order.
+//
+// The LevelDB iterator is released once it is exhausted (or when the iterator
+// is garbage collected).
+func (d Database) Scan(r db.KeyRange) db.Iterator {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	it := &iterator{it: d.db.NewIterator(ro), keys: r}
+	runtime.SetFinalizer(it, (*iterator).close)
+	it.it.Seek(r.Min)
+	return it
+}
+
+// Write applies a batch of updates atomically, using a LevelDB WriteBatch.
+func (d Database) Write(b *db.WriteBatch) error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	for _, u := range b.Updates() {
+		if u.IsPut() {
+			wb.Put(u.Key, u.Value)
+		} else {
+			wb.Delete(u.Key)
+		}
 	}
+	return d.db.Write(d.wo, wb)
 }
 
 // Close shuts down the database.
-func (d Database) Close() {
+func (d Database) Close() error {
 	d.wo.Close()
 	d.db.Close()
+	return nil
 }
 
 // Compact runs log and sstable compaction.
-func (d Database) Compact() {
+func (d Database) Compact() error {
 	d.db.CompactRange(levigo.Range{})
+	return nil
 }
@@ -19,21 +19,57 @@ package log
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 
 	"github.com/tchajed/specious-db/bin"
 )
 
+// A log starts with a header giving its format version, followed by one
+// record per transaction:
+//
+// log:
+//   magic uint32
+//   version uint32
+//   record*
+//
+// record:
+//   length uint32
+//   crc uint32
+//   data [length]byte
+//
+// The CRC (CRC32C) covers the length and the data, so a record that was only
+// partly written (a torn write) or was corrupted afterward is detected rather
+// than recovered.
+//
+// Version 1 logs have no header. Each transaction is stored as one or more
+// data records, which hold consecutive chunks of the transaction's data with
+// 16-bit lengths, followed by a commit record; recovery still reads these logs.
+
+const (
+	logMagic uint32 = 0x10c5ec10
+	// logVersion is the current log format
+	logVersion uint32 = 2
+	headerSize        = 4 + 4
+	// recordHeaderSize is the size of a record's length and CRC
+	recordHeaderSize = 4 + 4
+)
+
+// record types in version 1 logs
 const (
 	invalidRecord uint8 = iota
 	dataRecord
 	commitRecord
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // Writer gives access to a transactional log backed by an io.WriteCloser.
 // Transactions are uninterpreted byte arrays. Assuming writes (appends) to this
-// interface are persisted in order, log.RecoverTxns allows to recover any
+// interface are persisted in order, log.Recover allows to recover any
 // committed and persisted transactions even if the system halts in the middle
 // of adding a transaction. During normal operation the caller is expected to
 // record transactions in memory (probably in a non-byte-array format) and
@@ -44,61 +80,148 @@ type Writer struct {
 	enc *bin.Encoder
 }
 
-// New allocates a new log.Writer around a file.
+// New allocates a new log.Writer around a file, writing the log's header.
+//
+// The file should be empty. An error writing the header is reported by the
+// first Add.
 func New(f io.WriteCloser) Writer {
-	return Writer{f, bin.NewEncoder(f)}
+	enc := bin.NewEncoder(f)
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint32(header[:4], logMagic)
+	binary.LittleEndian.PutUint32(header[4:], logVersion)
+	enc.Bytes(header[:])
+	return Writer{f, enc}
 }
 
 // Add records a transaction in the log file.
-func (l Writer) Add(data []byte) {
-	buf := bytes.NewBuffer(make([]byte, 0, 1+2+len(data)+1))
-	localEnc := bin.NewEncoder(buf)
-	localEnc.Uint8(dataRecord)
-	localEnc.Array16(data)
-	localEnc.Uint8(commitRecord)
-	l.enc.Bytes(buf.Bytes())
+//
+// Once Add fails, the log may have a partially-written transaction at the end,
+// and the Writer should not be used any further.
+func (l Writer) Add(data []byte) error {
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(record[:4], uint32(len(data)))
+	copy(record[recordHeaderSize:], data)
+	binary.LittleEndian.PutUint32(record[4:8], recordChecksum(record))
+	l.enc.Bytes(record)
+	return l.enc.Err()
+}
+
+// recordChecksum computes the CRC of an encoded record (which covers
+// everything but the CRC itself).
+func recordChecksum(record []byte) uint32 {
+	crc := crc32.Checksum(record[:4], crcTable)
+	return crc32.Update(crc, crcTable, record[recordHeaderSize:])
 }
 
 // Close finishes writing the log. The Writer should not be used afterward.
-func (l Writer) Close() {
-	err := l.log.Close()
-	if err != nil {
-		panic(err)
-	}
+func (l Writer) Close() error {
+	return l.log.Close()
 }
 
-// RecoverTxns returns any committed and persisted transactions from a reader
-// over a log file, handling partial writes to the log.
-func RecoverTxns(log io.Reader) (txns [][]byte) {
+// Recovery is the result of recovering a log.
+type Recovery struct {
+	// Txns are the committed transactions, in order.
+	Txns [][]byte
+	// Discarded is the number of bytes at the end of the log that were not
+	// recovered, because they do not hold a complete, valid record (the
+	// result of a torn write or of corruption).
+	Discarded int
+}
+
+// Recover returns the committed and persisted transactions from a reader over
+// a log file, handling partial writes to the log.
+//
+// Recovery stops at the first record that is incomplete or fails its checksum,
+// discarding the rest of the log. Only a log with an unknown version is
+// reported as corrupt, with an error wrapping bin.ErrCorrupt.
+func Recover(log io.Reader) (Recovery, error) {
 	buf, err := ioutil.ReadAll(log)
 	if err != nil {
-		panic(err)
+		return Recovery{}, err
 	}
-	dec := bin.NewDecoder(buf)
-	for {
-		// here we decode as much as possible, stopping early if we run out of
-		// bytes (unfortunately the binary decoding library doesn't have good
-		// support for stopping early and will panic if there aren't enough
-		// bytes)
-		if dec.RemainingBytes() == 0 {
-			return
+	if len(buf) < headerSize {
+		if isHeaderPrefix(buf) {
+			// the header was not completely written, so the log has no
+			// transactions
+			return Recovery{Discarded: len(buf)}, nil
 		}
-		ty := dec.Uint8()
-		if ty != dataRecord {
-			panic("expected data record")
-		}
-		len := dec.Uint16()
-		if dec.RemainingBytes() < int(len) {
-			return
+		return recoverV1(buf), nil
+	}
+	if binary.LittleEndian.Uint32(buf[:4]) != logMagic {
+		return recoverV1(buf), nil
+	}
+	if version := binary.LittleEndian.Uint32(buf[4:headerSize]); version != logVersion {
+		return Recovery{}, fmt.Errorf("%w: unknown log version %d", bin.ErrCorrupt, version)
+	}
+	return recoverRecords(buf[headerSize:]), nil
+}
+
+// RecoverTxns is Recover, returning only the recovered transactions.
+func RecoverTxns(log io.Reader) (txns [][]byte, err error) {
+	r, err := Recover(log)
+	return r.Txns, err
+}
+
+// isHeaderPrefix reports whether b is the start of a log header.
+func isHeaderPrefix(b []byte) bool {
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint32(header[:4], logMagic)
+	binary.LittleEndian.PutUint32(header[4:], logVersion)
+	return bytes.HasPrefix(header[:], b)
+}
+
+// recoverRecords recovers the transactions from the records after the header.
+func recoverRecords(buf []byte) Recovery {
+	var r Recovery
+	for len(buf) >= recordHeaderSize {
+		n := binary.LittleEndian.Uint32(buf[:4])
+		if uint64(n) > uint64(len(buf)-recordHeaderSize) {
+			break
 		}
-		data := dec.Bytes(int(len))
-		if dec.RemainingBytes() == 0 {
-			return
+		record := buf[:recordHeaderSize+int(n)]
+		if binary.LittleEndian.Uint32(record[4:8]) != recordChecksum(record) {
+			break
 		}
-		ty = dec.Uint8()
-		if ty != commitRecord {
-			panic("expected commit record")
+		r.Txns = append(r.Txns, record[recordHeaderSize:])
+		buf = buf[len(record):]
+	}
+	r.Discarded = len(buf)
+	return r
+}
+
+// recoverV1 recovers the transactions from a version 1 log, stopping at the
+// first transaction that is incomplete or has an invalid record.
+func recoverV1(buf []byte) Recovery {
+	dec := bin.NewDecoder(buf)
+	var r Recovery
+	// the data records of the current (not yet committed) transaction
+	var chunks [][]byte
+	// the number of bytes before the current transaction
+	committed := 0
+	for dec.RemainingBytes() > 0 {
+		ty := dec.Uint8()
+		if ty == dataRecord {
+			chunk := dec.Array16()
+			if dec.Err() != nil {
+				break
+			}
+			chunks = append(chunks, chunk)
+		} else if ty == commitRecord && len(chunks) > 0 {
+			r.Txns = append(r.Txns, joinChunks(chunks))
+			chunks = nil
+			committed = len(buf) - dec.RemainingBytes()
+		} else {
+			break
 		}
-		txns = append(txns, data)
 	}
+	r.Discarded = len(buf) - committed
+	return r
+}
+
+// joinChunks assembles a transaction from its data records
+func joinChunks(chunks [][]byte) []byte {
+	if len(chunks) == 1 {
+		return chunks[0]
+	}
+	return bytes.Join(chunks, nil)
 }
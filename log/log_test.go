@@ -1,9 +1,16 @@
 package log
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"testing"
 
-import "github.com/stretchr/testify/assert"
-import "github.com/spf13/afero"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tchajed/specious-db/bin"
+)
 
 func TestLogEmpty(t *testing.T) {
 	assert := assert.New(t)
@@ -11,7 +18,8 @@ func TestLogEmpty(t *testing.T) {
 	f, _ := fs.Create("log")
 	f.Close()
 	f, _ = fs.Open("log")
-	txns := RecoverTxns(f)
+	txns, err := RecoverTxns(f)
+	assert.NoError(err)
 	assert.Empty(txns, "empty file should be an empty log")
 }
 
@@ -22,8 +30,22 @@ func newLog() (afero.Fs, Writer) {
 }
 
 func recoverLog(fs afero.Fs) [][]byte {
+	return recoverWithDiscarded(fs).Txns
+}
+
+func recoverWithDiscarded(fs afero.Fs) Recovery {
 	f, _ := fs.Open("log")
-	return RecoverTxns(f)
+	r, err := Recover(f)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func writeLog(fs afero.Fs, data []byte) {
+	f, _ := fs.Create("log")
+	f.Write(data)
+	f.Close()
 }
 
 func TestLogNoTxns(t *testing.T) {
@@ -72,3 +94,122 @@ func TestLogEmptyTxn(t *testing.T) {
 		{4},
 	}, txns, "should recover an empty txn")
 }
+
+func TestLogPartialTxn(t *testing.T) {
+	assert := assert.New(t)
+	fs, w := newLog()
+	w.Add([]byte{1, 2, 3})
+	w.Add([]byte{4, 5})
+	w.Close()
+	data, _ := afero.ReadFile(fs, "log")
+	firstEnd := headerSize + recordHeaderSize + 3
+	for n := len(data) - 1; n >= firstEnd; n-- {
+		writeLog(fs, data[:n])
+		r := recoverWithDiscarded(fs)
+		assert.Equal([][]byte{{1, 2, 3}}, r.Txns,
+			"should recover only complete txns from %d bytes", n)
+		assert.Equal(n-firstEnd, r.Discarded)
+	}
+	for n := firstEnd - 1; n >= 0; n-- {
+		writeLog(fs, data[:n])
+		assert.Empty(recoverLog(fs), "should recover no txns from %d bytes", n)
+	}
+}
+
+func TestLogCorrupt(t *testing.T) {
+	assert := assert.New(t)
+	fs, w := newLog()
+	w.Add([]byte{1, 2, 3})
+	w.Add([]byte{4, 5})
+	w.Add([]byte{6})
+	w.Close()
+	data, _ := afero.ReadFile(fs, "log")
+	secondStart := headerSize + recordHeaderSize + 3
+	// corrupt the length, the CRC, and the data of the second record
+	for _, offset := range []int{0, 5, recordHeaderSize + 1} {
+		corrupt := append([]byte(nil), data...)
+		corrupt[secondStart+offset] ^= 0x40
+		writeLog(fs, corrupt)
+		r := recoverWithDiscarded(fs)
+		assert.Equal([][]byte{{1, 2, 3}}, r.Txns,
+			"should stop at corrupt record (offset %d)", offset)
+		assert.Equal(len(data)-secondStart, r.Discarded)
+	}
+}
+
+func TestLogGarbage(t *testing.T) {
+	assert := assert.New(t)
+	fs := afero.NewMemMapFs()
+	writeLog(fs, []byte{7, 0, 0})
+	r := recoverWithDiscarded(fs)
+	assert.Empty(r.Txns)
+	assert.Equal(3, r.Discarded, "garbage should be discarded")
+}
+
+func TestLogUnknownVersion(t *testing.T) {
+	fs, w := newLog()
+	w.Add([]byte{1})
+	w.Close()
+	data, _ := afero.ReadFile(fs, "log")
+	data[4] = 7
+	writeLog(fs, data)
+	f, _ := fs.Open("log")
+	_, err := Recover(f)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, bin.ErrCorrupt), "unknown version should be corruption")
+}
+
+func TestLogLargeTxn(t *testing.T) {
+	assert := assert.New(t)
+	fs, w := newLog()
+	large := make([]byte, 3*(1<<16)+10)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	w.Add([]byte{1})
+	w.Add(large)
+	w.Add([]byte{2})
+	w.Close()
+	txns := recoverLog(fs)
+	assert.Equal([][]byte{{1}, large, {2}}, txns,
+		"should recover large txns")
+}
+
+func TestLogPartialLargeTxn(t *testing.T) {
+	assert := assert.New(t)
+	fs, w := newLog()
+	w.Add([]byte{1})
+	w.Add(make([]byte, 2*(1<<16)))
+	w.Close()
+	data, _ := afero.ReadFile(fs, "log")
+	for _, n := range []int{len(data) - 1, len(data) - 100} {
+		writeLog(fs, data[:n])
+		assert.Equal([][]byte{{1}}, recoverLog(fs),
+			"should not recover part of a txn")
+	}
+}
+
+func TestLogVersion1(t *testing.T) {
+	assert := assert.New(t)
+	fs := afero.NewMemMapFs()
+	large := make([]byte, 1<<16+10)
+	var buf bytes.Buffer
+	enc := bin.NewEncoder(&buf)
+	enc.Uint8(dataRecord)
+	enc.Array16([]byte{1, 2, 3})
+	enc.Uint8(commitRecord)
+	// a txn split across data records
+	enc.Uint8(dataRecord)
+	enc.Array16(large[:1<<16-1])
+	enc.Uint8(dataRecord)
+	enc.Array16(large[1<<16-1:])
+	enc.Uint8(commitRecord)
+	committed := buf.Len()
+	// a partial txn
+	enc.Uint8(dataRecord)
+	enc.Array16([]byte{4})
+	writeLog(fs, buf.Bytes())
+	r := recoverWithDiscarded(fs)
+	assert.Equal([][]byte{{1, 2, 3}, large}, r.Txns, "should read version 1 logs")
+	assert.Equal(buf.Len()-committed, r.Discarded)
+}